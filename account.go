@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Password reset and email verification by emailed one-time links.
+// Like api tokens, only the hash of each token is stored. Links are built
+// from siteBaseUrl, never from the request's Host header, so a forged
+// request can't send someone a link to another site.
+
+const USERTOKEN_RESETPWD = 1
+const USERTOKEN_VERIFYEMAIL = 2
+
+const RESETPWD_MAXAGE = time.Hour
+const VERIFYEMAIL_MAXAGE = 7 * 24 * time.Hour
+
+type UserToken struct {
+	Userid   int64
+	Kind     int
+	Email    string // email address the token was sent to
+	Expiredt string
+}
+
+func createUserToken(db *sql.DB, userid int64, kind int, email string, maxage time.Duration) (string, error) {
+	tok := randomToken(32)
+	expiredt := time.Now().UTC().Add(maxage).Format(time.RFC3339)
+	s := "INSERT INTO usertoken (tokenhash, user_id, kind, email, createdt, expiredt) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := sqlexec(db, s, hashToken(tok), userid, kind, email, nowUTC(), expiredt)
+	if err != nil {
+		return "", err
+	}
+	return tok, nil
+}
+
+// Returns sql.ErrNoRows if the token doesn't exist or has expired.
+func queryUserToken(db *sql.DB, tok string, kind int) (*UserToken, error) {
+	var t UserToken
+	s := "SELECT user_id, kind, email, expiredt FROM usertoken WHERE tokenhash = ? AND kind = ?"
+	row := db.QueryRow(s, hashToken(tok), kind)
+	err := row.Scan(&t.Userid, &t.Kind, &t.Email, &t.Expiredt)
+	if err != nil {
+		return nil, err
+	}
+	if isTokenExpired(t.Expiredt) {
+		return nil, sql.ErrNoRows
+	}
+	return &t, nil
+}
+
+// Tokens are used once, and any other outstanding tokens of the same kind go too.
+func delUserTokens(db *sql.DB, userid int64, kind int) error {
+	s := "DELETE FROM usertoken WHERE user_id = ? AND kind = ?"
+	_, err := sqlexec(db, s, userid, kind)
+	return err
+}
+
+func delExpiredUserTokens(db *sql.DB) error {
+	s := "DELETE FROM usertoken WHERE expiredt < ?"
+	_, err := sqlexec(db, s, nowUTC())
+	return err
+}
+
+func sendVerifyEmail(db *sql.DB, site *Site, u *User) error {
+	if u.Email == "" {
+		return nil
+	}
+	tok, err := createUserToken(db, u.Userid, USERTOKEN_VERIFYEMAIL, u.Email, VERIFYEMAIL_MAXAGE)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(`Hi %s,
+
+Please confirm your email address for %s by opening this link:
+
+%s/verifyemail/?tok=%s
+
+If you didn't create an account, you can ignore this email.
+`, u.Username, site.Title, siteBaseUrl, tok)
+	sendMail(u.Email, fmt.Sprintf("%s: confirm your email address", site.Title), body)
+	return nil
+}
+
+func sendResetPwdEmail(db *sql.DB, site *Site, u *User) error {
+	tok, err := createUserToken(db, u.Userid, USERTOKEN_RESETPWD, u.Email, RESETPWD_MAXAGE)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(`Hi %s,
+
+Someone asked to reset the password of your %s account. To choose a new password, open this link within the hour:
+
+%s/resetpwd/?tok=%s
+
+If it wasn't you, you can ignore this email. Your password hasn't been changed.
+`, u.Username, site.Title, siteBaseUrl, tok)
+	sendMail(u.Email, fmt.Sprintf("%s: reset your password", site.Title), body)
+	return nil
+}
+
+func queryUserByEmail(db *sql.DB, email string) *User {
+	var userid int64 = -1
+	s := "SELECT user_id FROM user WHERE email = ? AND email <> '' ORDER BY user_id LIMIT 1"
+	err := db.QueryRow(s, email).Scan(&userid)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("queryUserByEmail() db error (%s)\n", err)
+	}
+	return queryUser(db, userid)
+}
+
+func forgotpwdHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+		var fname string
+		var sent bool
+
+		login := getLoginUser(r, db)
+		site := querySite(db)
+
+		if r.Method == "POST" {
+			fname = strings.TrimSpace(r.FormValue("name"))
+			for {
+				if fname == "" {
+					errmsg = "Please enter your username or email."
+					break
+				}
+				errmsg = checkRateLimit(db, site, r, login, RATE_RESETPWD)
+				if errmsg != "" {
+					break
+				}
+				u := queryUsername(db, fname)
+				if u.Userid == -1 {
+					u = queryUserByEmail(db, fname)
+				}
+				// Same response whether or not the account exists,
+				// so the form can't be used to find out who has an account.
+				if u.Userid != -1 && u.Active && u.Email != "" && allowResetPwdEmail(db, site, u) {
+					err := sendResetPwdEmail(db, site, u)
+					if err != nil {
+						log.Printf("DB error creating reset password token: %s\n", err)
+						errmsg = "A problem occured. Please try again."
+						break
+					}
+				}
+				sent = true
+				break
+			}
+		}
+
+		data := struct {
+			Page
+			Name string
+			Sent bool
+		}{newPage(r, db, login, site), fname, sent}
+		data.Errmsg = errmsg
+		renderPage(w, "forgotpwd.html", data)
+	}
+}
+
+// /resetpwd/?tok=<token> from the forgot password email.
+func resetpwdHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+		var f struct{ password, password2 string }
+
+		login := getLoginUser(r, db)
+		site := querySite(db)
+
+		qtok := r.FormValue("tok")
+		t, err := queryUserToken(db, qtok, USERTOKEN_RESETPWD)
+		if err == sql.ErrNoRows {
+			http.Error(w, "This password reset link is invalid or has expired.", 404)
+			return
+		}
+		if handleDbErr(w, err, "resetpwdhandler") {
+			return
+		}
+		u := queryUser(db, t.Userid)
+		if u.Userid == -1 || !u.Active {
+			http.Error(w, "This password reset link is invalid or has expired.", 404)
+			return
+		}
+
+		if r.Method == "POST" {
+			f.password = r.FormValue("password")
+			f.password2 = r.FormValue("password2")
+			for {
+				if f.password == "" {
+					errmsg = "Please enter a new password."
+					break
+				}
+				if f.password != f.password2 {
+					errmsg = "re-entered password doesn't match"
+					f.password = ""
+					f.password2 = ""
+					break
+				}
+
+				s := "UPDATE user SET password = ? WHERE user_id = ?"
+				_, err := sqlexec(db, s, hashPassword(f.password), u.Userid)
+				if err == nil {
+					err = delUserTokens(db, u.Userid, USERTOKEN_RESETPWD)
+				}
+				if err == nil {
+					// Whoever knew the old password is logged out.
+					err = delUserSessions(db, u.Userid)
+				}
+				if err != nil {
+					log.Printf("DB error resetting password: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+
+				http.Redirect(w, r, "/login/", http.StatusSeeOther)
+				return
+			}
+		}
+
+		data := struct {
+			Page
+			Tok       string
+			Username  string
+			Password  string
+			Password2 string
+		}{newPage(r, db, login, site), qtok, u.Username, f.password, f.password2}
+		data.Errmsg = errmsg
+		renderPage(w, "resetpwd.html", data)
+	}
+}
+
+// GET /verifyemail/?tok=<token> from the verification email.
+// POST /verifyemail/ resends the verification email to the login user.
+func verifyemailHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := getLoginUser(r, db)
+		site := querySite(db)
+
+		var msg string
+		if r.Method == "POST" {
+			if !validateSessionLogin(w, login) {
+				return
+			}
+			if !validateCsrf(w, r, login) {
+				return
+			}
+			if login.Email == "" || login.Emailverified {
+				http.Redirect(w, r, "/usersetup/", http.StatusSeeOther)
+				return
+			}
+			err := sendVerifyEmail(db, site, login)
+			if handleDbErr(w, err, "verifyemailhandler") {
+				return
+			}
+			msg = fmt.Sprintf("A confirmation link has been sent to %s.", login.Email)
+		} else {
+			t, err := queryUserToken(db, r.FormValue("tok"), USERTOKEN_VERIFYEMAIL)
+			if err == sql.ErrNoRows {
+				http.Error(w, "This confirmation link is invalid or has expired.", 404)
+				return
+			}
+			if handleDbErr(w, err, "verifyemailhandler") {
+				return
+			}
+
+			// Email may have been changed since the link was sent.
+			s := "UPDATE user SET emailverified = 1 WHERE user_id = ? AND email = ?"
+			result, err := sqlexec(db, s, t.Userid, t.Email)
+			if handleDbErr(w, err, "verifyemailhandler") {
+				return
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				http.Error(w, "This confirmation link is invalid or has expired.", 404)
+				return
+			}
+			err = delUserTokens(db, t.Userid, USERTOKEN_VERIFYEMAIL)
+			if err != nil {
+				log.Printf("DB error deleting verify email tokens: %s\n", err)
+			}
+			msg = fmt.Sprintf("Your email address %s has been confirmed.", t.Email)
+		}
+
+		data := struct {
+			Page
+			Msg string
+		}{newPage(r, db, login, site), msg}
+		renderPage(w, "verifyemail.html", data)
+	}
+}
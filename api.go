@@ -0,0 +1,529 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// JSON api under /api/v1/
+//
+//   GET    /api/v1/items                 list submissions (latest, cat, tag, username, offset, limit)
+//   POST   /api/v1/items                 create submission
+//   GET    /api/v1/items/<id>            get entry with its comment tree (sort=best|new|old)
+//   POST   /api/v1/items/<id>/comments   reply to entry
+//   POST   /api/v1/items/<id>/vote       vote for entry (dir=-1 to down vote)
+//   DELETE /api/v1/items/<id>/vote       remove vote
+//   GET    /api/v1/users/<username>      get user
+//
+// Requests are authenticated by an api token in the header:
+//   Authorization: Bearer <token>
+// GET requests can be made without a token. Writes need a token
+// with the matching scope (submit, comment or vote).
+
+type ApiItem struct {
+	Id        int64      `json:"id"`
+	Type      string     `json:"type"`
+	Title     string     `json:"title,omitempty"`
+	Url       string     `json:"url,omitempty"`
+	Body      string     `json:"body,omitempty"`
+	Desc      string     `json:"description,omitempty"`
+	Thumburl  string     `json:"thumburl,omitempty"`
+	Createdt  string     `json:"createdt"`
+	Username  string     `json:"username"`
+	Parentid  int64      `json:"parentid,omitempty"`
+	Cat       int64      `json:"cat,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Votes     int        `json:"votes"`
+	Points    float64    `json:"points"`
+	Ncomments int        `json:"ncomments"`
+	Selfvote  bool       `json:"selfvote"`
+	Vote      int        `json:"vote"` // login user's vote: 1, -1 or 0
+	Deleted   bool       `json:"deleted,omitempty"`
+	Hidden    bool       `json:"hidden,omitempty"` // flagged and hidden from non-moderators
+	Comments  []*ApiItem `json:"comments,omitempty"`
+}
+
+type ApiUser struct {
+	Id           int64  `json:"id"`
+	Username     string `json:"username"`
+	Active       bool   `json:"active"`
+	Role         string `json:"role"`
+	Createdt     string `json:"createdt"`
+	Karma        int    `json:"karma"`
+	About        string `json:"about,omitempty"`
+	Nsubmissions int    `json:"nsubmissions"`
+	Ncomments    int    `json:"ncomments"`
+}
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("writeJson: %s\n", err)
+		status = 500
+		bs = []byte(`{"error":"server error"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bs)
+}
+
+func writeApiError(w http.ResponseWriter, status int, msg string) {
+	writeJson(w, status, ApiError{Error: msg})
+}
+
+func handleApiDbErr(w http.ResponseWriter, err error, sfunc string) bool {
+	if err == sql.ErrNoRows {
+		writeApiError(w, 404, "not found")
+		return true
+	}
+	if err != nil {
+		log.Printf("%s: database error (%s)\n", sfunc, err)
+		writeApiError(w, 500, "server database error")
+		return true
+	}
+	return false
+}
+
+func validateApiLogin(w http.ResponseWriter, login *User, scope string) bool {
+	if login.Userid == -1 {
+		writeApiError(w, 401, "api token required")
+		return false
+	}
+	if !login.Active {
+		writeApiError(w, 401, "not an active user")
+		return false
+	}
+	if !hasScope(login, scope) {
+		writeApiError(w, 403, fmt.Sprintf("api token doesn't have '%s' scope", scope))
+		return false
+	}
+	return true
+}
+
+func thingName(thing int) string {
+	if thing == COMMENT {
+		return "comment"
+	}
+	return "submission"
+}
+
+func apiHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := getApiUser(r, db)
+		if login == nil {
+			writeApiError(w, 401, "invalid api token")
+			return
+		}
+		if r.Method == "GET" && login.Userid != -1 && !hasScope(login, SCOPE_READ) {
+			writeApiError(w, 403, "api token doesn't have 'read' scope")
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/")
+		parts := strings.Split(path, "/")
+
+		if len(parts) == 1 && parts[0] == "items" {
+			switch r.Method {
+			case "GET":
+				apiListItems(w, r, db, login)
+			case "POST":
+				apiCreateSubmission(w, r, db, login)
+			default:
+				writeApiError(w, 405, "method not allowed")
+			}
+			return
+		}
+		if len(parts) >= 2 && parts[0] == "items" {
+			entryid := idtoi(parts[1])
+			if entryid == -1 {
+				writeApiError(w, 404, "not found")
+				return
+			}
+			if len(parts) == 2 && r.Method == "GET" {
+				apiGetItem(w, r, db, login, entryid)
+				return
+			}
+			if len(parts) == 3 && parts[2] == "comments" && r.Method == "POST" {
+				apiCreateComment(w, r, db, login, entryid)
+				return
+			}
+			if len(parts) == 3 && parts[2] == "vote" && (r.Method == "POST" || r.Method == "DELETE") {
+				apiVote(w, r, db, login, entryid)
+				return
+			}
+		}
+		if len(parts) == 2 && parts[0] == "users" && r.Method == "GET" {
+			apiGetUser(w, r, db, parts[1])
+			return
+		}
+
+		writeApiError(w, 404, "not found")
+	}
+}
+
+func apiListItems(w http.ResponseWriter, r *http.Request, db *sql.DB, login *User) {
+	site := querySite(db)
+
+	qcat := idtoi(r.FormValue("cat"))
+	if qcat == -1 {
+		qcat = 0
+	}
+	qoffset := atoi(r.FormValue("offset"))
+	if qoffset <= 0 {
+		qoffset = 0
+	}
+	qlimit := parseLimit(r.FormValue("limit"), cfg.Pagesize)
+	qi := &QIndex{
+		Latest:   r.FormValue("latest"),
+		Username: r.FormValue("username"),
+		Cat:      qcat,
+		Tag:      r.FormValue("tag"),
+	}
+
+	ee, err := queryIndexEntries(db, site, login, qi, qoffset, qlimit)
+	if handleApiDbErr(w, err, "apiListItems") {
+		return
+	}
+
+	items := []*ApiItem{}
+	for _, ie := range ee {
+		tt, _ := queryEntryTags(db, ie.Entry.Entryid)
+		items = append(items, &ApiItem{
+			Id:        ie.Entry.Entryid,
+			Type:      thingName(ie.Entry.Thing),
+			Title:     ie.Entry.Title,
+			Url:       ie.Entry.Url,
+			Desc:      ie.Entry.Description,
+			Thumburl:  ie.Entry.Thumburl,
+			Createdt:  ie.Entry.Createdt,
+			Username:  ie.Submitter.Username,
+			Tags:      tt,
+			Votes:     ie.TotalVotes,
+			Points:    ie.Points,
+			Ncomments: ie.Ncomments,
+			Selfvote:  ie.Selfvote != 0,
+			Vote:      ie.Selfvote,
+		})
+	}
+	writeJson(w, 200, items)
+}
+
+func queryApiItem(db *sql.DB, site *Site, login *User, entryid int64) (*ApiItem, error) {
+	var item ApiItem
+	var thing, selfvote int
+	cond, pp := flagHiddenCond(site, login)
+	s := `SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.description, e.thumburl, e.createdt, IFNULL(e.parent_id, 0), IFNULL(ec.cat_id, 0),
+IFNULL(u.username, ''),
+(SELECT COUNT(*) FROM entry AS child WHERE child.parent_id = e.entry_id AND child.deleted = 0) AS ncomments,
+IFNULL(totalvotes.votes, 0) AS votes,
+IFNULL(ev.dir, 0),
+calculate_points(IFNULL(totalvotes.votes, 0), e.createdt, ` + CAT_GRAVITYF_SQL + `) AS points
+FROM entry e
+LEFT OUTER JOIN user u ON e.user_id = u.user_id
+LEFT OUTER JOIN entrycat ec ON e.entry_id = ec.entry_id
+LEFT OUTER JOIN cat c ON ec.cat_id = c.cat_id
+LEFT OUTER JOIN totalvotes ON e.entry_id = totalvotes.entry_id
+LEFT OUTER JOIN totalflags ON e.entry_id = totalflags.entry_id
+LEFT OUTER JOIN entryvote ev ON ev.entry_id = e.entry_id AND ev.user_id = ?
+WHERE e.entry_id = ? AND e.deleted = 0` + cond
+	row := db.QueryRow(s, append([]interface{}{site.Gravityf, login.Userid, entryid}, pp...)...)
+	err := row.Scan(&item.Id, &thing, &item.Title, &item.Url, &item.Body, &item.Desc, &item.Thumburl, &item.Createdt, &item.Parentid, &item.Cat,
+		&item.Username, &item.Ncomments, &item.Votes, &selfvote, &item.Points)
+	if err != nil {
+		return nil, err
+	}
+	item.Type = thingName(thing)
+	item.Selfvote = selfvote != 0
+	item.Vote = selfvote
+	if thing == SUBMISSION {
+		item.Tags, err = queryEntryTags(db, entryid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &item, nil
+}
+
+func queryApiComments(db *sql.DB, site *Site, login *User, parentid int64, sort string) ([]*ApiItem, error) {
+	s := fmt.Sprintf(`SELECT e.entry_id, e.body, e.createdt, e.parent_id, IFNULL(u.username, ''), e.deleted,
+(SELECT COUNT(*) FROM entry AS child WHERE child.parent_id = e.entry_id AND child.deleted = 0) AS ncomments,
+IFNULL(totalvotes.votes, 0) AS votes,
+IFNULL(ev.dir, 0),
+IFNULL(totalflags.flags, 0)
+FROM entry AS e
+LEFT OUTER JOIN user u ON e.user_id = u.user_id
+LEFT OUTER JOIN totalvotes ON e.entry_id = totalvotes.entry_id
+LEFT OUTER JOIN totalflags ON e.entry_id = totalflags.entry_id
+LEFT OUTER JOIN entryvote ev ON ev.entry_id = e.entry_id AND ev.user_id = ?
+WHERE e.thing = 1 AND e.parent_id = ?
+ORDER BY %s`, commentsOrderBy(sort))
+	rows, err := db.Query(s, login.Userid, parentid)
+	if err != nil {
+		return nil, err
+	}
+	var items []*ApiItem
+	for rows.Next() {
+		var item ApiItem
+		var selfvote, deleted, nflags int
+		err := rows.Scan(&item.Id, &item.Body, &item.Createdt, &item.Parentid, &item.Username, &deleted, &item.Ncomments, &item.Votes, &selfvote, &nflags)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		item.Type = thingName(COMMENT)
+		item.Selfvote = selfvote != 0
+		item.Vote = selfvote
+		if deleted != 0 {
+			item.Deleted = true
+			item.Body = ""
+			item.Username = ""
+		} else if isFlagHidden(site, login, nflags) {
+			item.Hidden = true
+			item.Body = ""
+			item.Username = ""
+		}
+		items = append(items, &item)
+	}
+	rows.Close()
+
+	// Deleted and hidden comments are left as placeholders for their replies.
+	var visible []*ApiItem
+	for _, item := range items {
+		item.Comments, err = queryApiComments(db, site, login, item.Id, sort)
+		if err != nil {
+			return nil, err
+		}
+		if (item.Deleted || item.Hidden) && len(item.Comments) == 0 {
+			continue
+		}
+		visible = append(visible, item)
+	}
+	return visible, nil
+}
+
+func apiGetItem(w http.ResponseWriter, r *http.Request, db *sql.DB, login *User, entryid int64) {
+	site := querySite(db)
+	item, err := queryApiItem(db, site, login, entryid)
+	if handleApiDbErr(w, err, "apiGetItem") {
+		return
+	}
+	item.Comments, err = queryApiComments(db, site, login, entryid, r.FormValue("sort"))
+	if handleApiDbErr(w, err, "apiGetItem") {
+		return
+	}
+	writeJson(w, 200, item)
+}
+
+func apiCreateSubmission(w http.ResponseWriter, r *http.Request, db *sql.DB, login *User) {
+	if !validateApiLogin(w, login, SCOPE_SUBMIT) {
+		return
+	}
+
+	var f struct {
+		Title string   `json:"title"`
+		Url   string   `json:"url"`
+		Body  string   `json:"body"`
+		Cat   int64    `json:"cat"`
+		Tags  []string `json:"tags"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&f)
+	if err != nil {
+		writeApiError(w, 400, "invalid json")
+		return
+	}
+
+	var e Entry
+	e.Title = strings.TrimSpace(f.Title)
+	e.Url = strings.TrimSpace(f.Url)
+	e.Body = strings.TrimSpace(f.Body)
+	if e.Title == "" && e.Url == "" {
+		writeApiError(w, 400, "title required")
+		return
+	}
+	if e.Url == "" && e.Body == "" {
+		writeApiError(w, 400, "url or body required")
+		return
+	}
+	if f.Cat == 0 {
+		f.Cat = 1
+	}
+	cat := queryCat(db, f.Cat)
+	if cat == nil {
+		writeApiError(w, 400, "cat doesn't exist")
+		return
+	}
+	site := querySite(db)
+	if !canPostToCat(site, login, cat) {
+		writeApiError(w, 403, "can't post to this cat")
+		return
+	}
+	tt, blocked, err := resolveTags(db, parseTags(strings.Join(f.Tags, ",")))
+	if handleApiDbErr(w, err, "apiCreateSubmission") {
+		return
+	}
+	if len(blocked) > 0 {
+		writeApiError(w, 400, fmt.Sprintf("tag not allowed: %s", strings.Join(blocked, ", ")))
+		return
+	}
+
+	dupid, err := queryDuplicateUrl(db, site, e.Url)
+	if handleApiDbErr(w, err, "apiCreateSubmission") {
+		return
+	}
+	if dupid != -1 {
+		err := repostSubmission(db, login, dupid)
+		if handleApiDbErr(w, err, "apiCreateSubmission") {
+			return
+		}
+		item, err := queryApiItem(db, site, login, dupid)
+		if handleApiDbErr(w, err, "apiCreateSubmission") {
+			return
+		}
+		writeJson(w, 200, item)
+		return
+	}
+
+	if errmsg := checkRateLimit(db, site, r, login, RATE_SUBMIT); errmsg != "" {
+		writeApiError(w, 429, errmsg)
+		return
+	}
+	fetchEntryMeta(r.Context(), &e)
+	if e.Title == "" {
+		writeApiError(w, 400, "title required, couldn't get it from the url")
+		return
+	}
+
+	e.Userid = login.Userid
+	newid, err := createSubmission(db, &e, f.Cat, tt)
+	if handleApiDbErr(w, err, "apiCreateSubmission") {
+		return
+	}
+
+	item, err := queryApiItem(db, site, login, newid)
+	if handleApiDbErr(w, err, "apiCreateSubmission") {
+		return
+	}
+	writeJson(w, 201, item)
+}
+
+func apiCreateComment(w http.ResponseWriter, r *http.Request, db *sql.DB, login *User, parentid int64) {
+	if !validateApiLogin(w, login, SCOPE_COMMENT) {
+		return
+	}
+
+	var f struct {
+		Body string `json:"body"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&f)
+	if err != nil {
+		writeApiError(w, 400, "invalid json")
+		return
+	}
+
+	var e Entry
+	e.Body = strings.TrimSpace(f.Body)
+	if e.Body == "" {
+		writeApiError(w, 400, "body required")
+		return
+	}
+	_, err = queryEntry(db, parentid)
+	if handleApiDbErr(w, err, "apiCreateComment") {
+		return
+	}
+
+	site := querySite(db)
+	if errmsg := checkRateLimit(db, site, r, login, RATE_COMMENT); errmsg != "" {
+		writeApiError(w, 429, errmsg)
+		return
+	}
+
+	e.Parentid = parentid
+	e.Userid = login.Userid
+	newid, err := createComment(db, &e)
+	if handleApiDbErr(w, err, "apiCreateComment") {
+		return
+	}
+
+	item, err := queryApiItem(db, site, login, newid)
+	if handleApiDbErr(w, err, "apiCreateComment") {
+		return
+	}
+	writeJson(w, 201, item)
+}
+
+func apiVote(w http.ResponseWriter, r *http.Request, db *sql.DB, login *User, entryid int64) {
+	if !validateApiLogin(w, login, SCOPE_VOTE) {
+		return
+	}
+
+	e, err := queryEntry(db, entryid)
+	if handleApiDbErr(w, err, "apiVote") {
+		return
+	}
+
+	dir := 0
+	if r.Method != "DELETE" {
+		dir = 1
+		if r.FormValue("dir") == "-1" {
+			dir = -1
+		}
+	}
+	if dir == -1 && !canDownvote(querySite(db), login, e.Userid) {
+		writeApiError(w, 403, "not enough karma to down vote")
+		return
+	}
+
+	if r.Method == "DELETE" {
+		err = unvoteEntry(db, entryid, login.Userid)
+	} else {
+		err = voteEntry(db, entryid, login.Userid, dir)
+	}
+	if handleApiDbErr(w, err, "apiVote") {
+		return
+	}
+
+	votes, err := queryTotalVotes(db, entryid)
+	if handleApiDbErr(w, err, "apiVote") {
+		return
+	}
+	vr := VoteResult{
+		Entryid:    entryid,
+		Userid:     login.Userid,
+		TotalVotes: votes,
+		Dir:        dir,
+	}
+	writeJson(w, 200, vr)
+}
+
+func apiGetUser(w http.ResponseWriter, r *http.Request, db *sql.DB, username string) {
+	u := queryUsername(db, username)
+	if u.Userid == -1 {
+		writeApiError(w, 404, "not found")
+		return
+	}
+
+	au := ApiUser{
+		Id:       u.Userid,
+		Username: u.Username,
+		Active:   u.Active,
+		Role:     roleName(u.Role),
+		Createdt: u.Createdt,
+		Karma:    u.Karma,
+		About:    u.About,
+	}
+	s := "SELECT IFNULL(SUM(thing = 0), 0), IFNULL(SUM(thing = 1), 0) FROM entry WHERE user_id = ? AND deleted = 0"
+	row := db.QueryRow(s, u.Userid)
+	err := row.Scan(&au.Nsubmissions, &au.Ncomments)
+	if handleApiDbErr(w, err, "apiGetUser") {
+		return
+	}
+	writeJson(w, 200, au)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const SCOPE_READ = "read"
+const SCOPE_SUBMIT = "submit"
+const SCOPE_COMMENT = "comment"
+const SCOPE_VOTE = "vote"
+
+var apiScopes = []string{SCOPE_READ, SCOPE_SUBMIT, SCOPE_COMMENT, SCOPE_VOTE}
+
+type ApiToken struct {
+	Tokenid    int64
+	Userid     int64
+	Name       string
+	Scopes     []string
+	Createdt   string
+	Expiredt   string
+	Lastuseddt string
+}
+
+func parseScopes(s string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes
+}
+
+func isValidScope(scope string) bool {
+	for _, s := range apiScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Users logged in with a session cookie have every scope.
+// Users authenticated by api token only have the token's scopes.
+func hasScope(u *User, scope string) bool {
+	if u.Tokenid == 0 {
+		return true
+	}
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Api tokens are shown to the user once when created.
+// Only the hash of the token is stored in the apitoken table.
+// Empty expiredt means the token doesn't expire.
+func createApiToken(db *sql.DB, userid int64, name string, scopes []string, expiredt string) (string, error) {
+	tok := randomToken(32)
+	s := "INSERT INTO apitoken (user_id, tokenhash, name, scopes, createdt, expiredt) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := sqlexec(db, s, userid, hashToken(tok), name, strings.Join(scopes, ","), nowUTC(), expiredt)
+	if err != nil {
+		return "", err
+	}
+	return tok, nil
+}
+
+func queryApiToken(db *sql.DB, tokenid int64) (*ApiToken, error) {
+	var t ApiToken
+	var scopes string
+	s := "SELECT apitoken_id, user_id, name, scopes, createdt, expiredt, lastuseddt FROM apitoken WHERE apitoken_id = ?"
+	row := db.QueryRow(s, tokenid)
+	err := row.Scan(&t.Tokenid, &t.Userid, &t.Name, &scopes, &t.Createdt, &t.Expiredt, &t.Lastuseddt)
+	if err != nil {
+		return nil, err
+	}
+	t.Scopes = parseScopes(scopes)
+	return &t, nil
+}
+
+func queryUserApiTokens(db *sql.DB, userid int64) ([]ApiToken, error) {
+	s := "SELECT apitoken_id, user_id, name, scopes, createdt, expiredt, lastuseddt FROM apitoken WHERE user_id = ? ORDER BY apitoken_id"
+	rows, err := db.Query(s, userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tt []ApiToken
+	for rows.Next() {
+		var t ApiToken
+		var scopes string
+		err := rows.Scan(&t.Tokenid, &t.Userid, &t.Name, &scopes, &t.Createdt, &t.Expiredt, &t.Lastuseddt)
+		if err != nil {
+			return nil, err
+		}
+		t.Scopes = parseScopes(scopes)
+		tt = append(tt, t)
+	}
+	return tt, nil
+}
+
+func delApiToken(db *sql.DB, tokenid int64) error {
+	s := "DELETE FROM apitoken WHERE apitoken_id = ?"
+	_, err := sqlexec(db, s, tokenid)
+	return err
+}
+
+func isTokenExpired(expiredt string) bool {
+	if expiredt == "" {
+		return false
+	}
+	dt, err := time.Parse(time.RFC3339, expiredt)
+	if err != nil {
+		return true
+	}
+	return time.Now().After(dt)
+}
+
+// Return token from 'Authorization: Bearer <token>' header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// Return user with the token's scopes, or nil if the token is
+// invalid, expired or belongs to an inactive user.
+func queryApiTokenUser(db *sql.DB, tok string) *User {
+	var t ApiToken
+	var scopes string
+	s := "SELECT apitoken_id, user_id, scopes, expiredt, lastuseddt FROM apitoken WHERE tokenhash = ?"
+	row := db.QueryRow(s, hashToken(tok))
+	err := row.Scan(&t.Tokenid, &t.Userid, &scopes, &t.Expiredt, &t.Lastuseddt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Printf("queryApiTokenUser() db error (%s)\n", err)
+		return nil
+	}
+	if isTokenExpired(t.Expiredt) {
+		return nil
+	}
+
+	u := queryUser(db, t.Userid)
+	if u.Userid == -1 || !u.Active {
+		return nil
+	}
+	u.Tokenid = t.Tokenid
+	u.Scopes = parseScopes(scopes)
+
+	// Don't write lastuseddt to the db on every request.
+	lastuseddt, _ := time.Parse(time.RFC3339, t.Lastuseddt)
+	if time.Since(lastuseddt) >= SESSION_TOUCH_INTERVAL {
+		s = "UPDATE apitoken SET lastuseddt = ? WHERE apitoken_id = ?"
+		_, err = sqlexec(db, s, nowUTC(), t.Tokenid)
+		if err != nil {
+			log.Printf("queryApiTokenUser() db error (%s)\n", err)
+		}
+	}
+	return u
+}
+
+// Api requests are only authenticated by api token, never by session cookie.
+// Returns the anonymous user (Userid -1) if no token was given,
+// nil if the token is invalid.
+func getApiUser(r *http.Request, db *sql.DB) *User {
+	tok := bearerToken(r)
+	if tok == "" {
+		var u User
+		u.Userid = -1
+		return &u
+	}
+	return queryApiTokenUser(db, tok)
+}
+
+func apitokenHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	type ApitokenForm struct {
+		name    string
+		scopes  []string
+		expdays int
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+		var f ApitokenForm
+		var tok string
+
+		login := getLoginUser(r, db)
+		if !validateSessionLogin(w, login) {
+			return
+		}
+
+		f.scopes = apiScopes
+		if r.Method == "POST" {
+			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+				f.name = strings.TrimSpace(r.FormValue("name"))
+				f.expdays = atoi(r.FormValue("expdays"))
+				f.scopes = nil
+				r.ParseForm()
+				for _, scope := range r.Form["scope"] {
+					if isValidScope(scope) {
+						f.scopes = append(f.scopes, scope)
+					}
+				}
+				if f.name == "" {
+					errmsg = "Please enter a token name."
+					break
+				}
+				if len(f.scopes) == 0 {
+					errmsg = "Please select at least one scope."
+					break
+				}
+
+				expiredt := ""
+				if f.expdays > 0 {
+					expiredt = time.Now().UTC().Add(daysDuration(f.expdays)).Format(time.RFC3339)
+				}
+				var err error
+				tok, err = createApiToken(db, login.Userid, f.name, f.scopes, expiredt)
+				if err != nil {
+					log.Printf("DB error creating api token: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				break
+			}
+		}
+
+		type ScopeOption struct {
+			Scope   string
+			Checked bool
+		}
+		var scopes []ScopeOption
+		for _, scope := range apiScopes {
+			scopes = append(scopes, ScopeOption{scope, listContains(f.scopes, scope)})
+		}
+
+		data := struct {
+			Page
+			Tok      string
+			Name     string
+			Scopes   []ScopeOption
+			Expdays  int
+			Expiries []int
+		}{newPage(r, db, login, querySite(db)), tok, f.name, scopes, f.expdays, []int{0, 30, 90, 365}}
+		data.Errmsg = errmsg
+		renderPage(w, "apitoken.html", data)
+	}
+}
+
+func revoketokenHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		qfrom := r.FormValue("from")
+		if qfrom == "" {
+			qfrom = "/usersetup/"
+		}
+		qtokenid := idtoi(r.FormValue("tokenid"))
+		if !validateIdParm(w, qtokenid) {
+			return
+		}
+
+		login := getLoginUser(r, db)
+		if !validateSessionLogin(w, login) {
+			return
+		}
+
+		t, err := queryApiToken(db, qtokenid)
+		if handleDbErr(w, err, "revoketokenhandler") {
+			return
+		}
+		if t.Userid != login.Userid {
+			http.Error(w, "token belongs to another user", 401)
+			return
+		}
+
+		if r.Method == "POST" {
+			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+				err := delApiToken(db, qtokenid)
+				if err != nil {
+					log.Printf("DB error deleting api token: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+
+				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
+				return
+			}
+		}
+
+		data := struct {
+			Page
+			Token *ApiToken
+			From  string
+		}{newPage(r, db, login, querySite(db)), t, qfrom}
+		data.Errmsg = errmsg
+		renderPage(w, "revoketoken.html", data)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApiTokenLogin(t *testing.T) {
+	db := openTestDb(t)
+	_, err := migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := createApiToken(db, ADMIN_ID, "test", []string{SCOPE_READ}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pages can be viewed as the token's user, but nothing more.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	login := getLoginUser(r, db)
+	if login.Userid != ADMIN_ID || login.Tokenid == 0 {
+		t.Fatalf("expected api token login, got %+v", login)
+	}
+	if isAdmin(login) || isModerator(login) {
+		t.Errorf("api token login shouldn't have admin or moderator rights")
+	}
+	if checkCsrf(r, login) {
+		t.Errorf("api token login shouldn't pass csrf checks")
+	}
+
+	r = httptest.NewRequest("POST", "/edituser/?userid=1&setpwd=1", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	w := httptest.NewRecorder()
+	edituserHandler(db)(w, r)
+	if w.Code != 403 {
+		t.Errorf("account pages should refuse api tokens, got status %d", w.Code)
+	}
+
+	votetok, err := createApiToken(db, ADMIN_ID, "vote only", []string{SCOPE_VOTE}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+votetok)
+	if u := getLoginUser(r, db); u.Userid != -1 {
+		t.Errorf("token without read scope shouldn't log in to pages, got userid %d", u.Userid)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/items", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	u := getApiUser(r, db)
+	if u == nil || u.Userid != ADMIN_ID || u.Tokenid == 0 {
+		t.Fatalf("expected api token user, got %+v", u)
+	}
+	if !hasScope(u, SCOPE_READ) || hasScope(u, SCOPE_SUBMIT) {
+		t.Errorf("expected only the token's scopes, got %v", u.Scopes)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Moderation and admin actions are recorded in the auditlog table with who
+// did it, what it was done to, the changed values before and after, and the
+// reason given. The table is append-only, triggers reject updates and deletes.
+//
+// Before and after hold JSON objects of the changed fields only.
+
+const (
+	AUDIT_DEL_ENTRY       = "delete entry"
+	AUDIT_EDIT_ENTRY      = "edit entry"
+	AUDIT_RESTORE_ENTRY   = "restore entry"
+	AUDIT_PURGE_ENTRY     = "purge entry"
+	AUDIT_ACTIVATE_USER   = "activate user"
+	AUDIT_DEACTIVATE_USER = "deactivate user"
+	AUDIT_SET_ROLE        = "set role"
+	AUDIT_CREATE_CAT      = "create category"
+	AUDIT_EDIT_CAT        = "edit category"
+	AUDIT_DEL_CAT         = "delete category"
+	AUDIT_SITE_SETTINGS   = "site settings"
+	AUDIT_MERGE_TAG       = "merge tag"
+	AUDIT_BLOCK_TAG       = "block tag"
+	AUDIT_UNBLOCK_TAG     = "unblock tag"
+	AUDIT_UNALIAS_TAG     = "remove tag alias"
+)
+
+var auditActions = []string{
+	AUDIT_DEL_ENTRY, AUDIT_EDIT_ENTRY, AUDIT_RESTORE_ENTRY, AUDIT_PURGE_ENTRY,
+	AUDIT_ACTIVATE_USER, AUDIT_DEACTIVATE_USER, AUDIT_SET_ROLE,
+	AUDIT_CREATE_CAT, AUDIT_EDIT_CAT, AUDIT_DEL_CAT,
+	AUDIT_SITE_SETTINGS,
+	AUDIT_MERGE_TAG, AUDIT_BLOCK_TAG, AUDIT_UNBLOCK_TAG, AUDIT_UNALIAS_TAG,
+}
+
+// Audit target types
+const (
+	AUDIT_ENTRY = "entry"
+	AUDIT_USER  = "user"
+	AUDIT_CAT   = "category"
+	AUDIT_SITE  = "site"
+	AUDIT_TAG   = "tag"
+)
+
+var auditTargettypes = []string{AUDIT_ENTRY, AUDIT_USER, AUDIT_CAT, AUDIT_SITE, AUDIT_TAG}
+
+const MAX_REASON_LEN = 500
+
+type AuditEntry struct {
+	Auditid    int64
+	Createdt   string
+	Actor      User
+	Action     string
+	Targettype string
+	Targetid   int64
+	Target     string // name or title of the target at the time
+	Before     string
+	After      string
+	Reason     string
+}
+
+type AuditFields map[string]interface{}
+
+// Record an action by login. Errors are logged, the action has already been done.
+func logAudit(db *sql.DB, login *User, action, targettype string, targetid int64, target string, before, after AuditFields, reason string) {
+	sbefore, safter := auditDiff(before, after)
+	s := "INSERT INTO auditlog (createdt, actor_id, action, targettype, target_id, target, beforeval, afterval, reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := sqlexec(db, s, time.Now().Format(time.RFC3339), login.Userid, action, targettype, targetid, target, sbefore, safter, reason)
+	if err != nil {
+		log.Printf("DB error adding audit log '%s' for %s %d (%s)\n", action, targettype, targetid, err)
+	}
+}
+
+// JSON of the fields that differ between before and after. A nil before or
+// after, as for a create or delete, keeps all the other's fields.
+func auditDiff(before, after AuditFields) (string, string) {
+	b := AuditFields{}
+	a := AuditFields{}
+	for k, v := range before {
+		if after == nil || !reflect.DeepEqual(v, after[k]) {
+			b[k] = v
+		}
+	}
+	for k, v := range after {
+		if before == nil || !reflect.DeepEqual(v, before[k]) {
+			a[k] = v
+		}
+	}
+	return auditJson(b), auditJson(a)
+}
+
+func auditJson(ff AuditFields) string {
+	if len(ff) == 0 {
+		return ""
+	}
+	bs, err := json.Marshal(ff)
+	if err != nil {
+		return fmt.Sprintf("%v", ff)
+	}
+	return string(bs)
+}
+
+func entryAuditFields(e *Entry) AuditFields {
+	if e.Thing == COMMENT {
+		return AuditFields{"body": e.Body}
+	}
+	return AuditFields{"title": e.Title, "url": e.Url, "body": e.Body}
+}
+
+func submissionAuditFields(e *Entry, catid int64, tags string) AuditFields {
+	ff := entryAuditFields(e)
+	ff["cat"] = catid
+	ff["tags"] = tags
+	return ff
+}
+
+func catAuditFields(cat *Cat, mods string) AuditFields {
+	return AuditFields{
+		"name":       cat.Name,
+		"desc":       cat.Desc,
+		"gravityf":   cat.Gravityf,
+		"postpolicy": postPolicyName(cat.Postpolicy),
+		"moderators": mods,
+	}
+}
+
+func siteAuditFields(site *Site) AuditFields {
+	return AuditFields{
+		"title":                 site.Title,
+		"gravityf":              site.Gravityf,
+		"downvotekarma":         site.Downvotekarma,
+		"flagthreshold":         site.Flagthreshold,
+		"flagaction":            flagActionName(site.Flagaction),
+		"dupedays":              site.Dupedays,
+		"submitlimit":           site.Submitlimit,
+		"commentlimit":          site.Commentlimit,
+		"signuplimit":           site.Signuplimit,
+		"probationhours":        site.Probationhours,
+		"probationsubmitlimit":  site.Probationsubmitlimit,
+		"probationcommentlimit": site.Probationcommentlimit,
+		"persistlimits":         site.Persistlimits,
+		"trashdays":             site.Trashdays,
+	}
+}
+
+func parseReason(r *http.Request) string {
+	return textSnippet(r.FormValue("reason"), MAX_REASON_LEN)
+}
+
+type AuditFilter struct {
+	Action     string
+	Actor      string // username
+	Targettype string
+	Targetid   int64 // 0 for any
+}
+
+func queryAuditLog(db *sql.DB, f *AuditFilter, offset, limit int) ([]AuditEntry, error) {
+	var where []string
+	var qq []interface{}
+	if f.Action != "" {
+		where = append(where, "a.action = ?")
+		qq = append(qq, f.Action)
+	}
+	if f.Actor != "" {
+		where = append(where, "u.username = ?")
+		qq = append(qq, f.Actor)
+	}
+	if f.Targettype != "" {
+		where = append(where, "a.targettype = ?")
+		qq = append(qq, f.Targettype)
+	}
+	if f.Targetid > 0 {
+		where = append(where, "a.target_id = ?")
+		qq = append(qq, f.Targetid)
+	}
+	swhere := ""
+	if len(where) > 0 {
+		swhere = "WHERE " + strings.Join(where, " AND ")
+	}
+	s := fmt.Sprintf(`SELECT a.audit_id, a.createdt, a.actor_id, IFNULL(u.username, ''), a.action, a.targettype, a.target_id, a.target, a.beforeval, a.afterval, a.reason
+FROM auditlog a
+LEFT OUTER JOIN user u ON a.actor_id = u.user_id
+%s
+ORDER BY a.audit_id DESC
+LIMIT ? OFFSET ?`, swhere)
+	qq = append(qq, limit, offset)
+
+	rows, err := db.Query(s, qq...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aa []AuditEntry
+	for rows.Next() {
+		var a AuditEntry
+		err := rows.Scan(&a.Auditid, &a.Createdt, &a.Actor.Userid, &a.Actor.Username, &a.Action, &a.Targettype, &a.Targetid, &a.Target, &a.Before, &a.After, &a.Reason)
+		if err != nil {
+			return nil, err
+		}
+		aa = append(aa, a)
+	}
+	return aa, rows.Err()
+}
+
+// /admin/audit/?action=<action>&actor=<username>&targettype=<type>&targetid=<id>
+func auditHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := getLoginUser(r, db)
+		if !isAdmin(login) {
+			logDebugf("audit log: admin not logged in\n")
+			http.Error(w, "admin required", 401)
+			return
+		}
+
+		f := AuditFilter{
+			Action:     r.FormValue("action"),
+			Actor:      strings.TrimSpace(r.FormValue("actor")),
+			Targettype: r.FormValue("targettype"),
+			Targetid:   idtoi(r.FormValue("targetid")),
+		}
+		qoffset := atoi(r.FormValue("offset"))
+		if qoffset <= 0 {
+			qoffset = 0
+		}
+		qlimit := parseLimit(r.FormValue("limit"), cfg.Pagesize)
+
+		aa, err := queryAuditLog(db, &f, qoffset, qlimit)
+		if handleDbErr(w, err, "audithandler") {
+			return
+		}
+
+		stargetid := ""
+		if f.Targetid > 0 {
+			stargetid = fmt.Sprintf("%d", f.Targetid)
+		}
+		baseurl := fmt.Sprintf("/admin/audit/?action=%s&actor=%s&targettype=%s&targetid=%s",
+			url.QueryEscape(f.Action), url.QueryEscape(f.Actor), url.QueryEscape(f.Targettype), stargetid)
+		data := struct {
+			Page
+			Filter      AuditFilter
+			Targetid    string
+			Actions     []string
+			Targettypes []string
+			Entries     []AuditEntry
+			Paging      PagingNav
+		}{newPage(r, db, login, querySite(db)), f, stargetid, auditActions, auditTargettypes, aa, newPagingNav(baseurl, qoffset, qlimit, len(aa))}
+		renderPage(w, "audit.html", data)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAuditDiff(t *testing.T) {
+	before, after := auditDiff(AuditFields{"title": "a", "url": "u"}, AuditFields{"title": "b", "url": "u"})
+	if before != `{"title":"a"}` || after != `{"title":"b"}` {
+		t.Errorf("expected only the changed title, got %s => %s", before, after)
+	}
+	before, after = auditDiff(AuditFields{"name": "cat"}, nil)
+	if before != `{"name":"cat"}` || after != "" {
+		t.Errorf("expected all fields before a delete, got %s => %s", before, after)
+	}
+}
+
+func TestAuditLogAppendOnly(t *testing.T) {
+	db := openTestDb(t)
+	_, err := migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := &User{Userid: ADMIN_ID, Username: "admin"}
+	logAudit(db, admin, AUDIT_DEACTIVATE_USER, AUDIT_USER, 2, "u2", AuditFields{"active": true}, AuditFields{"active": false}, "spam")
+
+	aa, err := queryAuditLog(db, &AuditFilter{Actor: "admin", Targettype: AUDIT_USER, Targetid: 2}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aa) != 1 || aa[0].Action != AUDIT_DEACTIVATE_USER || aa[0].Reason != "spam" || aa[0].After != `{"active":false}` {
+		t.Fatalf("expected the deactivation to be logged, got %+v", aa)
+	}
+	aa, _ = queryAuditLog(db, &AuditFilter{Action: AUDIT_DEL_ENTRY}, 0, 10)
+	if len(aa) != 0 {
+		t.Errorf("expected action filter to exclude the entry, got %d", len(aa))
+	}
+
+	if _, err := db.Exec("UPDATE auditlog SET reason = ''"); err == nil {
+		t.Errorf("auditlog update should be rejected")
+	}
+	if _, err := db.Exec("DELETE FROM auditlog"); err == nil {
+		t.Errorf("auditlog delete should be rejected")
+	}
+}
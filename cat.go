@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Categories can set their own gravity factor for points, who can post to
+// them, and moderators who can edit or delete entries in the category.
+
+const (
+	CAT_POST_OPEN    = 0 // any user
+	CAT_POST_MEMBERS = 1 // users past their probation period
+	CAT_POST_ADMIN   = 2
+)
+
+var catPostPolicies = []int{CAT_POST_OPEN, CAT_POST_MEMBERS, CAT_POST_ADMIN}
+
+func postPolicyName(policy int) string {
+	switch policy {
+	case CAT_POST_MEMBERS:
+		return "members only"
+	case CAT_POST_ADMIN:
+		return "admin only"
+	}
+	return "open"
+}
+
+func isValidPostPolicy(policy int) bool {
+	for _, p := range catPostPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Blank or negative gravity factor uses the site's.
+func parseCatGravityf(s string) float64 {
+	if strings.TrimSpace(s) == "" {
+		return -1
+	}
+	gravityf := atof(s)
+	if gravityf < 0 {
+		return -1
+	}
+	return gravityf
+}
+
+// Points gravity of the entry's category, or the site's if the category
+// doesn't set one. Queries using it join entrycat ec and cat c, and pass
+// site.Gravityf for the ?.
+const CAT_GRAVITYF_SQL = "CASE WHEN IFNULL(c.gravityf, -1) >= 0 THEN c.gravityf ELSE ? END"
+
+func canPostToCat(site *Site, login *User, cat *Cat) bool {
+	if login.Userid == -1 || !login.Active {
+		return false
+	}
+	switch cat.Postpolicy {
+	case CAT_POST_MEMBERS:
+		return isModerator(login) || canModerateCat(login, cat.Catid) || !isOnProbation(site, login, time.Now())
+	case CAT_POST_ADMIN:
+		return isAdmin(login)
+	}
+	return true
+}
+
+// Categories login can post to, from cats.
+func postableCats(site *Site, login *User, cats []Cat) []Cat {
+	var pp []Cat
+	for i := range cats {
+		if canPostToCat(site, login, &cats[i]) {
+			pp = append(pp, cats[i])
+		}
+	}
+	return pp
+}
+
+func catsContain(cats []Cat, catid int64) bool {
+	for _, cat := range cats {
+		if cat.Catid == catid {
+			return true
+		}
+	}
+	return false
+}
+
+// Site moderators can moderate every category.
+func canModerateCat(login *User, catid int64) bool {
+	if isModerator(login) {
+		return true
+	}
+	if login.Userid == -1 || !login.Active || login.Tokenid != 0 {
+		return false
+	}
+	for _, modcat := range login.Modcats {
+		if modcat == catid {
+			return true
+		}
+	}
+	return false
+}
+
+func queryCatMods(db *sql.DB, catid int64) ([]User, error) {
+	s := "SELECT u.user_id, u.username FROM catmod cm INNER JOIN user u ON cm.user_id = u.user_id WHERE cm.cat_id = ? ORDER BY u.username"
+	rows, err := db.Query(s, catid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uu []User
+	for rows.Next() {
+		var u User
+		err := rows.Scan(&u.Userid, &u.Username)
+		if err != nil {
+			return nil, err
+		}
+		uu = append(uu, u)
+	}
+	return uu, rows.Err()
+}
+
+// Categories userid moderates.
+func queryModCats(db *sql.DB, userid int64) ([]int64, error) {
+	s := "SELECT cat_id FROM catmod WHERE user_id = ?"
+	rows, err := db.Query(s, userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var catids []int64
+	for rows.Next() {
+		var catid int64
+		err := rows.Scan(&catid)
+		if err != nil {
+			return nil, err
+		}
+		catids = append(catids, catid)
+	}
+	return catids, rows.Err()
+}
+
+// Parse comma separated usernames into their userids.
+func parseCatMods(db *sql.DB, smods string) ([]int64, error) {
+	var userids []int64
+	for _, username := range strings.Split(smods, ",") {
+		username = strings.TrimSpace(username)
+		if username == "" {
+			continue
+		}
+		u := queryUsername(db, username)
+		if u.Userid == -1 {
+			return nil, fmt.Errorf("User '%s' doesn't exist.", username)
+		}
+		userids = append(userids, u.Userid)
+	}
+	return userids, nil
+}
+
+func updateCatMods(tx *sql.Tx, catid int64, userids []int64) error {
+	s := "DELETE FROM catmod WHERE cat_id = ?"
+	_, err := txexec(tx, s, catid)
+	if err != nil {
+		return err
+	}
+	for _, userid := range userids {
+		s := "INSERT OR IGNORE INTO catmod (cat_id, user_id) VALUES (?, ?)"
+		_, err := txexec(tx, s, catid, userid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func joinCatMods(uu []User) string {
+	var ss []string
+	for _, u := range uu {
+		ss = append(ss, u.Username)
+	}
+	return strings.Join(ss, ", ")
+}
+
+// Category of a submission, or of the submission a comment is under.
+func queryEntryCatid(db *sql.DB, entryid int64) (int64, error) {
+	root, err := queryRootEntry(db, entryid)
+	if err != nil {
+		return 0, err
+	}
+	var catid int64
+	s := "SELECT cat_id FROM entrycat WHERE entry_id = ?"
+	err = db.QueryRow(s, root.Entryid).Scan(&catid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return catid, err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCanPostToCat(t *testing.T) {
+	site := &Site{Probationhours: 24}
+	newuser := &User{Userid: 2, Active: true, Role: ROLE_USER, Createdt: time.Now().Format(time.RFC3339)}
+	member := &User{Userid: 3, Active: true, Role: ROLE_USER, Createdt: time.Now().Add(-48 * time.Hour).Format(time.RFC3339)}
+	catmod := &User{Userid: 4, Active: true, Role: ROLE_USER, Createdt: time.Now().Format(time.RFC3339), Modcats: []int64{5}}
+	admin := &User{Userid: 1, Active: true, Role: ROLE_ADMIN}
+	anon := &User{Userid: -1}
+
+	tests := []struct {
+		policy int
+		u      *User
+		ok     bool
+	}{
+		{CAT_POST_OPEN, newuser, true},
+		{CAT_POST_OPEN, anon, false},
+		{CAT_POST_MEMBERS, newuser, false},
+		{CAT_POST_MEMBERS, member, true},
+		{CAT_POST_MEMBERS, catmod, true},
+		{CAT_POST_ADMIN, member, false},
+		{CAT_POST_ADMIN, catmod, false},
+		{CAT_POST_ADMIN, admin, true},
+	}
+	for _, test := range tests {
+		cat := &Cat{Catid: 5, Postpolicy: test.policy}
+		ok := canPostToCat(site, test.u, cat)
+		if ok != test.ok {
+			t.Errorf("canPostToCat(%s, user %d) = %v, expected %v", postPolicyName(test.policy), test.u.Userid, ok, test.ok)
+		}
+	}
+
+	if !canModerateCat(catmod, 5) || canModerateCat(catmod, 6) {
+		t.Errorf("category moderator should only moderate their category")
+	}
+	if !canModerateCat(admin, 6) {
+		t.Errorf("site moderators should moderate every category")
+	}
+}
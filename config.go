@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server settings come from, in increasing precedence:
+//
+//	built-in defaults
+//	JSON config file given by -config or NB_CONFIG
+//	NB_* environment variables
+//	command line switches, and the port after the newsboard file
+//
+// Site settings such as the title and rate limits are kept in the newsboard
+// file and changed on the admin settings page instead.
+
+type Config struct {
+	Listen     string          `json:"listen"`     // host:port, unix:<path> or systemd, see server.go
+	Static     string          `json:"static"`     // directory of static files to use over the built-in ones
+	Templates  string          `json:"templates"`  // theme directory, see templates.go
+	Baseurl    string          `json:"baseurl"`    // used for all links in emails and feeds, defaults from Listen
+	Pagesize   int             `json:"pagesize"`   // entries per page in listings
+	Secretfile string          `json:"secretfile"` // site secret, created if missing; blank uses the newsboard file's
+	Loglevel   string          `json:"loglevel"`   // error, info or debug
+	Mailer     string          `json:"mailer"`     // see mail.go
+	Features   map[string]bool `json:"features"`   // features turned on or off
+}
+
+// Errors are always logged.
+const (
+	LOG_ERROR = "error"
+	LOG_INFO  = "info"  // also mail sent, shutdown, trash purges and failed link preview fetches
+	LOG_DEBUG = "debug" // also every request, and why requests were turned away
+)
+
+var logLevels = []string{LOG_ERROR, LOG_INFO, LOG_DEBUG}
+
+// Features that can be turned off, all on by default.
+const (
+	FEATURE_API          = "api"
+	FEATURE_FEEDS        = "feeds"
+	FEATURE_SEARCH       = "search"
+	FEATURE_SIGNUP       = "signup"
+	FEATURE_LINKPREVIEWS = "linkpreviews"
+)
+
+var allFeatures = []string{FEATURE_API, FEATURE_FEEDS, FEATURE_SEARCH, FEATURE_SIGNUP, FEATURE_LINKPREVIEWS}
+
+// Env var names are NB_ and the switch name in uppercase.
+var configSwitches = []string{"listen", "static", "templates", "baseurl", "pagesize", "secretfile", "loglevel", "mailer", "features"}
+
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	cfg := Config{
+		Listen:   ":8000",
+		Pagesize: SETTINGS_LIMIT,
+		Loglevel: LOG_INFO,
+		Features: map[string]bool{},
+	}
+	for _, f := range allFeatures {
+		cfg.Features[f] = true
+	}
+	return &cfg
+}
+
+// Read settings from the -config file, env vars and switches over the defaults.
+// getenv is os.Getenv, replaced in tests.
+func loadConfig(sw map[string]string, getenv func(string) string) (*Config, error) {
+	cfg := defaultConfig()
+
+	cfgfile := sw["config"]
+	if cfgfile == "" {
+		cfgfile = getenv("NB_CONFIG")
+	}
+	if cfgfile != "" {
+		err := cfg.loadFile(cfgfile)
+		if err != nil {
+			return nil, fmt.Errorf("config file '%s': %s", cfgfile, err)
+		}
+	}
+
+	for _, k := range configSwitches {
+		v := getenv("NB_" + strings.ToUpper(k))
+		if v == "" {
+			continue
+		}
+		err := cfg.set(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("NB_%s: %s", strings.ToUpper(k), err)
+		}
+	}
+	for _, k := range configSwitches {
+		v := sw[k]
+		if v == "" {
+			continue
+		}
+		err := cfg.set(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("-%s: %s", k, err)
+		}
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(file string) error {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.DisallowUnknownFields()
+	// Features in the file are merged into the defaults.
+	return dec.Decode(cfg)
+}
+
+func (cfg *Config) set(k, v string) error {
+	switch k {
+	case "listen":
+		cfg.Listen = v
+	case "static":
+		cfg.Static = v
+	case "templates":
+		cfg.Templates = v
+	case "baseurl":
+		cfg.Baseurl = v
+	case "pagesize":
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("'%s' isn't a number", v)
+		}
+		cfg.Pagesize = n
+	case "secretfile":
+		cfg.Secretfile = v
+	case "loglevel":
+		cfg.Loglevel = v
+	case "mailer":
+		cfg.Mailer = v
+	case "features":
+		return cfg.setFeatures(v)
+	}
+	return nil
+}
+
+// Comma separated feature=on|off, ex. "api=off,signup=off"
+func (cfg *Config) setFeatures(s string) error {
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i == -1 {
+			return fmt.Errorf("expected feature=on|off, got '%s'", kv)
+		}
+		name, val := strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+		switch val {
+		case "on", "true", "1":
+			cfg.Features[name] = true
+		case "off", "false", "0":
+			cfg.Features[name] = false
+		default:
+			return fmt.Errorf("expected on or off for feature '%s', got '%s'", name, val)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.Pagesize <= 0 {
+		return fmt.Errorf("pagesize should be 1 or more")
+	}
+	if !listContains(logLevels, cfg.Loglevel) {
+		return fmt.Errorf("loglevel should be one of %s", strings.Join(logLevels, ", "))
+	}
+	var unknown []string
+	for name := range cfg.Features {
+		if !listContains(allFeatures, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown features %s, expected %s", strings.Join(unknown, ", "), strings.Join(allFeatures, ", "))
+	}
+	if cfg.Listen == "" {
+		return fmt.Errorf("listen address required")
+	}
+	if cfg.Listen == LISTEN_SYSTEMD {
+		return nil
+	}
+	if isUnixListen(cfg.Listen) {
+		if cfg.Listen == "unix:" {
+			return fmt.Errorf("listen address 'unix:' needs a socket path")
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("listen address '%s' should be host:port, unix:<path> or systemd", cfg.Listen)
+	}
+	return nil
+}
+
+// Base url for links in emails, from the listen address if not set.
+// Set baseurl when listening on a unix socket or behind a proxy.
+func (cfg *Config) siteBaseUrl() string {
+	if cfg.Baseurl != "" {
+		return strings.TrimSuffix(cfg.Baseurl, "/")
+	}
+	host, port, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return "http://localhost"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, port))
+}
+
+func featureEnabled(name string) bool {
+	return cfg.Features[name]
+}
+
+// Serve handler only if feature is on.
+func requireFeature(name string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !featureEnabled(name) {
+			http.Error(w, "Not found.", 404)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func logInfof(format string, v ...interface{}) {
+	if cfg.Loglevel == LOG_INFO || cfg.Loglevel == LOG_DEBUG {
+		log.Printf(format, v...)
+	}
+}
+
+func logDebugf(format string, v ...interface{}) {
+	if cfg.Loglevel == LOG_DEBUG {
+		log.Printf(format, v...)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Log each request at debug level.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Loglevel != LOG_DEBUG {
+			h.ServeHTTP(w, r)
+			return
+		}
+		t := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: 200}
+		h.ServeHTTP(sr, r)
+		logDebugf("%s %s %d %s\n", r.Method, r.RequestURI, sr.status, time.Since(t))
+	})
+}
+
+// Read the site secret from file, creating it with a new random secret if
+// it doesn't exist.
+func loadSecretFile(file string) error {
+	bs, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		rb := make([]byte, 32)
+		_, err = rand.Read(rb)
+		if err != nil {
+			return err
+		}
+		bs = []byte(hex.EncodeToString(rb))
+		err = os.WriteFile(file, append(bs, '\n'), 0600)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	secret := strings.TrimSpace(string(bs))
+	if secret == "" {
+		return fmt.Errorf("'%s' is empty", file)
+	}
+	siteSecret = []byte(secret)
+	return nil
+}
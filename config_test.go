@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	cfgfile := filepath.Join(t.TempDir(), "nb.json")
+	err := os.WriteFile(cfgfile, []byte(`{"listen": ":9000", "pagesize": 10, "loglevel": "error", "static": "/srv/static", "features": {"api": false}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"NB_CONFIG":   cfgfile,
+		"NB_PAGESIZE": "20",
+		"NB_LISTEN":   ":9001",
+	}
+	getenv := func(k string) string { return env[k] }
+	sw := map[string]string{"listen": "127.0.0.1:9002", "features": "signup=off"}
+
+	cfg, err := loadConfig(sw, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Static != "/srv/static" || cfg.Loglevel != LOG_ERROR {
+		t.Errorf("expected config file settings, got static '%s' loglevel '%s'", cfg.Static, cfg.Loglevel)
+	}
+	if cfg.Pagesize != 20 {
+		t.Errorf("expected env var to override the config file pagesize, got %d", cfg.Pagesize)
+	}
+	if cfg.Listen != "127.0.0.1:9002" {
+		t.Errorf("expected switch to override the env var listen, got '%s'", cfg.Listen)
+	}
+	if cfg.Features[FEATURE_API] || cfg.Features[FEATURE_SIGNUP] || !cfg.Features[FEATURE_SEARCH] {
+		t.Errorf("expected api and signup off and the rest on, got %v", cfg.Features)
+	}
+	if cfg.siteBaseUrl() != "http://127.0.0.1:9002" {
+		t.Errorf("expected base url from listen address, got '%s'", cfg.siteBaseUrl())
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	getenv := func(k string) string { return "" }
+	for _, sw := range []map[string]string{
+		{"pagesize": "0"},
+		{"loglevel": "verbose"},
+		{"features": "comments=off"},
+		{"features": "api"},
+		{"listen": "8000"},
+		{"listen": "unix:"},
+	} {
+		_, err := loadConfig(sw, getenv)
+		if err == nil {
+			t.Errorf("expected error for %v", sw)
+		}
+	}
+}
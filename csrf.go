@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Random per-install secret used to sign session cookies and csrf tokens.
+// Generated by migration when the newsboard file is created and loaded at startup.
+var siteSecret []byte
+
+// How long a page can be left open before its forms stop working.
+const CSRF_MAXAGE = 24 * time.Hour
+
+const CSRF_ERRMSG = "Your form expired. Please try again."
+
+func loadSiteSecret(db *sql.DB) error {
+	var secret string
+	s := "SELECT secret FROM site WHERE site_id = 1"
+	err := db.QueryRow(s).Scan(&secret)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return fmt.Errorf("site secret not set")
+	}
+	siteSecret = []byte(secret)
+	return nil
+}
+
+// Csrf token takes the format: <unix time>.<signature>
+// The signature ties the token to the login session it was created for.
+func createCsrfToken(sessionid string) string {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return fmt.Sprintf("%s.%s", ts, signString(fmt.Sprintf("csrf:%s:%s", sessionid, ts)))
+}
+
+func isValidCsrfToken(sessionid, tok string) bool {
+	if sessionid == "" {
+		return false
+	}
+	i := strings.Index(tok, ".")
+	if i == -1 {
+		return false
+	}
+	ts, sig := tok[:i], tok[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(signString(fmt.Sprintf("csrf:%s:%s", sessionid, ts)))) {
+		return false
+	}
+	n, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(n, 0))
+	return age >= -time.Minute && age <= CSRF_MAXAGE
+}
+
+// Api token logins can't post forms, see getLoginUser().
+func checkCsrf(r *http.Request, login *User) bool {
+	if login.Tokenid != 0 {
+		return false
+	}
+	tok := r.FormValue("csrftok")
+	if tok == "" {
+		tok = r.Header.Get("X-CSRF-Token")
+	}
+	return isValidCsrfToken(login.Sessionid, tok)
+}
+
+func validateCsrf(w http.ResponseWriter, r *http.Request, login *User) bool {
+	if login.Tokenid != 0 {
+		http.Error(w, "Api tokens can only post to /api/v1/.", 403)
+		return false
+	}
+	if !checkCsrf(r, login) {
+		http.Error(w, "Invalid or expired csrf token. Please reload the page.", 403)
+		return false
+	}
+	return true
+}
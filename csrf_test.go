@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCsrfToken(t *testing.T) {
+	siteSecret = []byte("test secret")
+
+	tok := createCsrfToken("session1")
+	if !isValidCsrfToken("session1", tok) {
+		t.Fatalf("csrf token should be valid for its own session")
+	}
+	if isValidCsrfToken("session2", tok) {
+		t.Fatalf("csrf token shouldn't be valid for another session")
+	}
+	if isValidCsrfToken("", tok) {
+		t.Fatalf("csrf token shouldn't be valid without a session")
+	}
+	if isValidCsrfToken("session1", tok+"0") {
+		t.Fatalf("tampered csrf token shouldn't be valid")
+	}
+
+	ts := strconv.FormatInt(time.Now().Add(-CSRF_MAXAGE-time.Minute).Unix(), 10)
+	oldtok := fmt.Sprintf("%s.%s", ts, signString(fmt.Sprintf("csrf:%s:%s", "session1", ts)))
+	if isValidCsrfToken("session1", oldtok) {
+		t.Fatalf("expired csrf token shouldn't be valid")
+	}
+
+	siteSecret = []byte("another secret")
+	if isValidCsrfToken("session1", tok) {
+		t.Fatalf("csrf token shouldn't be valid with a different site secret")
+	}
+}
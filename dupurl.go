@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+)
+
+// Submitting a url that was already submitted within site.Dupedays days
+// goes to the existing submission instead, and counts as an up vote for it.
+// Urls are compared by entry.normurl, set from normalizeUrl().
+
+// Query parameters that only track where a link was shared.
+// Also in tools/initdata.go.
+var trackingParams = []string{"fbclid", "gclid"}
+
+// Normalize url for comparing submissions: lowercase scheme and host without
+// www. or the default port, no tracking parameters or fragment, sorted query
+// and no trailing slash. http and https are treated as the same url.
+func normalizeUrl(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return s
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	q := u.Query()
+	for k := range q {
+		if strings.HasPrefix(strings.ToLower(k), "utm_") || listContains(trackingParams, strings.ToLower(k)) {
+			q.Del(k)
+		}
+	}
+	u.RawQuery = q.Encode() // sorted by key
+	u.ForceQuery = false
+	return u.String()
+}
+
+// Returns the latest submission of the same url within the dedupe window,
+// or -1 if there isn't one.
+func queryDuplicateUrl(db *sql.DB, site *Site, rawurl string) (int64, error) {
+	normurl := normalizeUrl(rawurl)
+	if normurl == "" || site.Dupedays <= 0 {
+		return -1, nil
+	}
+
+	var entryid int64
+	s := "SELECT entry_id FROM entry WHERE thing = ? AND deleted = 0 AND normurl = ? AND seconds_since_time(createdt) < ? ORDER BY entry_id DESC LIMIT 1"
+	err := db.QueryRow(s, SUBMISSION, normurl, site.Dupedays*24*60*60).Scan(&entryid)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return entryid, nil
+}
+
+// Count a repost of entryid by login as an up vote, unless it's their own submission.
+func repostSubmission(db *sql.DB, login *User, entryid int64) error {
+	e, err := queryEntry(db, entryid)
+	if err != nil {
+		return err
+	}
+	if e.Userid == login.Userid {
+		return nil
+	}
+	return voteEntry(db, entryid, login.Userid, 1)
+}
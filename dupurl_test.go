@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestNormalizeUrl(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"https://example.com/a", "https://example.com/a"},
+		{"http://WWW.Example.COM/a/", "https://example.com/a"},
+		{"https://example.com:443/", "https://example.com"},
+		{"https://example.com:8080/a", "https://example.com:8080/a"},
+		{"https://example.com/a?utm_source=x&b=2&a=1&fbclid=y#top", "https://example.com/a?a=1&b=2"},
+		{"https://example.com/a?UTM_Campaign=x", "https://example.com/a"},
+		{"https://example.com/Path/Case", "https://example.com/Path/Case"},
+		{"  https://example.com/a  ", "https://example.com/a"},
+		{"", ""},
+		{"not a url", "not a url"},
+	}
+	for _, tt := range tests {
+		got := normalizeUrl(tt.in)
+		if got != tt.want {
+			t.Errorf("normalizeUrl(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
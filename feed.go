@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RSS 2.0 and Atom 1.0 feeds at /rss and /atom.
+//
+// Both take the same latest, cat, tag and username parameters as the index page.
+// Pass id=<submission id> instead to get the comment feed of a submission.
+
+const FEED_LIMIT = 30
+
+type RssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	XmlnsDc string     `xml:"xmlns:dc,attr"`
+	Channel RssChannel `xml:"channel"`
+}
+
+type RssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []RssItem `xml:"item"`
+}
+
+type RssGuid struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type RssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description,omitempty"`
+	Creator     string   `xml:"dc:creator,omitempty"`
+	PubDate     string   `xml:"pubDate"`
+	Guid        RssGuid  `xml:"guid"`
+	Comments    string   `xml:"comments,omitempty"`
+	Categories  []string `xml:"category"`
+}
+
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type AtomPerson struct {
+	Name string `xml:"name"`
+}
+
+type AtomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type AtomEntry struct {
+	Title      string         `xml:"title"`
+	Id         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Links      []AtomLink     `xml:"link"`
+	Author     AtomPerson     `xml:"author"`
+	Content    *AtomText      `xml:"content,omitempty"`
+	Categories []AtomCategory `xml:"category"`
+}
+
+// Feed and its items in a format neutral way, converted to rss or atom on output.
+type Feed struct {
+	Title   string
+	Desc    string
+	Link    string // html page the feed is for
+	SelfUrl string
+	Items   []FeedItem
+}
+
+type FeedItem struct {
+	Title    string
+	Link     string // entry url, or item page for text posts
+	ItemUrl  string
+	Username string
+	Createdt string
+	Html     string
+	Tags     []string
+}
+
+func querySubmissionsFeed(db *sql.DB, r *http.Request, site *Site, base string) (*Feed, error) {
+	qcat := idtoi(r.FormValue("cat"))
+	if qcat == -1 {
+		qcat = 0
+	}
+	qi := &QIndex{
+		Latest:   r.FormValue("latest"),
+		Username: r.FormValue("username"),
+		Cat:      qcat,
+		Tag:      r.FormValue("tag"),
+	}
+
+	var anon User
+	anon.Userid = -1
+	ee, err := queryIndexEntries(db, site, &anon, qi, 0, FEED_LIMIT)
+	if err != nil {
+		return nil, err
+	}
+
+	var f Feed
+	f.Title = site.Title
+	var tt []string
+	if qi.Cat > 0 {
+		if cat := queryCat(db, qi.Cat); cat != nil {
+			tt = append(tt, cat.Name)
+		}
+	}
+	if qi.Tag != "" {
+		tt = append(tt, qi.Tag)
+	}
+	if qi.Username != "" {
+		tt = append(tt, qi.Username)
+	}
+	if qi.Latest != "" {
+		tt = append(tt, "latest")
+	}
+	if len(tt) > 0 {
+		f.Title = fmt.Sprintf("%s: %s", site.Title, strings.Join(tt, ", "))
+	}
+	f.Desc = site.Desc
+	if f.Desc == "" {
+		f.Desc = site.Title
+	}
+	f.Link = fmt.Sprintf("%s/?username=%s&cat=%d&tag=%s&latest=%s", base, url.QueryEscape(qi.Username), qi.Cat, url.QueryEscape(qi.Tag), url.QueryEscape(qi.Latest))
+
+	for _, ie := range ee {
+		itemurl := base + createItemUrl(ie.Entry.Entryid)
+		fi := FeedItem{
+			Title:    ie.Entry.Title,
+			Link:     itemurl,
+			ItemUrl:  itemurl,
+			Username: ie.Submitter.Username,
+			Createdt: ie.Entry.Createdt,
+		}
+		if ie.Entry.Url != "" {
+			fi.Link = ie.Entry.Url
+		}
+		fi.Html = fmt.Sprintf("<p><a href=\"%s\">%d comments</a></p>", itemurl, ie.Ncomments)
+		if ie.Entry.Body != "" {
+			fi.Html = parseMarkdown(ie.Entry.Body) + fi.Html
+		}
+		fi.Tags, err = queryEntryTags(db, ie.Entry.Entryid)
+		if err != nil {
+			return nil, err
+		}
+		f.Items = append(f.Items, fi)
+	}
+	return &f, nil
+}
+
+// Latest comments anywhere in a submission's thread.
+func queryCommentsFeed(db *sql.DB, site *Site, base string, entryid int64) (*Feed, error) {
+	e, err := queryEntry(db, entryid)
+	if err != nil {
+		return nil, err
+	}
+	var anon User
+	anon.Userid = -1
+	var nflags int
+	s := "SELECT IFNULL((SELECT flags FROM totalflags WHERE entry_id = ?), 0)"
+	err = db.QueryRow(s, entryid).Scan(&nflags)
+	if err != nil {
+		return nil, err
+	}
+	if isFlagHidden(site, &anon, nflags) {
+		return nil, sql.ErrNoRows
+	}
+
+	var f Feed
+	f.Title = fmt.Sprintf("%s: comments on %s", site.Title, e.Title)
+	f.Desc = f.Title
+	f.Link = base + createItemUrl(entryid)
+
+	cond, pp := flagHiddenCond(site, &anon)
+	s = `WITH RECURSIVE thread(entry_id) AS (
+SELECT entry_id FROM entry WHERE parent_id = ? AND thing = 1
+UNION ALL
+SELECT e.entry_id FROM entry e INNER JOIN thread ON e.parent_id = thread.entry_id
+)
+SELECT e.entry_id, e.body, e.createdt, IFNULL(u.username, '')
+FROM entry e
+INNER JOIN thread ON e.entry_id = thread.entry_id
+LEFT OUTER JOIN user u ON e.user_id = u.user_id
+LEFT OUTER JOIN totalflags ON e.entry_id = totalflags.entry_id
+WHERE e.deleted = 0` + cond + `
+ORDER BY e.createdt DESC, e.entry_id DESC
+LIMIT ?`
+	qq := append([]interface{}{entryid}, pp...)
+	rows, err := db.Query(s, append(qq, FEED_LIMIT)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Entry
+		var username string
+		err := rows.Scan(&c.Entryid, &c.Body, &c.Createdt, &username)
+		if err != nil {
+			return nil, err
+		}
+		itemurl := base + createItemUrl(c.Entryid)
+		f.Items = append(f.Items, FeedItem{
+			Title:    fmt.Sprintf("%s on %s", username, e.Title),
+			Link:     itemurl,
+			ItemUrl:  itemurl,
+			Username: username,
+			Createdt: c.Createdt,
+			Html:     parseMarkdown(c.Body),
+		})
+	}
+	return &f, rows.Err()
+}
+
+func feedUpdated(f *Feed) time.Time {
+	var updated time.Time
+	for _, fi := range f.Items {
+		dt, _ := time.Parse(time.RFC3339, fi.Createdt)
+		if dt.After(updated) {
+			updated = dt
+		}
+	}
+	if updated.IsZero() {
+		updated = time.Now().UTC()
+	}
+	return updated
+}
+
+func createRssFeed(f *Feed) *RssFeed {
+	rss := RssFeed{
+		Version: "2.0",
+		XmlnsDc: "http://purl.org/dc/elements/1.1/",
+	}
+	rss.Channel = RssChannel{
+		Title:         f.Title,
+		Link:          f.Link,
+		Description:   f.Desc,
+		LastBuildDate: feedUpdated(f).Format(time.RFC1123Z),
+	}
+	for _, fi := range f.Items {
+		dt, _ := time.Parse(time.RFC3339, fi.Createdt)
+		rss.Channel.Items = append(rss.Channel.Items, RssItem{
+			Title:       fi.Title,
+			Link:        fi.Link,
+			Description: fi.Html,
+			Creator:     fi.Username,
+			PubDate:     dt.Format(time.RFC1123Z),
+			Guid:        RssGuid{IsPermaLink: "true", Value: fi.ItemUrl},
+			Comments:    fi.ItemUrl,
+			Categories:  fi.Tags,
+		})
+	}
+	return &rss
+}
+
+func createAtomFeed(f *Feed) *AtomFeed {
+	atom := AtomFeed{
+		Title:   f.Title,
+		Id:      f.SelfUrl,
+		Updated: feedUpdated(f).Format(time.RFC3339),
+		Links: []AtomLink{
+			{Href: f.SelfUrl, Rel: "self", Type: "application/atom+xml"},
+			{Href: f.Link, Rel: "alternate", Type: "text/html"},
+		},
+	}
+	for _, fi := range f.Items {
+		ae := AtomEntry{
+			Title:     fi.Title,
+			Id:        fi.ItemUrl,
+			Updated:   fi.Createdt,
+			Published: fi.Createdt,
+			Links:     []AtomLink{{Href: fi.Link, Rel: "alternate"}},
+			Author:    AtomPerson{Name: fi.Username},
+			Content:   &AtomText{Type: "html", Body: fi.Html},
+		}
+		if fi.Link != fi.ItemUrl {
+			ae.Links = append(ae.Links, AtomLink{Href: fi.ItemUrl, Rel: "replies", Type: "text/html"})
+		}
+		for _, tag := range fi.Tags {
+			ae.Categories = append(ae.Categories, AtomCategory{Term: tag})
+		}
+		atom.Entries = append(atom.Entries, ae)
+	}
+	return &atom
+}
+
+func queryFeed(db *sql.DB, r *http.Request) (*Feed, error) {
+	site := querySite(db)
+	// Links are built from -baseurl, not the request's Host header, so a
+	// cached feed can't be made to link to another site.
+	base := siteBaseUrl
+
+	var f *Feed
+	var err error
+	if qentryid := idtoi(r.FormValue("id")); qentryid != -1 {
+		f, err = queryCommentsFeed(db, site, base, qentryid)
+	} else {
+		f, err = querySubmissionsFeed(db, r, site, base)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.SelfUrl = base + r.URL.RequestURI()
+	return f, nil
+}
+
+func writeXml(w http.ResponseWriter, contentType string, v interface{}) {
+	bs, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("writeXml: %s\n", err)
+		http.Error(w, "Server error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(xml.Header))
+	w.Write(bs)
+}
+
+func rssHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := queryFeed(db, r)
+		if handleDbErr(w, err, "rsshandler") {
+			return
+		}
+		writeXml(w, "application/rss+xml; charset=utf-8", createRssFeed(f))
+	}
+}
+
+func atomHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := queryFeed(db, r)
+		if handleDbErr(w, err, "atomhandler") {
+			return
+		}
+		writeXml(w, "application/atom+xml; charset=utf-8", createAtomFeed(f))
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// When a url is submitted, its page is fetched for the title, description and
+// image, from the OpenGraph meta tags or else <title> and the description meta.
+// The title fills in a blank submission title, the description and image are
+// shown with the submission.
+//
+// Fetching is limited by FETCH_TIMEOUT and FETCH_MAXBYTES, and won't connect to
+// loopback, private or link-local addresses so that submitters can't use nb to
+// reach hosts on its own network. The address check is made when connecting,
+// after dns lookup and on every redirect.
+
+const FETCH_TIMEOUT = 5 * time.Second
+const FETCH_MAXBYTES = 512 * 1024
+const FETCH_MAXREDIRECTS = 5
+const FETCH_USERAGENT = "newsboard (+https://github.com/robdelacruz/newsboard)"
+
+const MAX_TITLE_LEN = 256
+const MAX_DESC_LEN = 300
+
+type PageMeta struct {
+	Title       string
+	Description string
+	Image       string
+}
+
+type Fetcher struct {
+	Client *http.Client
+}
+
+var errPrivateAddr = errors.New("private address not allowed")
+
+var fetcher = newFetcher(FETCH_TIMEOUT, false)
+
+// allowPrivate lets tests fetch from an httptest server on localhost.
+func newFetcher(timeout time.Duration, allowPrivate bool) *Fetcher {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isPrivateIp(ip) {
+				return errPrivateAddr
+			}
+			return nil
+		}
+	}
+	transport := &http.Transport{
+		Proxy:                 nil, // a proxy would connect on our behalf, past the address check
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= FETCH_MAXREDIRECTS {
+				return fmt.Errorf("stopped after %d redirects", FETCH_MAXREDIRECTS)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme '%s'", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+	return &Fetcher{Client: client}
+}
+
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPrivateIp(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || cgnatNet.Contains(ip)
+}
+
+func (f *Fetcher) fetchPageMeta(ctx context.Context, rawurl string) (*PageMeta, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", FETCH_USERAGENT)
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	mediatype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediatype != "text/html" && mediatype != "application/xhtml+xml" {
+		return nil, fmt.Errorf("not an html page (%s)", mediatype)
+	}
+
+	// Relative image urls are from the final page after redirects.
+	return parsePageMeta(io.LimitReader(resp.Body, FETCH_MAXBYTES), resp.Request.URL), nil
+}
+
+// Read meta from the page's <head>. OpenGraph tags are preferred over
+// <title> and the description meta.
+func parsePageMeta(r io.Reader, baseurl *url.URL) *PageMeta {
+	var title, desc, ogtitle, ogdesc, ogimage string
+	intitle := false
+
+	z := html.NewTokenizer(r)
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "title":
+				intitle = tt == html.StartTagToken && title == ""
+			case "meta":
+				var prop, content string
+				for _, a := range t.Attr {
+					switch strings.ToLower(a.Key) {
+					case "property", "name":
+						prop = strings.ToLower(a.Val)
+					case "content":
+						content = a.Val
+					}
+				}
+				switch prop {
+				case "og:title":
+					ogtitle = content
+				case "og:description":
+					ogdesc = content
+				case "og:image", "og:image:url":
+					if ogimage == "" {
+						ogimage = content
+					}
+				case "description":
+					desc = content
+				}
+			case "body":
+				break loop
+			}
+		case html.TextToken:
+			if intitle {
+				title += string(z.Text())
+			}
+		case html.EndTagToken:
+			t := z.Token()
+			if t.Data == "title" {
+				intitle = false
+			}
+			if t.Data == "head" {
+				break loop
+			}
+		}
+	}
+
+	var pm PageMeta
+	pm.Title = textSnippet(firstNonEmpty(ogtitle, title), MAX_TITLE_LEN)
+	pm.Description = textSnippet(firstNonEmpty(ogdesc, desc), MAX_DESC_LEN)
+	if ogimage != "" {
+		imgurl, err := baseurl.Parse(strings.TrimSpace(ogimage))
+		if err == nil && (imgurl.Scheme == "http" || imgurl.Scheme == "https") {
+			pm.Image = imgurl.String()
+		}
+	}
+	return &pm
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if strings.TrimSpace(s) != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// Fill in e's blank title, description and thumbnail from its url.
+// Errors are logged, the submission goes ahead without them.
+func fetchEntryMeta(ctx context.Context, e *Entry) {
+	if e.Url == "" || !featureEnabled(FEATURE_LINKPREVIEWS) {
+		return
+	}
+	pm, err := fetcher.fetchPageMeta(ctx, e.Url)
+	if err != nil {
+		logInfof("error fetching '%s' (%s)\n", e.Url, err)
+		return
+	}
+	if e.Title == "" {
+		e.Title = pm.Title
+	}
+	e.Description = pm.Description
+	e.Thumburl = pm.Image
+}
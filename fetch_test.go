@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchPageMeta(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/og", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<!DOCTYPE html><html><head>
+<title>Page title</title>
+<meta name="description" content="Plain description">
+<meta property="og:title" content="OG &amp; title">
+<meta property="og:description" content="OG description">
+<meta property="og:image" content="/img/thumb.png">
+</head><body><title>not this</title></body></html>`)
+	})
+	mux.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><title>
+  Plain   title </title><meta name="description" content="Plain description"></head></html>`)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/og", http.StatusFound)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><head><!--")
+		fmt.Fprint(w, strings.Repeat("x", FETCH_MAXBYTES))
+		fmt.Fprint(w, "--><title>past the size cap</title></head></html>")
+	})
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"title": "no"}`)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<title>slow</title>")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	f := newFetcher(200*time.Millisecond, true)
+	ctx := context.Background()
+
+	pm, err := f.fetchPageMeta(ctx, ts.URL+"/og")
+	if err != nil {
+		t.Fatalf("fetch failed (%s)", err)
+	}
+	if pm.Title != "OG & title" || pm.Description != "OG description" || pm.Image != ts.URL+"/img/thumb.png" {
+		t.Fatalf("og meta not read: %+v", pm)
+	}
+
+	pm, err = f.fetchPageMeta(ctx, ts.URL+"/plain")
+	if err != nil {
+		t.Fatalf("fetch failed (%s)", err)
+	}
+	if pm.Title != "Plain title" || pm.Description != "Plain description" || pm.Image != "" {
+		t.Fatalf("title and description meta not read: %+v", pm)
+	}
+
+	pm, err = f.fetchPageMeta(ctx, ts.URL+"/redirect")
+	if err != nil || pm.Title != "OG & title" {
+		t.Fatalf("redirect not followed: %+v (%v)", pm, err)
+	}
+
+	pm, err = f.fetchPageMeta(ctx, ts.URL+"/big")
+	if err != nil {
+		t.Fatalf("fetch failed (%s)", err)
+	}
+	if pm.Title != "" {
+		t.Fatalf("page should only be read up to the size cap, got title %q", pm.Title)
+	}
+
+	if _, err := f.fetchPageMeta(ctx, ts.URL+"/json"); err == nil {
+		t.Fatalf("non-html page should fail")
+	}
+	if _, err := f.fetchPageMeta(ctx, ts.URL+"/slow"); err == nil {
+		t.Fatalf("slow page should time out")
+	}
+	if _, err := f.fetchPageMeta(ctx, "file:///etc/passwd"); err == nil {
+		t.Fatalf("non-http url should fail")
+	}
+}
+
+func TestFetchPrivateAddr(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<title>internal</title>")
+	}))
+	defer ts.Close()
+
+	f := newFetcher(time.Second, false)
+	_, err := f.fetchPageMeta(context.Background(), ts.URL)
+	if !errors.Is(err, errPrivateAddr) {
+		t.Fatalf("fetching a loopback address should be refused, got %v", err)
+	}
+
+	for _, s := range []string{"10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "::1", "fc00::1", "0.0.0.0"} {
+		if !isPrivateIp(net.ParseIP(s)) {
+			t.Errorf("%s should be private", s)
+		}
+	}
+	if isPrivateIp(net.ParseIP("93.184.216.34")) {
+		t.Errorf("public address shouldn't be private")
+	}
+}
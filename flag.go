@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Users flag entries that break the rules, giving a reason.
+// Entries with at least site.Flagthreshold flags are either marked
+// [flagged] or hidden from non-moderators, depending on site.Flagaction.
+
+var flagReasons = []string{"spam", "offensive", "off-topic", "other"}
+
+const FLAGS_LIMIT = 50
+
+type EntryFlag struct {
+	Entryid  int64
+	Userid   int64
+	Username string
+	Reason   string
+	Createdt string
+}
+
+type FlaggedEntry struct {
+	Entry         Entry
+	Nflags        int
+	Overthreshold bool
+}
+
+func isValidFlagReason(reason string) bool {
+	for _, r := range flagReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func flagEntry(db *sql.DB, entryid, userid int64, reason string) error {
+	s := "INSERT OR REPLACE INTO entryflag (entry_id, user_id, reason, createdt) VALUES (?, ?, ?, ?)"
+	_, err := sqlexec(db, s, entryid, userid, reason, time.Now().Format(time.RFC3339))
+	return err
+}
+
+func unflagEntry(db *sql.DB, entryid, userid int64) error {
+	s := "DELETE FROM entryflag WHERE entry_id = ? AND user_id = ?"
+	_, err := sqlexec(db, s, entryid, userid)
+	return err
+}
+
+func clearEntryFlags(db *sql.DB, entryid int64) error {
+	s := "DELETE FROM entryflag WHERE entry_id = ?"
+	_, err := sqlexec(db, s, entryid)
+	return err
+}
+
+func queryEntryFlags(db *sql.DB, entryid int64) ([]EntryFlag, error) {
+	s := `SELECT f.entry_id, f.user_id, IFNULL(u.username, ''), f.reason, f.createdt
+FROM entryflag f
+LEFT OUTER JOIN user u ON f.user_id = u.user_id
+WHERE f.entry_id = ?
+ORDER BY f.createdt`
+	rows, err := db.Query(s, entryid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ff []EntryFlag
+	for rows.Next() {
+		var f EntryFlag
+		err := rows.Scan(&f.Entryid, &f.Userid, &f.Username, &f.Reason, &f.Createdt)
+		if err != nil {
+			return nil, err
+		}
+		ff = append(ff, f)
+	}
+	return ff, rows.Err()
+}
+
+// Returns the flag reason given by userid, or "" if not flagged by the user.
+func queryUserFlag(db *sql.DB, entryid, userid int64) (string, error) {
+	var reason string
+	s := "SELECT reason FROM entryflag WHERE entry_id = ? AND user_id = ?"
+	err := db.QueryRow(s, entryid, userid).Scan(&reason)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return reason, err
+}
+
+// Entries with any flags, most flagged first.
+func queryFlaggedEntries(db *sql.DB, limit int) ([]FlaggedEntry, error) {
+	s := `SELECT e.entry_id, e.thing, e.title, e.body, e.createdt, totalflags.flags
+FROM totalflags
+INNER JOIN entry e ON totalflags.entry_id = e.entry_id
+WHERE e.deleted = 0
+ORDER BY totalflags.flags DESC, e.entry_id DESC
+LIMIT ?`
+	rows, err := db.Query(s, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ff []FlaggedEntry
+	for rows.Next() {
+		var fe FlaggedEntry
+		err := rows.Scan(&fe.Entry.Entryid, &fe.Entry.Thing, &fe.Entry.Title, &fe.Entry.Body, &fe.Entry.Createdt, &fe.Nflags)
+		if err != nil {
+			return nil, err
+		}
+		ff = append(ff, fe)
+	}
+	return ff, rows.Err()
+}
+
+func entrySummary(e *Entry) string {
+	if e.Thing == SUBMISSION {
+		return e.Title
+	}
+	return textSnippet(e.Body, 80)
+}
+
+// /flag/?id=<entryid>&from=<url>
+// Users add or withdraw their own flag. Moderators also see all flags
+// given to the entry and can clear them.
+func flagHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		qentryid := idtoi(r.FormValue("id"))
+		if !validateIdParm(w, qentryid) {
+			return
+		}
+		qfrom := r.FormValue("from")
+		if qfrom == "" {
+			qfrom = createItemUrl(qentryid)
+		}
+
+		login := getLoginUser(r, db)
+		if !validateLogin(w, login) {
+			return
+		}
+
+		e, err := queryEntry(db, qentryid)
+		if handleDbErr(w, err, "flaghandler") {
+			return
+		}
+		if !canFlag(login, e.Userid) && !isModerator(login) {
+			http.Error(w, "Can't flag your own entry.", 403)
+			return
+		}
+
+		userreason, err := queryUserFlag(db, qentryid, login.Userid)
+		if handleDbErr(w, err, "flaghandler") {
+			return
+		}
+
+		var freason, fdetails string
+		if r.Method == "POST" {
+			freason = r.FormValue("reason")
+			fdetails = strings.TrimSpace(r.FormValue("details"))
+			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+
+				switch r.FormValue("action") {
+				case "unflag":
+					err = unflagEntry(db, qentryid, login.Userid)
+				case "clear":
+					if !isModerator(login) {
+						http.Error(w, "moderator required", 401)
+						return
+					}
+					err = clearEntryFlags(db, qentryid)
+				default:
+					if !canFlag(login, e.Userid) {
+						errmsg = "Can't flag your own entry."
+						break
+					}
+					if !isValidFlagReason(freason) {
+						errmsg = "Please select a reason."
+						break
+					}
+					reason := freason
+					if fdetails != "" {
+						reason = fmt.Sprintf("%s: %s", freason, fdetails)
+					}
+					err = flagEntry(db, qentryid, login.Userid, reason)
+				}
+				if errmsg != "" {
+					break
+				}
+				if err != nil {
+					log.Printf("DB error updating flags: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+
+				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
+				return
+			}
+		}
+
+		var ff []EntryFlag
+		if isModerator(login) {
+			ff, err = queryEntryFlags(db, qentryid)
+			if err != nil {
+				log.Printf("DB error querying entry flags: %s\n", err)
+			}
+		}
+
+		data := struct {
+			Page
+			Entry      *Entry
+			From       string
+			Userreason string
+			Canflag    bool
+			Reasons    []string
+			Reason     string
+			Details    string
+			Flags      []EntryFlag
+		}{
+			Page:       newPage(r, db, login, querySite(db)),
+			Entry:      e,
+			From:       qfrom,
+			Userreason: userreason,
+			Canflag:    canFlag(login, e.Userid),
+			Reasons:    flagReasons,
+			Reason:     freason,
+			Details:    fdetails,
+			Flags:      ff,
+		}
+		data.Errmsg = errmsg
+		renderPage(w, "flag.html", data)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Schema migrations are applied in order at startup and by 'nb -migrate'.
+// The current schema version is kept in PRAGMA user_version.
+//
+// Databases created before migrations were introduced have user_version 0,
+// so migration 1 uses IF NOT EXISTS and INSERT OR IGNORE to bring any older
+// newsboard file up to the initial schema without touching existing data.
+//
+// Never edit a migration that has been released, add a new one instead.
+type Migration struct {
+	Version int
+	Desc    string
+	Stmts   []string
+}
+
+var migrations = []Migration{
+	{1, "initial schema", []string{
+		`CREATE TABLE IF NOT EXISTS entry (entry_id INTEGER PRIMARY KEY NOT NULL, thing INTEGER NOT NULL DEFAULT 0, title TEXT NOT NULL DEFAULT '', url TEXT NOT NULL DEFAULT '', body TEXT NOT NULL DEFAULT '', createdt TEXT NOT NULL, user_id INTEGER NOT NULL, parent_id INTEGER DEFAULT 0);`,
+		`CREATE TABLE IF NOT EXISTS user (user_id INTEGER PRIMARY KEY NOT NULL, username TEXT, password TEXT, active INTEGER NOT NULL, email TEXT, CONSTRAINT unique_username UNIQUE (username));`,
+		`INSERT OR IGNORE INTO user (user_id, username, password, active, email) VALUES (1, 'admin', '', 1, 'admin@localhost');`,
+		`CREATE TABLE IF NOT EXISTS entryvote(entry_id INTEGER NOT NULL, user_id INTEGER, PRIMARY KEY (entry_id, user_id));`,
+		`CREATE TABLE IF NOT EXISTS entrytag(entry_id INTEGER NOT NULL, tag TEXT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS cat(cat_id INTEGER PRIMARY KEY NOT NULL, name TEXT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS entrycat(entry_id INTEGER NOT NULL, cat_id INTEGER NOT NULL)`,
+		`INSERT OR IGNORE INTO cat (cat_id, name) VALUES (1, 'Main');`,
+		`CREATE TABLE IF NOT EXISTS site (site_id INTEGER PRIMARY KEY NOT NULL, title TEXT NOT NULL, desc TEXT NOT NULL, gravityf REAL NOT NULL);`,
+		`INSERT OR IGNORE INTO site (site_id, title, desc, gravityf) VALUES (1, 'newsboard', '', 1.0);`,
+		`DROP VIEW IF EXISTS totalvotes;`,
+		`CREATE VIEW totalvotes
+AS
+SELECT entry_id, COUNT(*) AS votes FROM entryvote GROUP BY entry_id;`,
+		// Welcome submission for new newsboard files.
+		`INSERT INTO entry (entry_id, thing, title, url, body, createdt, user_id, parent_id) SELECT 1, 0, 'newsboard - a hackernews clone', 'https://github.com/robdelacruz/newsboard', '', strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), 1, 0 WHERE NOT EXISTS (SELECT 1 FROM entry);`,
+		// Submissions from before categories were added go in 'Main'.
+		`INSERT INTO entrycat (entry_id, cat_id) SELECT entry_id, 1 FROM entry WHERE thing = 0 AND entry_id NOT IN (SELECT entry_id FROM entrycat);`,
+	}},
+	{2, "login sessions", []string{
+		`CREATE TABLE IF NOT EXISTS session (session_id TEXT PRIMARY KEY NOT NULL, user_id INTEGER NOT NULL, createdt TEXT NOT NULL, expiredt TEXT NOT NULL, lastseendt TEXT NOT NULL);`,
+	}},
+	{3, "full-text search index", []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS entry_fts USING fts5(title, body, url, tokenize = 'porter unicode61');`,
+		`DELETE FROM entry_fts;`,
+		`INSERT INTO entry_fts (rowid, title, body, url) SELECT entry_id, title, body, url FROM entry;`,
+	}},
+	{4, "user roles", []string{
+		`ALTER TABLE user ADD COLUMN role INTEGER NOT NULL DEFAULT 0;`,
+		`UPDATE user SET role = 2 WHERE user_id = 1;`,
+	}},
+	{5, "api tokens", []string{
+		`CREATE TABLE IF NOT EXISTS apitoken (apitoken_id INTEGER PRIMARY KEY NOT NULL, user_id INTEGER NOT NULL, tokenhash TEXT NOT NULL UNIQUE, createdt TEXT NOT NULL);`,
+	}},
+	{6, "api token names, scopes and expiry", []string{
+		`ALTER TABLE apitoken ADD COLUMN name TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE apitoken ADD COLUMN scopes TEXT NOT NULL DEFAULT 'read,submit,comment,vote';`,
+		`ALTER TABLE apitoken ADD COLUMN expiredt TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE apitoken ADD COLUMN lastuseddt TEXT NOT NULL DEFAULT '';`,
+	}},
+	{7, "site secret", []string{
+		`ALTER TABLE site ADD COLUMN secret TEXT NOT NULL DEFAULT '';`,
+		`UPDATE site SET secret = lower(hex(randomblob(32))) WHERE secret = '';`,
+	}},
+	{8, "vote direction and flags", []string{
+		`ALTER TABLE entryvote ADD COLUMN dir INTEGER NOT NULL DEFAULT 1;`,
+		`DROP VIEW IF EXISTS totalvotes;`,
+		`CREATE VIEW totalvotes
+AS
+SELECT entry_id, SUM(dir) AS votes, SUM(dir > 0) AS ups, SUM(dir < 0) AS downs FROM entryvote GROUP BY entry_id;`,
+		`CREATE TABLE IF NOT EXISTS entryflag (entry_id INTEGER NOT NULL, user_id INTEGER NOT NULL, reason TEXT NOT NULL, createdt TEXT NOT NULL, PRIMARY KEY (entry_id, user_id));`,
+		`DROP VIEW IF EXISTS totalflags;`,
+		`CREATE VIEW totalflags
+AS
+SELECT entry_id, COUNT(*) AS flags FROM entryflag GROUP BY entry_id;`,
+		`ALTER TABLE site ADD COLUMN downvotekarma INTEGER NOT NULL DEFAULT 20;`,
+		`ALTER TABLE site ADD COLUMN flagthreshold INTEGER NOT NULL DEFAULT 3;`,
+		`ALTER TABLE site ADD COLUMN flagaction INTEGER NOT NULL DEFAULT 0;`,
+	}},
+	{9, "user profile", []string{
+		`ALTER TABLE user ADD COLUMN createdt TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE user ADD COLUMN about TEXT NOT NULL DEFAULT '';`,
+		// Existing users joined no later than their first entry.
+		`UPDATE user SET createdt = IFNULL((SELECT MIN(e.createdt) FROM entry e WHERE e.user_id = user.user_id), strftime('%Y-%m-%dT%H:%M:%SZ', 'now')) WHERE createdt = '';`,
+		`DROP VIEW IF EXISTS userkarma;`,
+		`CREATE VIEW userkarma
+AS
+SELECT e.user_id, SUM(ev.dir) AS karma FROM entryvote ev INNER JOIN entry e ON ev.entry_id = e.entry_id WHERE ev.user_id <> e.user_id GROUP BY e.user_id;`,
+	}},
+	{10, "reply notifications", []string{
+		`CREATE TABLE IF NOT EXISTS notification (notification_id INTEGER PRIMARY KEY NOT NULL, user_id INTEGER NOT NULL, entry_id INTEGER NOT NULL, isread INTEGER NOT NULL DEFAULT 0, createdt TEXT NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS notification_user_isread ON notification (user_id, isread);`,
+	}},
+	{11, "email verification, password reset and digests", []string{
+		`CREATE TABLE IF NOT EXISTS usertoken (tokenhash TEXT PRIMARY KEY NOT NULL, user_id INTEGER NOT NULL, kind INTEGER NOT NULL, email TEXT NOT NULL DEFAULT '', createdt TEXT NOT NULL, expiredt TEXT NOT NULL);`,
+		`ALTER TABLE user ADD COLUMN emailverified INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE user ADD COLUMN digest INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE user ADD COLUMN lastdigestdt TEXT NOT NULL DEFAULT '';`,
+	}},
+	{12, "rate limits", []string{
+		`ALTER TABLE site ADD COLUMN submitlimit INTEGER NOT NULL DEFAULT 10;`,
+		`ALTER TABLE site ADD COLUMN commentlimit INTEGER NOT NULL DEFAULT 60;`,
+		`ALTER TABLE site ADD COLUMN signuplimit INTEGER NOT NULL DEFAULT 3;`,
+		`ALTER TABLE site ADD COLUMN probationhours INTEGER NOT NULL DEFAULT 24;`,
+		`ALTER TABLE site ADD COLUMN probationsubmitlimit INTEGER NOT NULL DEFAULT 2;`,
+		`ALTER TABLE site ADD COLUMN probationcommentlimit INTEGER NOT NULL DEFAULT 10;`,
+		`ALTER TABLE site ADD COLUMN persistlimits INTEGER NOT NULL DEFAULT 0;`,
+		`CREATE TABLE IF NOT EXISTS ratelimit (key TEXT PRIMARY KEY NOT NULL, tokens REAL NOT NULL, updatedt TEXT NOT NULL);`,
+	}},
+	{13, "duplicate url detection", []string{
+		`ALTER TABLE entry ADD COLUMN normurl TEXT NOT NULL DEFAULT '';`,
+		`UPDATE entry SET normurl = normalize_url(url) WHERE thing = 0 AND url <> '';`,
+		`CREATE INDEX IF NOT EXISTS entry_normurl ON entry (normurl);`,
+		`ALTER TABLE site ADD COLUMN dupedays INTEGER NOT NULL DEFAULT 30;`,
+	}},
+	{14, "submission description and thumbnail", []string{
+		`ALTER TABLE entry ADD COLUMN description TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE entry ADD COLUMN thumburl TEXT NOT NULL DEFAULT '';`,
+	}},
+	{15, "category settings and moderators", []string{
+		`ALTER TABLE cat ADD COLUMN desc TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE cat ADD COLUMN gravityf REAL NOT NULL DEFAULT -1;`,
+		`ALTER TABLE cat ADD COLUMN postpolicy INTEGER NOT NULL DEFAULT 0;`,
+		`CREATE TABLE IF NOT EXISTS catmod (cat_id INTEGER NOT NULL, user_id INTEGER NOT NULL, PRIMARY KEY (cat_id, user_id));`,
+	}},
+	{16, "normalized tags, aliases and blocked tags", []string{
+		`UPDATE entrytag SET tag = normalize_tag(tag);`,
+		`DELETE FROM entrytag WHERE tag = '' OR rowid NOT IN (SELECT MIN(rowid) FROM entrytag GROUP BY entry_id, tag);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS entrytag_entry_tag ON entrytag (entry_id, tag);`,
+		`CREATE INDEX IF NOT EXISTS entrytag_tag ON entrytag (tag);`,
+		`CREATE TABLE IF NOT EXISTS tagalias (alias TEXT PRIMARY KEY NOT NULL, tag TEXT NOT NULL);`,
+		`CREATE TABLE IF NOT EXISTS tagblock (tag TEXT PRIMARY KEY NOT NULL, createdt TEXT NOT NULL);`,
+	}},
+	{17, "audit log", []string{
+		`CREATE TABLE IF NOT EXISTS auditlog (audit_id INTEGER PRIMARY KEY NOT NULL, createdt TEXT NOT NULL, actor_id INTEGER NOT NULL, action TEXT NOT NULL, targettype TEXT NOT NULL, target_id INTEGER NOT NULL, target TEXT NOT NULL DEFAULT '', beforeval TEXT NOT NULL DEFAULT '', afterval TEXT NOT NULL DEFAULT '', reason TEXT NOT NULL DEFAULT '');`,
+		`CREATE INDEX IF NOT EXISTS auditlog_target ON auditlog (targettype, target_id);`,
+		// Append-only
+		`CREATE TRIGGER IF NOT EXISTS auditlog_noupdate BEFORE UPDATE ON auditlog BEGIN SELECT RAISE(ABORT, 'auditlog is append-only'); END;`,
+		`CREATE TRIGGER IF NOT EXISTS auditlog_nodelete BEFORE DELETE ON auditlog BEGIN SELECT RAISE(ABORT, 'auditlog is append-only'); END;`,
+	}},
+	{18, "soft delete", []string{
+		`ALTER TABLE entry ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE entry ADD COLUMN deletedt TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE entry ADD COLUMN deletedby INTEGER NOT NULL DEFAULT 0;`,
+		`CREATE INDEX IF NOT EXISTS entry_deleted ON entry (deleted);`,
+		`ALTER TABLE site ADD COLUMN trashdays INTEGER NOT NULL DEFAULT 30;`,
+	}},
+	{19, "entry revisions", []string{
+		`CREATE TABLE IF NOT EXISTS entry_revision (revision_id INTEGER PRIMARY KEY NOT NULL, entry_id INTEGER NOT NULL, title TEXT NOT NULL DEFAULT '', url TEXT NOT NULL DEFAULT '', body TEXT NOT NULL DEFAULT '', createdt TEXT NOT NULL, editor_id INTEGER NOT NULL DEFAULT 0);`,
+		`CREATE INDEX IF NOT EXISTS entry_revision_entry ON entry_revision (entry_id);`,
+		`ALTER TABLE entry ADD COLUMN editdt TEXT NOT NULL DEFAULT '';`,
+	}},
+	{20, "entry root id", []string{
+		`ALTER TABLE entry ADD COLUMN root_id INTEGER NOT NULL DEFAULT 0;`,
+		// Comments whose thread no longer reaches a submission are left at 0.
+		`WITH RECURSIVE root(entry_id, root_id) AS (
+SELECT entry_id, entry_id FROM entry WHERE IFNULL(parent_id, 0) = 0
+UNION ALL
+SELECT e.entry_id, root.root_id FROM entry e INNER JOIN root ON e.parent_id = root.entry_id
+)
+UPDATE entry SET root_id = IFNULL((SELECT root.root_id FROM root WHERE root.entry_id = entry.entry_id), 0);`,
+		`CREATE INDEX IF NOT EXISTS entry_root ON entry (root_id);`,
+	}},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func querySchemaVersion(db *sql.DB) (int, error) {
+	var ver int
+	err := db.QueryRow("PRAGMA user_version").Scan(&ver)
+	if err != nil {
+		return 0, err
+	}
+	return ver, nil
+}
+
+// Apply all pending migrations in a single transaction.
+// In dryrun mode, the migrations are run then rolled back so that errors
+// still show up without changing the newsboard file.
+// Returns the migrations that were applied (or would have been).
+func migrateDb(db *sql.DB, dryrun bool) ([]Migration, error) {
+	ver, err := querySchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if ver > latestSchemaVersion() {
+		return nil, fmt.Errorf("newsboard file schema version %d is newer than this nb (version %d)", ver, latestSchemaVersion())
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > ver {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, m := range pending {
+		for _, s := range m.Stmts {
+			_, err := tx.Exec(s)
+			if err != nil && isDuplicateColumnErr(s, err) {
+				// Column was already added by a pre-migration build.
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("migration %d (%s): %s", m.Version, m.Desc, err)
+			}
+		}
+		_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.Version))
+		if err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %s", m.Version, m.Desc, err)
+		}
+	}
+
+	if dryrun {
+		return pending, nil
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func isDuplicateColumnErr(s string, err error) bool {
+	return strings.Contains(s, "ADD COLUMN") && strings.Contains(err.Error(), "duplicate column name")
+}
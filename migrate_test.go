@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDb(t *testing.T) *sql.DB {
+	registerSqliteFuncs()
+	dbfile := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3_custom", dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateNew(t *testing.T) {
+	db := openTestDb(t)
+
+	applied, err := migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("applied %d migrations, want %d", len(applied), len(migrations))
+	}
+	ver, _ := querySchemaVersion(db)
+	if ver != latestSchemaVersion() {
+		t.Errorf("schema version %d, want %d", ver, latestSchemaVersion())
+	}
+
+	// Second run is a no-op.
+	applied, err = migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("applied %d migrations on up to date db", len(applied))
+	}
+
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM entrycat WHERE entry_id = 1 AND cat_id = 1").Scan(&n)
+	if n != 1 {
+		t.Errorf("welcome entry not in Main category")
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	db := openTestDb(t)
+
+	// Schema from before entrytag, cat and entrycat were added.
+	ss := []string{
+		`CREATE TABLE entry (entry_id INTEGER PRIMARY KEY NOT NULL, thing INTEGER NOT NULL DEFAULT 0, title TEXT NOT NULL DEFAULT '', url TEXT NOT NULL DEFAULT '', body TEXT NOT NULL DEFAULT '', createdt TEXT NOT NULL, user_id INTEGER NOT NULL, parent_id INTEGER DEFAULT 0);`,
+		`CREATE TABLE user (user_id INTEGER PRIMARY KEY NOT NULL, username TEXT, password TEXT, active INTEGER NOT NULL, email TEXT, CONSTRAINT unique_username UNIQUE (username));`,
+		`INSERT INTO user (user_id, username, password, active, email) VALUES (1, 'admin', '', 1, 'admin@localhost');`,
+		`CREATE TABLE entryvote(entry_id INTEGER NOT NULL, user_id INTEGER, PRIMARY KEY (entry_id, user_id));`,
+		`CREATE TABLE site (site_id INTEGER PRIMARY KEY NOT NULL, title TEXT NOT NULL, desc TEXT NOT NULL, gravityf REAL NOT NULL);`,
+		`INSERT INTO site (site_id, title, desc, gravityf) VALUES (1, 'old board', '', 1.0);`,
+		`INSERT INTO entry (entry_id, thing, title, url, body, createdt, user_id, parent_id) VALUES (7, 0, 'old post', '', 'hello', '2020-01-01T00:00:00Z', 1, 0);`,
+		`INSERT INTO entry (entry_id, thing, title, url, body, createdt, user_id, parent_id) VALUES (8, 1, '', '', 'old reply', '2020-01-02T00:00:00Z', 1, 7);`,
+		`INSERT INTO entry (entry_id, thing, title, url, body, createdt, user_id, parent_id) VALUES (9, 1, '', '', 'nested reply', '2020-01-03T00:00:00Z', 1, 8);`,
+	}
+	for _, s := range ss {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dry run doesn't change anything.
+	applied, err := migrateDb(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("dry run returned %d migrations, want %d", len(applied), len(migrations))
+	}
+	ver, _ := querySchemaVersion(db)
+	if ver != 0 {
+		t.Errorf("dry run changed schema version to %d", ver)
+	}
+
+	_, err = migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var title string
+	db.QueryRow("SELECT title FROM site WHERE site_id = 1").Scan(&title)
+	if title != "old board" {
+		t.Errorf("site title overwritten: '%s'", title)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM entry").Scan(&n)
+	if n != 3 {
+		t.Errorf("%d entries after migration, want 3", n)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM entry WHERE root_id = 7").Scan(&n)
+	if n != 3 {
+		t.Errorf("%d entries with root 7 after migration, want 3", n)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM entrycat WHERE entry_id = 7 AND cat_id = 1").Scan(&n)
+	if n != 1 {
+		t.Errorf("old submission not in Main category")
+	}
+	db.QueryRow("SELECT COUNT(*) FROM entry_fts WHERE entry_fts MATCH 'hello'").Scan(&n)
+	if n != 1 {
+		t.Errorf("old submission not in search index")
+	}
+}
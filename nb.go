@@ -20,6 +20,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	sqlite "github.com/mattn/go-sqlite3"
@@ -32,6 +33,14 @@ const ADMIN_ID = 1
 const SUBMISSION = 0
 const COMMENT = 1
 
+const ROLE_USER = 0
+const ROLE_MODERATOR = 1
+const ROLE_ADMIN = 2
+
+// What happens to entries that reach the site flag threshold.
+const FLAG_MARK = 0
+const FLAG_HIDE = 1
+
 const SETTINGS_LIMIT = 30
 
 type User struct {
@@ -39,12 +48,42 @@ type User struct {
 	Username string
 	Active   bool
 	Email    string
+	Role     int
+	Karma    int
+	Createdt string
+	About    string
+
+	Emailverified bool
+	Digest        bool // email daily digest of replies
+	Lastdigestdt  string
+
+	// Login session, used to create csrf tokens.
+	Sessionid string
+	Modcats   []int64 // categories the login user moderates
+
+	// Set when authenticated by api token instead of session cookie.
+	Tokenid int64
+	Scopes  []string
 }
 
 type Site struct {
-	Title    string
-	Desc     string
-	Gravityf float64
+	Title         string
+	Desc          string
+	Gravityf      float64
+	Downvotekarma int
+	Flagthreshold int
+	Flagaction    int
+	Dupedays      int // days a url can't be submitted again, 0 to allow
+	Trashdays     int // days deleted entries are kept before they're purged, 0 to keep them
+
+	// Hourly rate limits, 0 for no limit. See ratelimit.go.
+	Submitlimit           int
+	Commentlimit          int
+	Signuplimit           int
+	Probationhours        int
+	Probationsubmitlimit  int
+	Probationcommentlimit int
+	Persistlimits         bool
 }
 
 type Entry struct {
@@ -56,17 +95,28 @@ type Entry struct {
 	Createdt string
 	Userid   int64
 	Parentid int64
+
+	// Fetched from the submitted url's page.
+	Description string
+	Thumburl    string
+
+	Deleted int    // ENTRY_DELETED or ENTRY_PURGED, see trash.go
+	Editdt  string // last edited, blank if never, see revision.go
 }
 
 type Cat struct {
-	Catid int64
-	Name  string
+	Catid      int64
+	Name       string
+	Desc       string
+	Gravityf   float64 // -1 to use the site's gravity factor
+	Postpolicy int
 }
 
 type VoteResult struct {
 	Entryid    int64 `json:"entryid"`
 	Userid     int64 `json:"userid"`
 	TotalVotes int   `json:"totalvotes"`
+	Dir        int   `json:"dir"`
 }
 
 type QIndex struct {
@@ -80,30 +130,46 @@ func main() {
 	os.Args = os.Args[1:]
 	sw, parms := parseArgs(os.Args)
 
+	registerSqliteFuncs()
+
 	// [-i new_file]  Create and initialize newsboard file
 	if sw["i"] != "" {
 		dbfile := sw["i"]
 		if fileExists(dbfile) {
-			s := fmt.Sprintf("File '%s' already exists. Can't initialize it.\n", dbfile)
-			fmt.Printf(s)
+			fmt.Printf("File '%s' already exists. Can't initialize it.\n", dbfile)
 			os.Exit(1)
 		}
 		createAndInitTables(dbfile)
 		os.Exit(0)
 	}
 
+	// [-migrate file [--dryrun]]  Update newsboard file to the latest schema
+	if sw["migrate"] != "" {
+		migrateFile(sw["migrate"], sw["dryrun"] != "")
+		os.Exit(0)
+	}
+
 	// Need to specify a notes file as first parameter.
 	if len(parms) == 0 {
 		s := `Usage:
 
 Start webservice using existing newsboard file:
-	nb <newsboard_file> [port]
+	nb <newsboard_file> [port] [-config <file>] [-listen <host:port>|unix:<path>|systemd] [-static <dir>] [-templates <dir>]
+		[-baseurl <url>] [-pagesize <n>] [-secretfile <file>] [-loglevel error|info|debug]
+		[-mailer stdout|file:<path>|smtp://...] [-features <feature>=on|off,...]
+
+	Switches can also be set by NB_<SWITCH> environment variables, or in a
+	JSON config file. Switches take precedence over environment variables,
+	which take precedence over the config file.
 
 Initialize new newsboard file:
 	nb -i <newsboard_file>
 
+Update newsboard file to the latest schema:
+	nb -migrate <newsboard_file> [--dryrun]
+
 `
-		fmt.Printf(s)
+		fmt.Print(s)
 		os.Exit(0)
 	}
 
@@ -113,47 +179,142 @@ Initialize new newsboard file:
 		s := fmt.Sprintf(`Newboard file '%s' doesn't exist. Create one using:
 	nb -i <newsboard_file>
 `, dbfile)
-		fmt.Printf(s)
+		fmt.Print(s)
+		os.Exit(1)
+	}
+
+	// [port] after the newsboard file is the same as -listen :<port>
+	if len(parms) > 1 && sw["listen"] == "" {
+		sw["listen"] = ":" + parms[1]
+	}
+	var err error
+	cfg, err = loadConfig(sw, os.Getenv)
+	if err != nil {
+		fmt.Printf("Error in settings (%s)\n", err)
 		os.Exit(1)
 	}
 
-	registerSqliteFuncs()
 	db, err := sql.Open("sqlite3_custom", dbfile)
 	if err != nil {
 		fmt.Printf("Error opening '%s' (%s)\n", dbfile, err)
 		os.Exit(1)
 	}
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "./static/news-paper.ico") })
+	applied, err := migrateDb(db, false)
+	if err != nil {
+		fmt.Printf("Error updating '%s' schema (%s)\n", dbfile, err)
+		os.Exit(1)
+	}
+	for _, m := range applied {
+		fmt.Printf("Applied migration %d: %s\n", m.Version, m.Desc)
+	}
+	if cfg.Secretfile != "" {
+		err = loadSecretFile(cfg.Secretfile)
+		if err != nil {
+			fmt.Printf("Error reading site secret from '%s' (%s)\n", cfg.Secretfile, err)
+			os.Exit(1)
+		}
+	} else {
+		err = loadSiteSecret(db)
+		if err != nil {
+			fmt.Printf("Error reading '%s' site secret (%s)\n", dbfile, err)
+			os.Exit(1)
+		}
+	}
+	mailer, err = newMailer(cfg.Mailer)
+	if err != nil {
+		fmt.Printf("Error setting up mailer (%s)\n", err)
+		os.Exit(1)
+	}
+	if cfg.Mailer == "" {
+		logInfof("Mail not configured, set -mailer to send email.\n")
+	}
+	if cfg.Templates != "" {
+		views, err = loadTemplates(cfg.Templates)
+		if err != nil {
+			fmt.Printf("Error loading templates from '%s' (%s)\n", cfg.Templates, err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Static != "" {
+		assets, err = loadStaticAssets(cfg.Static)
+		if err != nil {
+			fmt.Printf("Error loading static files from '%s' (%s)\n", cfg.Static, err)
+			os.Exit(1)
+		}
+	}
+
+	http.Handle("/static/", assets)
+	http.HandleFunc("/favicon.ico", assets.serveFile("news-paper.ico"))
 	http.HandleFunc("/login/", loginHandler(db))
 	http.HandleFunc("/logout/", logoutHandler(db))
-	http.HandleFunc("/createaccount/", createaccountHandler(db))
+	http.HandleFunc("/logoutall/", logoutallHandler(db))
+	http.HandleFunc("/createaccount/", requireFeature(FEATURE_SIGNUP, createaccountHandler(db)))
+	http.HandleFunc("/forgotpwd/", forgotpwdHandler(db))
+	http.HandleFunc("/resetpwd/", resetpwdHandler(db))
+	http.HandleFunc("/verifyemail/", verifyemailHandler(db))
 	http.HandleFunc("/adminsetup/", adminsetupHandler(db))
 	http.HandleFunc("/usersetup/", usersetupHandler(db))
 	http.HandleFunc("/edituser/", edituserHandler(db))
 	http.HandleFunc("/activateuser/", activateuserHandler(db))
+	http.HandleFunc("/setrole/", setroleHandler(db))
 	http.HandleFunc("/createcat/", createcatHandler(db))
 	http.HandleFunc("/editcat/", editcatHandler(db))
 	http.HandleFunc("/delcat/", delcatHandler(db))
+	http.HandleFunc("/admintags/", admintagsHandler(db))
+	http.HandleFunc("/admin/audit/", auditHandler(db))
+	http.HandleFunc("/admin/trash/", trashHandler(db))
 	http.HandleFunc("/", indexHandler(db))
 	http.HandleFunc("/item/", itemHandler(db))
+	http.HandleFunc("/search/", requireFeature(FEATURE_SEARCH, searchHandler(db)))
+	http.HandleFunc("/tags/", tagsHandler(db))
+	http.HandleFunc("/rss", requireFeature(FEATURE_FEEDS, rssHandler(db)))
+	http.HandleFunc("/atom", requireFeature(FEATURE_FEEDS, atomHandler(db)))
 	http.HandleFunc("/submit/", submitHandler(db))
 	http.HandleFunc("/edit/", editHandler(db))
+	http.HandleFunc("/history/", historyHandler(db))
 	http.HandleFunc("/del/", delHandler(db))
 	http.HandleFunc("/vote/", voteHandler(db))
 	http.HandleFunc("/unvote/", unvoteHandler(db))
+	http.HandleFunc("/flag/", flagHandler(db))
+	http.HandleFunc("/user/", userHandler(db))
+	http.HandleFunc("/inbox/", inboxHandler(db))
+	http.HandleFunc("/apitoken/", requireFeature(FEATURE_API, apitokenHandler(db)))
+	http.HandleFunc("/revoketoken/", requireFeature(FEATURE_API, revoketokenHandler(db)))
+	http.HandleFunc("/api/v1/", requireFeature(FEATURE_API, apiHandler(db)))
 
-	port := "8000"
-	if len(parms) > 1 {
-		port = parms[1]
+	siteBaseUrl = cfg.siteBaseUrl()
+
+	l, err := listen(cfg.Listen)
+	if err != nil {
+		fmt.Printf("Error listening on %s (%s)\n", cfg.Listen, err)
+		os.Exit(1)
+	}
+
+	var jobs Jobs
+	jobs.run(func(stop <-chan struct{}) { runDigests(db, stop) })
+	jobs.run(func(stop <-chan struct{}) { runRateLimitPrune(db, stop) })
+	jobs.run(func(stop <-chan struct{}) { runTrashPurge(db, stop) })
+
+	srv := newServer(logRequests(http.DefaultServeMux))
+	fmt.Printf("Listening on %s...\n", cfg.Listen)
+	err = serve(srv, l)
+	jobs.stopWait()
+	db.Close()
+	if err != nil {
+		log.Fatal(err)
 	}
-	fmt.Printf("Listening on %s...\n", port)
-	err = http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
-	log.Fatal(err)
+	fmt.Printf("Stopped.\n")
 }
 
+var registerSqliteFuncsOnce sync.Once
+
 func registerSqliteFuncs() {
+	registerSqliteFuncsOnce.Do(registerSqliteDriver)
+}
+
+func registerSqliteDriver() {
 	rand.Seed(time.Now().UnixNano())
 
 	sql.Register("sqlite3_custom", &sqlite.SQLiteDriver{
@@ -182,6 +343,18 @@ func registerSqliteFuncs() {
 			if err != nil {
 				return err
 			}
+			err = con.RegisterFunc("wilson_score", wilson_score, true)
+			if err != nil {
+				return err
+			}
+			err = con.RegisterFunc("normalize_url", normalizeUrl, true)
+			if err != nil {
+				return err
+			}
+			err = con.RegisterFunc("normalize_tag", normalizeTag, true)
+			if err != nil {
+				return err
+			}
 			return nil
 		},
 	})
@@ -202,16 +375,30 @@ func seconds_since_time(dt string) int64 {
 func hours_since_time(dt string) int64 {
 	return seconds_since_time(dt) / 60 / 60
 }
+
+// votes is the net score, up votes minus down votes.
 func calculate_points(votes int, submitdt string, gravityf float64) float64 {
 	return float64(votes) / pow((int(hours_since_time(submitdt))+2), gravityf)
 }
 
+// Lower bound of Wilson score confidence interval (95%) for the
+// fraction of up votes. Used to sort comments by 'best'.
+func wilson_score(ups int, downs int) float64 {
+	n := float64(ups + downs)
+	if n == 0 {
+		return 0
+	}
+	z := 1.96
+	phat := float64(ups) / n
+	return (phat + z*z/(2*n) - z*math.Sqrt((phat*(1-phat)+z*z/(4*n))/n)) / (1 + z*z/n)
+}
+
 func parseArgs(args []string) (map[string]string, []string) {
 	switches := map[string]string{}
 	parms := []string{}
 
 	standaloneSwitches := []string{}
-	definitionSwitches := []string{"i"}
+	definitionSwitches := []string{"i", "migrate", "config", "listen", "static", "templates", "baseurl", "pagesize", "secretfile", "loglevel", "mailer", "features"}
 	fNoMoreSwitches := false
 	curKey := ""
 
@@ -278,6 +465,24 @@ func idtoi(sid string) int64 {
 	return int64(n)
 }
 
+// Most entries shown on a page, unless the default page size is larger.
+const MAX_PAGE_LIMIT = 100
+
+// Page size from the limit parameter, deflimit if not given.
+func parseLimit(s string, deflimit int) int {
+	n := atoi(s)
+	if n <= 0 {
+		return deflimit
+	}
+	if n > MAX_PAGE_LIMIT && n > deflimit {
+		if deflimit > MAX_PAGE_LIMIT {
+			return deflimit
+		}
+		return MAX_PAGE_LIMIT
+	}
+	return n
+}
+
 func atoi(s string) int {
 	if s == "" {
 		return -1
@@ -329,7 +534,6 @@ func txexec(tx *sql.Tx, s string, pp ...interface{}) (sql.Result, error) {
 }
 
 func parseMarkdown(s string) string {
-	s = strings.ReplaceAll(s, "%", "%%")
 	return string(github_flavored_markdown.Markdown([]byte(s)))
 }
 
@@ -347,68 +551,112 @@ func parseIsoDate(dt string) string {
 
 func createAndInitTables(newfile string) {
 	if fileExists(newfile) {
-		s := fmt.Sprintf("File '%s' already exists. Can't initialize it.\n", newfile)
-		fmt.Printf(s)
+		fmt.Printf("File '%s' already exists. Can't initialize it.\n", newfile)
 		os.Exit(1)
 	}
 
-	db, err := sql.Open("sqlite3", newfile)
+	db, err := sql.Open("sqlite3_custom", newfile)
 	if err != nil {
 		fmt.Printf("Error opening '%s' (%s)\n", newfile, err)
 		os.Exit(1)
 	}
+	defer db.Close()
+
+	_, err = migrateDb(db, false)
+	if err != nil {
+		log.Printf("DB error setting up newsboard db on '%s' (%s)\n", newfile, err)
+		os.Exit(1)
+	}
+}
 
-	ss := []string{
-		"BEGIN TRANSACTION;",
-		`CREATE TABLE entry (entry_id INTEGER PRIMARY KEY NOT NULL, thing INTEGER NOT NULL DEFAULT 0, title TEXT NOT NULL DEFAULT '', url TEXT NOT NULL DEFAULT '', body TEXT NOT NULL DEFAULT '', createdt TEXT NOT NULL, user_id INTEGER NOT NULL, parent_id INTEGER DEFAULT 0);`,
-		`CREATE TABLE user (user_id INTEGER PRIMARY KEY NOT NULL, username TEXT, password TEXT, active INTEGER NOT NULL, email TEXT, CONSTRAINT unique_username UNIQUE (username));`,
-		`INSERT INTO user (user_id, username, password, active, email) VALUES (1, 'admin', '', 1, 'admin@localhost');`,
-		`CREATE TABLE entryvote(entry_id INTEGER NOT NULL, user_id INTEGER, PRIMARY KEY (entry_id, user_id));`,
-		`CREATE TABLE entrytag(entry_id INTEGER NOT NULL, tag TEXT NOT NULL)`,
-		`CREATE TABLE cat(cat_id INTEGER PRIMARY KEY NOT NULL, name TEXT NOT NULL)`,
-		`CREATE TABLE entrycat(entry_id INTEGER NOT NULL, cat_id INTEGER NOT NULL)`,
-		`INSERT INTO cat (cat_id, name) VALUES (1, 'Main');`,
-		`CREATE TABLE site (site_id INTEGER PRIMARY KEY NOT NULL, title TEXT NOT NULL, desc TEXT NOT NULL, gravityf REAL NOT NULL);`,
-		`INSERT INTO site (site_id, title, desc, gravityf) VALUES (1, 'newsboard', '', 1.0);`,
-		`CREATE VIEW totalvotes 
-AS 
-SELECT entry_id, COUNT(*) AS votes FROM entryvote GROUP BY entry_id;`,
-		`INSERT INTO entry (entry_id, thing, title, url, body, createdt, user_id, parent_id) VALUES (1, 0, 'newsboard - a hackernews clone', 'https://github.com/robdelacruz/newsboard', '', strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), 1, 0);`,
-		`INSERT INTO entrycat (entry_id, cat_id) VALUES (1, 1);`,
-		"COMMIT;",
+func migrateFile(dbfile string, dryrun bool) {
+	if !fileExists(dbfile) {
+		fmt.Printf("Newboard file '%s' doesn't exist.\n", dbfile)
+		os.Exit(1)
 	}
 
-	for _, s := range ss {
-		_, err := sqlexec(db, s)
-		if err != nil {
-			log.Printf("DB error setting up newsboard db on '%s' (%s)\n", newfile, err)
-			os.Exit(1)
+	db, err := sql.Open("sqlite3_custom", dbfile)
+	if err != nil {
+		fmt.Printf("Error opening '%s' (%s)\n", dbfile, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	ver, err := querySchemaVersion(db)
+	if err != nil {
+		fmt.Printf("Error reading '%s' schema version (%s)\n", dbfile, err)
+		os.Exit(1)
+	}
+	fmt.Printf("'%s' schema version: %d, latest: %d\n", dbfile, ver, latestSchemaVersion())
+
+	applied, err := migrateDb(db, dryrun)
+	if err != nil {
+		fmt.Printf("Error updating '%s' schema (%s)\n", dbfile, err)
+		os.Exit(1)
+	}
+	if len(applied) == 0 {
+		fmt.Printf("Nothing to do.\n")
+		return
+	}
+	for _, m := range applied {
+		if dryrun {
+			fmt.Printf("Would apply migration %d: %s\n", m.Version, m.Desc)
+			for _, stmt := range m.Stmts {
+				fmt.Printf("    %s\n", stmt)
+			}
+			continue
 		}
+		fmt.Printf("Applied migration %d: %s\n", m.Version, m.Desc)
+	}
+	if dryrun {
+		fmt.Printf("Dry run, no changes were made.\n")
 	}
 }
 
+// Login user from the session cookie, or from an api token in the
+// 'Authorization: Bearer <token>' header. Api token logins can view pages
+// with the read scope, but can't post forms, use account pages or moderate:
+// checkCsrf(), validateSessionLogin(), isAdmin() and isModerator() refuse
+// them. Scripts post through the api instead, where scopes are checked.
 func getLoginUser(r *http.Request, db *sql.DB) *User {
 	var u User
 	u.Userid = -1
 
-	c, err := r.Cookie("userid")
+	if tok := bearerToken(r); tok != "" {
+		pu := queryApiTokenUser(db, tok)
+		if pu == nil || !hasScope(pu, SCOPE_READ) {
+			return &u
+		}
+		return pu
+	}
+
+	c, err := r.Cookie(SESSION_COOKIE)
 	if err != nil {
 		return &u
 	}
-	userid := idtoi(c.Value)
-	if userid == -1 {
+	sess := querySession(db, c.Value)
+	if sess == nil {
 		return &u
 	}
-	return queryUser(db, userid)
+	touchSession(db, sess)
+	pu := queryUser(db, sess.Userid)
+	if pu.Userid != -1 {
+		pu.Sessionid = sess.Sessionid
+		pu.Modcats, err = queryModCats(db, pu.Userid)
+		if err != nil {
+			log.Printf("DB error querying moderated categories (%s)\n", err)
+		}
+	}
+	return pu
 }
 
 func queryUser(db *sql.DB, userid int64) *User {
 	var u User
 	u.Userid = -1
 
-	s := "SELECT user_id, username, active, email FROM user WHERE user_id = ?"
+	s := "SELECT u.user_id, u.username, u.active, u.email, u.role, u.createdt, u.about, IFNULL(uk.karma, 0), u.emailverified, u.digest, u.lastdigestdt FROM user u LEFT OUTER JOIN userkarma uk ON u.user_id = uk.user_id WHERE u.user_id = ?"
 	row := db.QueryRow(s, userid)
-	err := row.Scan(&u.Userid, &u.Username, &u.Active, &u.Email)
+	err := row.Scan(&u.Userid, &u.Username, &u.Active, &u.Email, &u.Role, &u.Createdt, &u.About, &u.Karma, &u.Emailverified, &u.Digest, &u.Lastdigestdt)
 	if err == sql.ErrNoRows {
 		return &u
 	}
@@ -423,9 +671,9 @@ func queryUsername(db *sql.DB, username string) *User {
 	var u User
 	u.Userid = -1
 
-	s := "SELECT user_id, username, active, email FROM user WHERE username = ?"
+	s := "SELECT u.user_id, u.username, u.active, u.email, u.role, u.createdt, u.about, IFNULL(uk.karma, 0), u.emailverified, u.digest, u.lastdigestdt FROM user u LEFT OUTER JOIN userkarma uk ON u.user_id = uk.user_id WHERE u.username = ?"
 	row := db.QueryRow(s, username)
-	err := row.Scan(&u.Userid, &u.Username, &u.Active, &u.Email)
+	err := row.Scan(&u.Userid, &u.Username, &u.Active, &u.Email, &u.Role, &u.Createdt, &u.About, &u.Karma, &u.Emailverified, &u.Digest, &u.Lastdigestdt)
 	if err == sql.ErrNoRows {
 		return &u
 	}
@@ -438,19 +686,30 @@ func queryUsername(db *sql.DB, username string) *User {
 
 func querySite(db *sql.DB) *Site {
 	var site Site
-	s := "SELECT title, desc, gravityf FROM site WHERE site_id = 1"
+	s := "SELECT title, desc, gravityf, downvotekarma, flagthreshold, flagaction, dupedays, trashdays, submitlimit, commentlimit, signuplimit, probationhours, probationsubmitlimit, probationcommentlimit, persistlimits FROM site WHERE site_id = 1"
 	row := db.QueryRow(s)
-	err := row.Scan(&site.Title, &site.Desc, &site.Gravityf)
+	err := row.Scan(&site.Title, &site.Desc, &site.Gravityf, &site.Downvotekarma, &site.Flagthreshold, &site.Flagaction, &site.Dupedays, &site.Trashdays,
+		&site.Submitlimit, &site.Commentlimit, &site.Signuplimit, &site.Probationhours, &site.Probationsubmitlimit, &site.Probationcommentlimit, &site.Persistlimits)
 	if err == sql.ErrNoRows {
 		// Site settings row not defined yet, just use default Site values.
 		site.Title = "newsboard"
 		site.Desc = ""
 		site.Gravityf = 1.5
+		site.Downvotekarma = 20
+		site.Flagthreshold = 3
+		site.Dupedays = 30
+		site.Trashdays = 30
+		setDefaultRateLimits(&site)
 	} else if err != nil {
 		// DB error, log then use common site settings.
 		log.Printf("error reading site settings for siteid %d (%s)\n", 1, err)
 		site.Title = "newsboard"
 		site.Gravityf = 1.5
+		site.Downvotekarma = 20
+		site.Flagthreshold = 3
+		site.Dupedays = 30
+		site.Trashdays = 30
+		setDefaultRateLimits(&site)
 	}
 	if site.Title == "" {
 		site.Title = "newsboard"
@@ -460,9 +719,9 @@ func querySite(db *sql.DB) *Site {
 
 func queryCat(db *sql.DB, catid int64) *Cat {
 	var cat Cat
-	s := "SELECT cat_id, name FROM cat WHERE cat_id = ?"
+	s := "SELECT cat_id, name, desc, gravityf, postpolicy FROM cat WHERE cat_id = ?"
 	row := db.QueryRow(s, catid)
-	err := row.Scan(&cat.Catid, &cat.Name)
+	err := row.Scan(&cat.Catid, &cat.Name, &cat.Desc, &cat.Gravityf, &cat.Postpolicy)
 	if err == sql.ErrNoRows {
 		return nil
 	}
@@ -473,70 +732,24 @@ func queryCat(db *sql.DB, catid int64) *Cat {
 	return &cat
 }
 
-func printPageHead(w io.Writer, jsurls []string, cssurls []string, site *Site) {
-	fmt.Fprintf(w, "<!DOCTYPE html>\n")
-	fmt.Fprintf(w, "<html>\n")
-	fmt.Fprintf(w, "<head>\n")
-	fmt.Fprintf(w, "<meta charset=\"utf-8\">\n")
-	fmt.Fprintf(w, "<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n")
-	fmt.Fprintf(w, "<title>%s</title>\n", escape(site.Title))
-	fmt.Fprintf(w, "<link rel=\"stylesheet\" type=\"text/css\" href=\"/static/style.css\">\n")
-	fmt.Fprintf(w, "<link rel=\"stylesheet\" type=\"text/css\" href=\"/static/nbstyle.css\">\n")
-	for _, cssurl := range cssurls {
-		fmt.Fprintf(w, "<link rel=\"stylesheet\" type=\"text/css\" href=\"%s\">\n", cssurl)
-	}
-	for _, jsurl := range jsurls {
-		fmt.Fprintf(w, "<script src=\"%s\" defer></script>\n", jsurl)
-	}
-	fmt.Fprintf(w, "</head>\n")
-	fmt.Fprintf(w, "<body>\n")
-	fmt.Fprintf(w, "<section class=\"body\">\n")
-}
-
-func printPageFoot(w io.Writer) {
-	fmt.Fprintf(w, "</section>\n")
-	fmt.Fprintf(w, "</body>\n")
-	fmt.Fprintf(w, "</html>\n")
-}
-
-func printPageNav(w http.ResponseWriter, db *sql.DB, login *User, site *Site, qq *QIndex) {
-	fmt.Fprintf(w, "<header class=\"masthead mb-sm\">\n")
-
-	// First row nav
-	fmt.Fprintf(w, "<nav class=\"navbar\">\n")
-	// Menu section (left part)
-	fmt.Fprintf(w, "<div>\n")
-	fmt.Fprintf(w, "<h1 class=\"heading\"><a href=\"/\">%s</a></h1>\n", escape(site.Title))
-	fmt.Fprintf(w, "<ul class=\"line-menu\">\n")
-	if qq != nil {
-		if qq.Latest != "" {
-			fmt.Fprintf(w, "  <li><a href=\"/?username=%s&cat=%d&tag=%s&latest=1\">[latest]</a></li>\n", url.QueryEscape(qq.Username), qq.Cat, url.QueryEscape(qq.Tag))
-		} else {
-			fmt.Fprintf(w, "  <li><a href=\"/?username=%s&cat=%d&tag=%s&latest=1\">latest</a></li>\n", url.QueryEscape(qq.Username), qq.Cat, url.QueryEscape(qq.Tag))
-		}
-	} else {
-		fmt.Fprintf(w, "  <li><a href=\"/?latest=1\">latest</a></li>\n")
-	}
-	if login.Userid != -1 && login.Active {
-		fmt.Fprintf(w, "  <li><a href=\"/submit/\">submit</a></li>\n")
+func queryCats(db *sql.DB) ([]Cat, error) {
+	s := "SELECT cat_id, name, desc, gravityf, postpolicy FROM cat ORDER BY cat_id"
+	rows, err := db.Query(s)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Fprintf(w, "</ul>\n")
-	fmt.Fprintf(w, "</div>\n")
+	defer rows.Close()
 
-	// User section (right part)
-	fmt.Fprintf(w, "<ul class=\"line-menu right\">\n")
-	if login.Userid == -1 {
-		fmt.Fprintf(w, "<li><a href=\"/login\">login</a></li>\n")
-	} else if login.Userid == ADMIN_ID {
-		fmt.Fprintf(w, "<li><a href=\"/adminsetup/\">%s</a></li>\n", escape(login.Username))
-		fmt.Fprintf(w, "<li><a href=\"/logout\">logout</a></li>\n")
-	} else {
-		fmt.Fprintf(w, "<li><a href=\"/usersetup/\">%s</a></li>\n", escape(login.Username))
-		fmt.Fprintf(w, "<li><a href=\"/logout\">logout</a></li>\n")
+	var cats []Cat
+	for rows.Next() {
+		var cat Cat
+		err := rows.Scan(&cat.Catid, &cat.Name, &cat.Desc, &cat.Gravityf, &cat.Postpolicy)
+		if err != nil {
+			return nil, err
+		}
+		cats = append(cats, cat)
 	}
-	fmt.Fprintf(w, "</ul>\n")
-	fmt.Fprintf(w, "</nav>\n")
-	fmt.Fprintf(w, "</header>\n")
+	return cats, rows.Err()
 }
 
 func isCorrectPassword(inputPassword, hashedpwd string) bool {
@@ -558,16 +771,13 @@ func hashPassword(pwd string) string {
 	return string(hashedpwd)
 }
 
-func loginUser(w http.ResponseWriter, userid int64) {
-	suserid := fmt.Sprintf("%d", userid)
-	c := http.Cookie{
-		Name:     "userid",
-		Value:    suserid,
-		Path:     "/",
-		HttpOnly: true,
-		Expires:  time.Now().Add(daysDuration(400)),
+func loginUser(w http.ResponseWriter, db *sql.DB, userid int64) error {
+	tok, err := createSession(db, userid)
+	if err != nil {
+		return err
 	}
-	http.SetCookie(w, &c)
+	setSessionCookie(w, tok)
+	return nil
 }
 
 func daysDuration(ndays int) time.Duration {
@@ -631,58 +841,39 @@ func loginHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 					break
 				}
 
-				loginUser(w, userid)
+				err = loginUser(w, db, userid)
+				if err != nil {
+					log.Printf("DB error creating session: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
 
 				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
 				return
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-
-		fmt.Fprintf(w, "<section class=\"main\">\n")
-		fmt.Fprintf(w, "<form class=\"simpleform\" action=\"/login/?from=%s\" method=\"post\">\n", url.QueryEscape(qfrom))
-		fmt.Fprintf(w, "<h1 class=\"heading\">Login</h1>")
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"username\">username</label>\n")
-		fmt.Fprintf(w, "<input id=\"username\" name=\"username\" type=\"text\" size=\"20\" value=\"%s\">\n", f.username)
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"password\">password</label>\n")
-		fmt.Fprintf(w, "<input id=\"password\" name=\"password\" type=\"password\" size=\"20\" value=\"%s\">\n", f.password)
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<button class=\"submit\">login</button>\n")
-		fmt.Fprintf(w, "</div>\n")
-		fmt.Fprintf(w, "</form>\n")
-
-		fmt.Fprintf(w, "<p class=\"mt-xl\"><a href=\"/createaccount/?from=%s\">Create New Account</a></p>\n", url.QueryEscape(qfrom))
-		fmt.Fprintf(w, "</section>\n")
-
-		printPageFoot(w)
+		data := struct {
+			Page
+			From     string
+			Username string
+			Password string
+		}{newPage(r, db, login, querySite(db)), qfrom, f.username, f.password}
+		data.Errmsg = errmsg
+		renderPage(w, "login.html", data)
 	}
 }
 
 func logoutHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c := http.Cookie{
-			Name:     "userid",
-			Value:    "",
-			Path:     "/",
-			HttpOnly: true,
-			MaxAge:   0,
+		c, err := r.Cookie(SESSION_COOKIE)
+		if err == nil {
+			err = delSession(db, c.Value)
+			if err != nil {
+				log.Printf("DB error deleting session: %s\n", err)
+			}
 		}
-		http.SetCookie(w, &c)
+		clearSessionCookie(w)
 
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
@@ -726,10 +917,14 @@ func createaccountHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 					errmsg = fmt.Sprintf("username '%s' already exists", f.username)
 					break
 				}
+				errmsg = checkRateLimit(db, querySite(db), r, login, RATE_SIGNUP)
+				if errmsg != "" {
+					break
+				}
 
 				hashedPassword := hashPassword(f.password)
-				s := "INSERT INTO user (username, password, active, email) VALUES (?, ?, ?, ?);"
-				result, err := sqlexec(db, s, f.username, hashedPassword, 1, f.email)
+				s := "INSERT INTO user (username, password, active, email, createdt) VALUES (?, ?, ?, ?, ?);"
+				result, err := sqlexec(db, s, f.username, hashedPassword, 1, f.email, time.Now().Format(time.RFC3339))
 				if err != nil {
 					log.Printf("DB error creating user: %s\n", err)
 					errmsg = "A problem occured. Please try again."
@@ -737,9 +932,14 @@ func createaccountHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 				}
 				newid, err := result.LastInsertId()
 				if err == nil {
-					loginUser(w, newid)
-				} else {
-					// DB doesn't support getting newly added userid, so login manually.
+					err = sendVerifyEmail(db, querySite(db), queryUser(db, newid))
+					if err != nil {
+						log.Printf("DB error creating verify email token: %s\n", err)
+					}
+					err = loginUser(w, db, newid)
+				}
+				if err != nil {
+					// Couldn't get newly added userid or start a session, so login manually.
 					qfrom = "/login/"
 				}
 
@@ -748,46 +948,16 @@ func createaccountHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-
-		fmt.Fprintf(w, "<section class=\"main\">\n")
-		fmt.Fprintf(w, "<form class=\"simpleform\" action=\"/createaccount/?from=%s\" method=\"post\">\n", url.QueryEscape(qfrom))
-		fmt.Fprintf(w, "<h1 class=\"heading\">Create Account</h1>")
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"username\">username</label>\n")
-		fmt.Fprintf(w, "<input id=\"username\" name=\"username\" type=\"text\" size=\"20\" maxlength=\"20\" value=\"%s\">\n", f.username)
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"email\">email</label>\n")
-		fmt.Fprintf(w, "<input id=\"email\" name=\"email\" type=\"email\" size=\"20\" value=\"%s\">\n", f.email)
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"password\">password</label>\n")
-		fmt.Fprintf(w, "<input id=\"password\" name=\"password\" type=\"password\" size=\"20\" value=\"%s\">\n", f.password)
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"password2\">re-enter password</label>\n")
-		fmt.Fprintf(w, "<input id=\"password2\" name=\"password2\" type=\"password\" size=\"20\" value=\"%s\">\n", f.password2)
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<button class=\"submit\">create account</button>\n")
-		fmt.Fprintf(w, "</div>\n")
-		fmt.Fprintf(w, "</form>\n")
-		fmt.Fprintf(w, "</section>\n")
-
-		printPageFoot(w)
+		data := struct {
+			Page
+			From      string
+			Username  string
+			Email     string
+			Password  string
+			Password2 string
+		}{newPage(r, db, login, querySite(db)), qfrom, f.username, f.email, f.password, f.password2}
+		data.Errmsg = errmsg
+		renderPage(w, "createaccount.html", data)
 	}
 }
 
@@ -795,12 +965,18 @@ func adminsetupHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errmsg string
 		var f struct {
-			title    string
-			gravityf float64
+			title         string
+			gravityf      float64
+			downvotekarma int
+			flagthreshold int
+			flagaction    int
+			dupedays      int
+			trashdays     int
+			limits        Site // rate limit settings
 		}
 
 		login := getLoginUser(r, db)
-		if login.Userid != ADMIN_ID {
+		if !isAdmin(login) {
 			http.Error(w, "admin user required", 401)
 			return
 		}
@@ -811,13 +987,35 @@ func adminsetupHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		if f.gravityf < 0 {
 			f.gravityf = 0.0
 		}
+		f.downvotekarma = site.Downvotekarma
+		f.flagthreshold = site.Flagthreshold
+		f.flagaction = site.Flagaction
+		f.dupedays = site.Dupedays
+		f.trashdays = site.Trashdays
+		f.limits = *site
 
 		qfrom := r.FormValue("from")
 
 		if r.Method == "POST" {
 			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
 				f.title = strings.TrimSpace(r.FormValue("title"))
 				f.gravityf = atof(r.FormValue("gravityf"))
+				f.downvotekarma = atoi(r.FormValue("downvotekarma"))
+				f.flagthreshold = atoi(r.FormValue("flagthreshold"))
+				f.flagaction = atoi(r.FormValue("flagaction"))
+				f.dupedays = atoi(r.FormValue("dupedays"))
+				f.trashdays = atoi(r.FormValue("trashdays"))
+				f.limits.Submitlimit = atoi(r.FormValue("submitlimit"))
+				f.limits.Commentlimit = atoi(r.FormValue("commentlimit"))
+				f.limits.Signuplimit = atoi(r.FormValue("signuplimit"))
+				f.limits.Probationhours = atoi(r.FormValue("probationhours"))
+				f.limits.Probationsubmitlimit = atoi(r.FormValue("probationsubmitlimit"))
+				f.limits.Probationcommentlimit = atoi(r.FormValue("probationcommentlimit"))
+				f.limits.Persistlimits = r.FormValue("persistlimits") != ""
 				if f.title == "" {
 					errmsg = "Enter a site title"
 					break
@@ -826,173 +1024,199 @@ func adminsetupHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 					errmsg = "Enter a gravity factor (0.0 and above)"
 					break
 				}
+				if f.downvotekarma < 0 {
+					errmsg = "Enter the karma needed to down vote (0 and above)"
+					break
+				}
+				if f.flagthreshold < 0 {
+					errmsg = "Enter a flag threshold (0 and above)"
+					break
+				}
+				if f.flagaction != FLAG_MARK && f.flagaction != FLAG_HIDE {
+					f.flagaction = FLAG_MARK
+				}
+				if f.dupedays < 0 {
+					errmsg = "Enter the duplicate url window in days (0 and above)"
+					break
+				}
+				if f.trashdays < 0 {
+					errmsg = "Enter the days to keep deleted entries (0 and above)"
+					break
+				}
+				if f.limits.Submitlimit < 0 || f.limits.Commentlimit < 0 || f.limits.Signuplimit < 0 ||
+					f.limits.Probationsubmitlimit < 0 || f.limits.Probationcommentlimit < 0 {
+					errmsg = "Enter rate limits per hour (0 for no limit)"
+					break
+				}
+				if f.limits.Probationhours < 0 {
+					errmsg = "Enter the probation period in hours (0 for none)"
+					break
+				}
 
-				s := "INSERT OR REPLACE INTO site (site_id, title, desc, gravityf) VALUES (1, ?, ?, ?)"
-				_, err := sqlexec(db, s, f.title, "", f.gravityf)
+				// Update in place so that other site columns such as the secret are kept.
+				s := `UPDATE site SET title = ?, desc = ?, gravityf = ?, downvotekarma = ?, flagthreshold = ?, flagaction = ?, dupedays = ?, trashdays = ?,
+submitlimit = ?, commentlimit = ?, signuplimit = ?, probationhours = ?, probationsubmitlimit = ?, probationcommentlimit = ?, persistlimits = ?
+WHERE site_id = 1`
+				_, err := sqlexec(db, s, f.title, "", f.gravityf, f.downvotekarma, f.flagthreshold, f.flagaction, f.dupedays, f.trashdays,
+					f.limits.Submitlimit, f.limits.Commentlimit, f.limits.Signuplimit, f.limits.Probationhours, f.limits.Probationsubmitlimit, f.limits.Probationcommentlimit, f.limits.Persistlimits)
 				if err != nil {
 					fmt.Printf("adminsetup site update DB error (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
+				logAudit(db, login, AUDIT_SITE_SETTINGS, AUDIT_SITE, 1, site.Title, siteAuditFields(site), siteAuditFields(querySite(db)), parseReason(r))
 
 				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
 				return
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-
-		fmt.Fprintf(w, "<section class=\"main\">\n")
-
-		fmt.Fprintf(w, "<form class=\"simpleform mb-xl\" action=\"/adminsetup/?from=%s\" method=\"post\">\n", url.QueryEscape(qfrom))
-		fmt.Fprintf(w, "<h1 class=\"heading\">Site Settings</h1>")
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
+		ff, err := queryFlaggedEntries(db, FLAGS_LIMIT)
+		if err != nil {
+			log.Printf("DB error querying flagged entries: %s\n", err)
 		}
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"title\">site title</label>\n")
-		fmt.Fprintf(w, "<input id=\"title\" name=\"title\" type=\"text\" size=\"30\" maxlength=\"50\" value=\"%s\">\n", escape(f.title))
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"gravityf\">gravity factor</label>\n")
-		if f.gravityf >= 0 {
-			fmt.Fprintf(w, "<input id=\"gravityf\" name=\"gravityf\" type=\"number\" step=\"0.001\" min=\"0\" size=\"5\" value=\"%.2f\">\n", f.gravityf)
-		} else {
-			fmt.Fprintf(w, "<input id=\"gravityf\" name=\"gravityf\" type=\"number\" step=\"0.001\" min=\"0\" size=\"5\" value=\"\">\n")
+		for i := range ff {
+			ff[i].Overthreshold = isFlagged(site, ff[i].Nflags)
 		}
-		fmt.Fprintf(w, "<p class=\"text-sm text-fade-2 text-italic mt-xs\">\n")
-		fmt.Fprintf(w, "points = num_votes / (hours_since_submission + 2) ^ gravity_factor.<br>The gravity_factor determines how quickly points decrease as time passes.\n")
-		fmt.Fprintf(w, "</p>\n")
-		fmt.Fprintf(w, "</div>\n")
 
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<button class=\"submit\">submit</button>\n")
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "</form>\n")
-
-		// Categories
-		fmt.Fprintf(w, "<h1 class=\"heading mb-sm\">Categories</h1>\n")
-		fmt.Fprintf(w, "<ul class=\"vertical-list mb-xl\">\n")
-		fmt.Fprintf(w, "  <li><a class=\"text-fade-2 text-xs\" href=\"/createcat/?from=%s\">create new category</a></li>\n", url.QueryEscape("/adminsetup/"))
-		var cat Cat
-		s := "SELECT cat_id, name FROM cat ORDER BY cat_id"
-		rows, _ := db.Query(s)
-		for rows.Next() {
-			rows.Scan(&cat.Catid, &cat.Name)
-			fmt.Fprintf(w, "<li>\n")
-			fmt.Fprintf(w, "  <div>%s</div>\n", escape(cat.Name))
-			fmt.Fprintf(w, "  <ul class=\"line-menu text-fade-2 text-xs\">\n")
-			fmt.Fprintf(w, "    <li><a href=\"/editcat?catid=%d&from=%s\">edit</a></li>\n", cat.Catid, url.QueryEscape("/adminsetup/"))
-			if cat.Catid != 1 {
-				fmt.Fprintf(w, "    <li><a href=\"/delcat?catid=%d&from=%s\">delete</a></li>\n", cat.Catid, url.QueryEscape("/adminsetup/"))
-			}
-			fmt.Fprintf(w, "  </ul>\n")
-			fmt.Fprintf(w, "</li>\n")
+		cats, err := queryCats(db)
+		if handleDbErr(w, err, "adminsetuphandler") {
+			return
 		}
-		fmt.Fprintf(w, "</ul>\n")
 
 		// Users
-		fmt.Fprintf(w, "<h1 class=\"heading mb-sm\">Users</h1>\n")
-		s = "SELECT user_id, username, active, email FROM user ORDER BY username"
+		type UserRow struct {
+			User
+			Canchange bool // admin can change active and role
+		}
+		var uu []UserRow
+		s := "SELECT user_id, username, active, email, role FROM user ORDER BY username"
 		rows, err := db.Query(s)
 		if handleDbErr(w, err, "adminsetuphandler") {
 			return
 		}
-
-		var u User
-		fmt.Fprintf(w, "<ul class=\"vertical-list mb-xl\">\n")
 		for rows.Next() {
-			rows.Scan(&u.Userid, &u.Username, &u.Active, &u.Email)
-			fmt.Fprintf(w, "<li>\n")
-			if u.Active {
-				fmt.Fprintf(w, "<div>%s</div>\n", escape(u.Username))
-			} else {
-				fmt.Fprintf(w, "<div class=\"text-fade-2\">(%s)</div>\n", escape(u.Username))
-			}
-
-			fmt.Fprintf(w, "<ul class=\"line-menu text-fade-2 text-xs\">\n")
-			fmt.Fprintf(w, "  <li><a href=\"/edituser?userid=%d&from=%s\">edit</a>\n", u.Userid, url.QueryEscape("/adminsetup/"))
-			if u.Userid != ADMIN_ID {
-				if u.Active {
-					fmt.Fprintf(w, "  <li><a href=\"/activateuser?userid=%d&setactive=0&from=%s\">deactivate</a>\n", u.Userid, url.QueryEscape("/adminsetup/"))
-				} else {
-					fmt.Fprintf(w, "  <li><a href=\"/activateuser?userid=%d&setactive=1&from=%s\">activate</a>\n", u.Userid, url.QueryEscape("/adminsetup/"))
-				}
-			}
-			fmt.Fprintf(w, "</ul>\n")
-
-			fmt.Fprintf(w, "</li>\n")
-		}
-		fmt.Fprintf(w, "</ul>\n")
-
-		fmt.Fprintf(w, "</section>\n")
-		printPageFoot(w)
+			var u UserRow
+			rows.Scan(&u.Userid, &u.Username, &u.Active, &u.Email, &u.Role)
+			u.Canchange = u.Userid != ADMIN_ID && u.Userid != login.Userid
+			uu = append(uu, u)
+		}
+		rows.Close()
+
+		data := struct {
+			Page
+			From          string
+			Title         string
+			Gravityf      float64
+			Downvotekarma int
+			Flagthreshold int
+			Flagaction    int
+			Flagactions   []int
+			Dupedays      int
+			Trashdays     int
+			Limits        Site
+			Flagged       []FlaggedEntry
+			Cats          []Cat
+			Users         []UserRow
+			Roles         []int
+		}{
+			Page:          newPage(r, db, login, site),
+			From:          qfrom,
+			Title:         f.title,
+			Gravityf:      f.gravityf,
+			Downvotekarma: f.downvotekarma,
+			Flagthreshold: f.flagthreshold,
+			Flagaction:    f.flagaction,
+			Flagactions:   []int{FLAG_MARK, FLAG_HIDE},
+			Dupedays:      f.dupedays,
+			Trashdays:     f.trashdays,
+			Limits:        f.limits,
+			Flagged:       ff,
+			Cats:          cats,
+			Users:         uu,
+			Roles:         []int{ROLE_USER, ROLE_MODERATOR, ROLE_ADMIN},
+		}
+		data.Errmsg = errmsg
+		renderPage(w, "adminsetup.html", data)
 	}
 }
 
 func usersetupHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		login := getLoginUser(r, db)
-		if !validateLogin(w, login) {
+		if !validateSessionLogin(w, login) {
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-		fmt.Fprintf(w, "<section class=\"main\">\n")
-
-		fmt.Fprintf(w, "<p class=\"\"><a href=\"/edituser?userid=%d&from=%s\">Edit Account</a></p>\n", login.Userid, url.QueryEscape("/usersetup/"))
-		fmt.Fprintf(w, "<p class=\"mt-base\"><a href=\"/edituser?userid=%d&setpwd=1&from=%s\">Set Password</a></p>\n", login.Userid, url.QueryEscape("/usersetup/"))
+		tt, err := queryUserApiTokens(db, login.Userid)
+		if handleDbErr(w, err, "usersetuphandler") {
+			return
+		}
 
-		fmt.Fprintf(w, "</section>\n")
-		printPageFoot(w)
+		data := struct {
+			Page
+			Tokens []ApiToken
+		}{newPage(r, db, login, querySite(db)), tt}
+		renderPage(w, "usersetup.html", data)
 	}
 }
 
 func edituserHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errmsg string
-		var f struct{ username, email, password, password2 string }
+		var f struct {
+			username, email, about, password, password2 string
+			digest                                      bool
+		}
 
 		qfrom := r.FormValue("from")
 		qsetpwd := r.FormValue("setpwd") // ?setpwd=1 to prompt for new password
 		quserid := idtoi(r.FormValue("userid"))
 		if quserid == -1 {
-			log.Printf("edit user: no userid\n")
+			logDebugf("edit user: no userid\n")
 			http.Error(w, "missing userid parameter", 401)
 			return
 		}
 
 		login := getLoginUser(r, db)
-		if login.Userid != ADMIN_ID && login.Userid != quserid {
-			log.Printf("edit user: admin or self user not logged in\n")
+		if login.Tokenid != 0 {
+			http.Error(w, "Api tokens can't be used here. Please log in.", 403)
+			return
+		}
+		if !isAdmin(login) && login.Userid != quserid {
+			logDebugf("edit user: admin or self user not logged in\n")
 			http.Error(w, "admin or self user required", 401)
 			return
 		}
+		if !canEditUser(login, quserid) {
+			logDebugf("edit user: userid %d can't edit the super-admin\n", login.Userid)
+			http.Error(w, "can't edit this user", 401)
+			return
+		}
 
 		u := queryUser(db, quserid)
 		if u.Userid == -1 {
-			log.Printf("edit user: userid %d doesn't exist\n", quserid)
+			logDebugf("edit user: userid %d doesn't exist\n", quserid)
 			http.Error(w, "user doesn't exist", 401)
 			return
 		}
 
 		f.username = u.Username
 		f.email = u.Email
+		f.about = u.About
+		f.digest = u.Digest
 
 		if r.Method == "POST" {
 			f.username = strings.TrimSpace(r.FormValue("username"))
 			f.email = r.FormValue("email")
+			f.about = strings.TrimSpace(r.FormValue("about"))
+			f.digest = r.FormValue("digest") != ""
 
 			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
 				// If username was changed,
 				// make sure the new username hasn't been taken yet.
 				if f.username != u.Username && isUsernameExists(db, f.username) {
@@ -1007,8 +1231,13 @@ func edituserHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 
 				var err error
 				if qsetpwd == "" {
-					s := "UPDATE user SET username = ?, email = ? WHERE user_id = ?"
-					_, err = sqlexec(db, s, f.username, f.email, quserid)
+					// Changed email address needs to be confirmed again.
+					s := "UPDATE user SET username = ?, email = ?, about = ?, digest = ?, emailverified = CASE WHEN email = ? THEN emailverified ELSE 0 END WHERE user_id = ?"
+					_, err = sqlexec(db, s, f.username, f.email, f.about, f.digest, f.email, quserid)
+					if err == nil && f.email != u.Email {
+						u.Email = f.email
+						err = sendVerifyEmail(db, querySite(db), u)
+					}
 				} else {
 					// ?setpwd=1 to set new password
 					f.password = r.FormValue("password")
@@ -1034,56 +1263,20 @@ func edituserHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-
-		fmt.Fprintf(w, "<div class=\"main\">\n")
-		fmt.Fprintf(w, "<section class=\"main-content\">\n")
-		fmt.Fprintf(w, "<form class=\"simpleform\" action=\"/edituser/?userid=%d&setpwd=%s&from=%s\" method=\"post\">\n", quserid, qsetpwd, url.QueryEscape(qfrom))
-		fmt.Fprintf(w, "<h1 class=\"heading\">Edit User</h1>")
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-		// ?setpwd=1 to set new password
-		if qsetpwd != "" {
-			fmt.Fprintf(w, "<div class=\"control displayonly\">\n")
-			fmt.Fprintf(w, "<label for=\"username\">username</label>\n")
-			fmt.Fprintf(w, "<input id=\"username\" name=\"username\" type=\"text\" size=\"20\" maxlength=\"20\" value=\"%s\" readonly>\n", f.username)
-			fmt.Fprintf(w, "</div>\n")
-
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<label for=\"password\">password</label>\n")
-			fmt.Fprintf(w, "<input id=\"password\" name=\"password\" type=\"password\" size=\"30\" value=\"%s\">\n", f.password)
-			fmt.Fprintf(w, "</div>\n")
-
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<label for=\"password2\">re-enter password</label>\n")
-			fmt.Fprintf(w, "<input id=\"password2\" name=\"password2\" type=\"password\" size=\"30\" value=\"%s\">\n", f.password2)
-			fmt.Fprintf(w, "</div>\n")
-		} else {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<label for=\"username\">username</label>\n")
-			fmt.Fprintf(w, "<input id=\"username\" name=\"username\" type=\"text\" size=\"20\" maxlength=\"20\" value=\"%s\">\n", f.username)
-			fmt.Fprintf(w, "</div>\n")
-
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<label for=\"email\">email</label>\n")
-			fmt.Fprintf(w, "<input id=\"email\" name=\"email\" type=\"email\" size=\"20\" value=\"%s\">\n", f.email)
-			fmt.Fprintf(w, "</div>\n")
-		}
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<button class=\"submit\">update user</button>\n")
-		fmt.Fprintf(w, "</div>\n")
-		fmt.Fprintf(w, "</form>\n")
-		fmt.Fprintf(w, "</section>\n")
-
-		fmt.Fprintf(w, "</div>\n")
-		printPageFoot(w)
+		data := struct {
+			Page
+			Userid    int64
+			Setpwd    string
+			From      string
+			Username  string
+			Email     string
+			About     string
+			Digest    bool
+			Password  string
+			Password2 string
+		}{newPage(r, db, login, querySite(db)), quserid, qsetpwd, qfrom, f.username, f.email, f.about, f.digest, f.password, f.password2}
+		data.Errmsg = errmsg
+		renderPage(w, "edituser.html", data)
 	}
 }
 
@@ -1094,33 +1287,42 @@ func activateuserHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		qfrom := r.FormValue("from")
 		qsetactive := atoi(r.FormValue("setactive"))
 		if qsetactive != 0 && qsetactive != 1 {
-			log.Printf("activate user: setactive should be 0 or 1\n")
+			logDebugf("activate user: setactive should be 0 or 1\n")
 			http.Error(w, "missing setactive parameter", 401)
 			return
 		}
 		quserid := idtoi(r.FormValue("userid"))
 		if quserid == -1 {
-			log.Printf("activate user: no userid\n")
+			logDebugf("activate user: no userid\n")
 			http.Error(w, "missing userid parameter", 401)
 			return
 		}
 
 		login := getLoginUser(r, db)
-		if login.Userid != ADMIN_ID {
-			log.Printf("activate user: admin not logged in\n")
+		if !isAdmin(login) {
+			logDebugf("activate user: admin not logged in\n")
 			http.Error(w, "admin user required", 401)
 			return
 		}
+		if quserid == ADMIN_ID || quserid == login.Userid {
+			logDebugf("activate user: can't change active of userid %d\n", quserid)
+			http.Error(w, "can't activate or deactivate this user", 401)
+			return
+		}
 
 		u := queryUser(db, quserid)
 		if u.Userid == -1 {
-			log.Printf("activate user: userid %d doesn't exist\n", quserid)
+			logDebugf("activate user: userid %d doesn't exist\n", quserid)
 			http.Error(w, "user doesn't exist", 401)
 			return
 		}
 
 		if r.Method == "POST" {
 			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
 				s := "UPDATE user SET active = ? WHERE user_id = ?"
 				_, err := sqlexec(db, s, qsetactive, quserid)
 				if err != nil {
@@ -1128,235 +1330,258 @@ func activateuserHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 					errmsg = "A problem occured. Please try again."
 					break
 				}
+				action := AUDIT_DEACTIVATE_USER
+				if qsetactive == 1 {
+					action = AUDIT_ACTIVATE_USER
+				}
+				logAudit(db, login, action, AUDIT_USER, u.Userid, u.Username, AuditFields{"active": u.Active}, AuditFields{"active": qsetactive == 1}, parseReason(r))
 
 				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
 				return
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-
-		fmt.Fprintf(w, "<div class=\"main\">\n")
-		fmt.Fprintf(w, "<section class=\"main-content\">\n")
-		fmt.Fprintf(w, "<form class=\"simpleform\" action=\"/activateuser/?userid=%d&setactive=%d&from=%s\" method=\"post\">\n", quserid, qsetactive, url.QueryEscape(qfrom))
-		if qsetactive == 0 {
-			fmt.Fprintf(w, "<h1 class=\"heading\">Deactivate User</h1>")
-		} else {
-			fmt.Fprintf(w, "<h1 class=\"heading\">Activate User</h1>")
-		}
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-		fmt.Fprintf(w, "<div class=\"control displayonly\">\n")
-		fmt.Fprintf(w, "<label for=\"username\">username</label>\n")
-		fmt.Fprintf(w, "<input id=\"username\" name=\"username\" type=\"text\" size=\"20\" maxlength=\"20\" readonly value=\"%s\">\n", u.Username)
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		if qsetactive == 0 {
-			fmt.Fprintf(w, "<button class=\"submit\">deactivate user</button>\n")
-		} else {
-			fmt.Fprintf(w, "<button class=\"submit\">activate user</button>\n")
-		}
-		fmt.Fprintf(w, "</div>\n")
-		fmt.Fprintf(w, "</form>\n")
-		fmt.Fprintf(w, "</section>\n")
-
-		fmt.Fprintf(w, "</div>\n")
-		printPageFoot(w)
+		data := struct {
+			Page
+			User      *User
+			Setactive int
+			From      string
+		}{newPage(r, db, login, querySite(db)), u, qsetactive, qfrom}
+		data.Errmsg = errmsg
+		renderPage(w, "activateuser.html", data)
 	}
 }
 
-func getCountUnit(e *Entry, nchildren int) string {
-	if e.Thing == SUBMISSION {
-		if nchildren == 1 {
-			return "comment"
-		} else {
-			return "comments"
+func setroleHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		qfrom := r.FormValue("from")
+		qrole := atoi(r.FormValue("role"))
+		if qrole != ROLE_USER && qrole != ROLE_MODERATOR && qrole != ROLE_ADMIN {
+			logDebugf("set role: invalid role\n")
+			http.Error(w, "invalid role parameter", 401)
+			return
 		}
-	} else {
-		if nchildren == 1 {
-			return "reply"
-		} else {
-			return "replies"
+		quserid := idtoi(r.FormValue("userid"))
+		if quserid == -1 {
+			logDebugf("set role: no userid\n")
+			http.Error(w, "missing userid parameter", 401)
+			return
 		}
-	}
-}
-
-func getPointCountUnit(points int) string {
-	if points == 1 {
-		return "point"
-	}
-	return "points"
-}
 
-func printUpvote(w http.ResponseWriter, nvotes int, selfvote int) {
-	var selfvoteclass string
-	if selfvote == 1 {
-		selfvoteclass = "selfvote "
-	}
-	fmt.Fprintf(w, "<a class=\"upvote %s mx-auto\">\n", selfvoteclass)
-	fmt.Fprintf(w, "<svg viewbox=\"0 0 100 100\">\n")
-	fmt.Fprintf(w, "  <polygon points=\"50 15, 100 100, 0 100\"/>\n")
-	fmt.Fprintf(w, "</svg>\n")
-	fmt.Fprintf(w, "</a>\n")
-	fmt.Fprintf(w, "<div class=\"votectr mx-auto text-fade-2 text-sm\">%d</div>\n", nvotes)
-}
-
-func printCommentMarker(w http.ResponseWriter) {
-	fmt.Fprintf(w, "<svg viewbox=\"0 0 100 100\" class=\"upvote\">\n")
-	fmt.Fprintf(w, "  <rect x=\"25\" y=\"25\" width=\"40\" height=\"40\"/>\n")
-	fmt.Fprintf(w, "</svg>\n")
-}
-
-func printSubmissionEntry(w http.ResponseWriter, r *http.Request, db *sql.DB, qi *QIndex, e *Entry, tt []string, submitter *User, login *User, ncomments, totalvotes int, selfvote int, points float64, showBody bool) {
-	screatedt := parseIsoDate(e.Createdt)
-	itemurl := createItemUrl(e.Entryid)
-	entryurl := e.Url
-	if entryurl == "" {
-		entryurl = itemurl
-	}
+		login := getLoginUser(r, db)
+		if !isAdmin(login) {
+			logDebugf("set role: admin not logged in\n")
+			http.Error(w, "admin user required", 401)
+			return
+		}
+		if quserid == ADMIN_ID || quserid == login.Userid {
+			logDebugf("set role: can't change role of userid %d\n", quserid)
+			http.Error(w, "can't change role of this user", 401)
+			return
+		}
 
-	tokparms := fmt.Sprintf("%d:%d", e.Entryid, login.Userid)
-	fmt.Fprintf(w, "<section class=\"entry\" data-votetok=\"%s\">\n", encryptString(tokparms))
-	fmt.Fprintf(w, "<div class=\"col0\">\n")
-	printUpvote(w, totalvotes, selfvote)
-	fmt.Fprintf(w, "</div>\n")
+		u := queryUser(db, quserid)
+		if u.Userid == -1 {
+			logDebugf("set role: userid %d doesn't exist\n", quserid)
+			http.Error(w, "user doesn't exist", 401)
+			return
+		}
 
-	fmt.Fprintf(w, "<div class=\"col1\">\n")
-	fmt.Fprintf(w, "<div class=\"mb-xs text-lg\">\n")
-	fmt.Fprintf(w, "  <a class=\"no-underline\" href=\"%s\">%s</a>\n", entryurl, escape(normalizeTitle(e.Title)))
+		if r.Method == "POST" {
+			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+				s := "UPDATE user SET role = ? WHERE user_id = ?"
+				_, err := sqlexec(db, s, qrole, quserid)
+				if err != nil {
+					log.Printf("DB error updating user.role: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				logAudit(db, login, AUDIT_SET_ROLE, AUDIT_USER, u.Userid, u.Username, AuditFields{"role": roleName(u.Role)}, AuditFields{"role": roleName(qrole)}, parseReason(r))
 
-	// url host
-	if e.Url != "" {
-		urllink, err := url.Parse(e.Url)
-		urlhostname := strings.TrimPrefix(urllink.Hostname(), "www.")
-		if err == nil {
-			fmt.Fprintf(w, " <span class=\"text-fade-2 text-sm\">(%s)</span>\n", escape(urlhostname))
+				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
+				return
+			}
 		}
+
+		data := struct {
+			Page
+			User *User
+			Role int
+			From string
+		}{newPage(r, db, login, querySite(db)), u, qrole, qfrom}
+		data.Errmsg = errmsg
+		renderPage(w, "setrole.html", data)
 	}
-	// tags
-	for _, t := range tt {
-		fmt.Fprintf(w, " <span class=\"tag-pill text-fade-2\"><a class=\"no-underline\"href=\"/?cat=%d&tag=%s&latest=%s\">%s</a></span>\n", qi.Cat, url.QueryEscape(t), qi.Latest, escape(t))
-	}
+}
 
-	fmt.Fprintf(w, "</div>\n")
-	fmt.Fprintf(w, "<ul class=\"line-menu byline\">\n")
-	npoints := int(math.Floor(points))
-	fmt.Fprintf(w, "  <li>%d %s</li>\n", npoints, getPointCountUnit(npoints))
-	fmt.Fprintf(w, "  <li><a href=\"/?cat=%d&username=%s&latest=%s\">%s</a></li>\n", qi.Cat, url.QueryEscape(submitter.Username), qi.Latest, url.QueryEscape(submitter.Username))
-	if login.Userid == ADMIN_ID || submitter.Userid == login.Userid {
-		fmt.Fprintf(w, "  <li><a class=\"\" href=\"/edit/?id=%d&from=%s\">edit</a></li>\n", e.Entryid, url.QueryEscape(r.RequestURI))
+func getVoteUnit(nvotes int) string {
+	if nvotes == 1 {
+		return "point"
 	}
-	if login.Userid == ADMIN_ID || submitter.Userid == login.Userid {
-		fromurl := r.RequestURI
-		if strings.Contains(fromurl, "/item") {
-			fromurl = "/"
+	return "points"
+}
+
+func getCountUnit(e *Entry, nchildren int) string {
+	if e.Thing == SUBMISSION {
+		if nchildren == 1 {
+			return "comment"
+		} else {
+			return "comments"
+		}
+	} else {
+		if nchildren == 1 {
+			return "reply"
+		} else {
+			return "replies"
 		}
-		fmt.Fprintf(w, "  <li><a class=\"\" href=\"/del/?id=%d&from=%s\">delete</a></li>\n", e.Entryid, url.QueryEscape(fromurl))
 	}
-	fmt.Fprintf(w, "  <li>%s</li>\n", screatedt)
-	fmt.Fprintf(w, "  <li><a href=\"%s\">%d %s</a></li>\n", itemurl, ncomments, getCountUnit(e, ncomments))
-	fmt.Fprintf(w, "</ul>\n")
+}
 
-	if showBody {
-		fmt.Fprintf(w, "<div class=\"content mt-base mb-base\">\n")
-		//e.Body = parseTextLinks(e.Body)
-		e.Body = parseMarkdown(e.Body)
-		fmt.Fprintf(w, e.Body)
-		fmt.Fprintf(w, "</div>\n")
+func getPointCountUnit(points int) string {
+	if points == 1 {
+		return "point"
 	}
+	return "points"
+}
 
-	fmt.Fprintf(w, "</div>\n") // col1
-	fmt.Fprintf(w, "</section>\n")
+// Downvotes are for users with enough karma, and moderators.
+func canDownvote(site *Site, login *User, entryUserid int64) bool {
+	if login.Userid == -1 || !login.Active || login.Userid == entryUserid {
+		return false
+	}
+	return isModerator(login) || login.Karma >= site.Downvotekarma
 }
 
-func printCommentEntry(w http.ResponseWriter, db *sql.DB, e *Entry, u *User, parent *Entry, ncomments int) {
-	screatedt := parseIsoDate(e.Createdt)
-	itemurl := createItemUrl(e.Entryid)
-	entryurl := e.Url
-	if entryurl == "" {
-		entryurl = itemurl
+func flagActionName(flagaction int) string {
+	if flagaction == FLAG_HIDE {
+		return "hide from non-moderators"
 	}
+	return "mark as [flagged]"
+}
 
-	fmt.Fprintf(w, "<section class=\"entry\">\n")
-	fmt.Fprintf(w, "<div class=\"col0-comment\">\n")
-	printCommentMarker(w)
-	fmt.Fprintf(w, "</div>\n")
+func isFlagged(site *Site, nflags int) bool {
+	return site.Flagthreshold > 0 && nflags >= site.Flagthreshold
+}
 
-	fmt.Fprintf(w, "<div class=\"col1\">\n")
-	fmt.Fprintf(w, "<ul class=\"line-menu byline\">\n")
-	fmt.Fprintf(w, "  <li><a href=\"#\">%s</a></li>\n", escape(u.Username))
-	fmt.Fprintf(w, "  <li>%s</li>\n", screatedt)
-	fmt.Fprintf(w, "  <li><a href=\"%s\">%d %s</a></li>\n", itemurl, ncomments, getCountUnit(e, ncomments))
+// Moderators still see hidden entries so they can act on them.
+func isFlagHidden(site *Site, login *User, nflags int) bool {
+	return isFlagged(site, nflags) && site.Flagaction == FLAG_HIDE && !isModerator(login)
+}
 
-	if parent != nil {
-		parenturl := createItemUrl(parent.Entryid)
-		fmt.Fprintf(w, "  <li><a href=\"%s\">parent</a></li>\n", parenturl)
+// SQL condition leaving out the entries isFlagHidden() hides, with its
+// parameters. totalflags has to be joined on the entry.
+func flagHiddenCond(site *Site, login *User) (string, []interface{}) {
+	if site.Flagthreshold > 0 && site.Flagaction == FLAG_HIDE && !isModerator(login) {
+		return " AND IFNULL(totalflags.flags, 0) < ?", []interface{}{site.Flagthreshold}
 	}
+	return "", nil
+}
 
-	root, err := queryRootEntry(db, e.Entryid)
-	if err == nil {
-		rooturl := createItemUrl(root.Entryid)
-		fmt.Fprintf(w, "  <li>on: <a href=\"%s\">%s</a></li>\n", rooturl, escape(normalizeTitle(root.Title)))
-	} else {
-		log.Printf("DB error querying root entry (%s)\n", err)
-	}
-	fmt.Fprintf(w, "</ul>\n")
+func canFlag(login *User, entryUserid int64) bool {
+	return login.Userid != -1 && login.Active && login.Userid != entryUserid
+}
 
-	fmt.Fprintf(w, "<div class=\"content mt-base mb-base\">\n")
-	//e.Body = parseTextLinks(e.Body)
-	e.Body = parseMarkdown(e.Body)
-	fmt.Fprintf(w, e.Body)
-	fmt.Fprintf(w, "</div>\n")
+// Entry as shown by the submission, commententry and comment templates.
+type EntryView struct {
+	IndexEntry
+	Tags     []string
+	Qi       *QIndex // listing filters kept by the tag links
+	Parent   Entry   // entry that a comment replies to
+	Uparent  User    // author of Parent
+	Root     *Entry  // submission that a comment belongs to
+	Level    int     // depth of comment in its thread
+	Replies  []EntryView
+	ShowBody bool
+
+	page *Page
+}
+
+func newEntryView(p *Page, ie IndexEntry) EntryView {
+	return EntryView{IndexEntry: ie, Qi: &QIndex{}, page: p}
+}
 
-	fmt.Fprintf(w, "</div>\n") // col1
-	fmt.Fprintf(w, "</section>\n")
+func (ev EntryView) Csrftok() string {
+	return ev.page.Csrftok
 }
 
-func printComment(w http.ResponseWriter, db *sql.DB, e *Entry, u *User, uparent *User, level int) {
-	screatedt := parseIsoDate(e.Createdt)
-	itemurl := createItemUrl(e.Entryid)
-	entryurl := e.Url
-	if entryurl == "" {
-		entryurl = itemurl
+func (ev EntryView) Requri() string {
+	return ev.page.Requri
+}
+
+func (ev EntryView) EntryUrl() string {
+	if ev.Entry.Url == "" {
+		return createItemUrl(ev.Entry.Entryid)
 	}
+	return ev.Entry.Url
+}
 
-	// Limit the indents to maxindent
-	maxindent := 1
-	nindent := level
-	if nindent > maxindent {
-		nindent = maxindent
+func (ev EntryView) Hostname() string {
+	if ev.Entry.Url == "" {
+		return ""
 	}
-	fmt.Fprintf(w, "<section class=\"entry\" style=\"padding-left: %drem\">\n", nindent*2)
+	urllink, err := url.Parse(ev.Entry.Url)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(urllink.Hostname(), "www.")
+}
 
-	fmt.Fprintf(w, "<div class=\"col0-comment\">\n")
-	printCommentMarker(w)
-	fmt.Fprintf(w, "</div>\n")
+func (ev EntryView) Npoints() int {
+	return int(math.Floor(ev.Points))
+}
 
-	fmt.Fprintf(w, "<div class=\"col1\">\n")
-	fmt.Fprintf(w, "  <p class=\"byline mb-xs\">%s <a href=\"%s\">%s</a></p>\n", escape(u.Username), itemurl, screatedt)
+func (ev EntryView) CountUnit() string {
+	return getCountUnit(&ev.Entry, ev.Ncomments)
+}
 
-	fmt.Fprintf(w, "  <div class=\"content mt-xs mb-xs\">\n")
-	body := e.Body
-	if level >= 1 {
-		//		fmt.Fprintf(w, "<span class=\"mention\">@%s</span> ", uparent.Username)
-		body = fmt.Sprintf("***@%s*** %s", escape(uparent.Username), e.Body)
+// Deleting a submission from its own item page returns to the front page.
+func (ev EntryView) Delfrom() string {
+	if strings.Contains(ev.page.Requri, "/item") {
+		return "/"
 	}
-	//body = parseTextLinks(body)
-	body = parseMarkdown(body)
-	fmt.Fprintf(w, body)
-	fmt.Fprintf(w, "</div>\n")
+	return ev.page.Requri
+}
+
+func (ev EntryView) CanEdit() bool {
+	return canEditEntry(ev.page.Login, ev.Submitter.Userid, ev.Catid)
+}
+
+func (ev EntryView) CanFlag() bool {
+	return canFlag(ev.page.Login, ev.Submitter.Userid) || (isModerator(ev.page.Login) && ev.Nflags > 0)
+}
+
+func (ev EntryView) CanDownvote() bool {
+	return canDownvote(ev.page.Site, ev.page.Login, ev.Submitter.Userid)
+}
 
-	fmt.Fprintf(w, "  <p class=\"text-xs mb-base\"><a href=\"%s\">reply</a></p>\n", createItemUrl(e.Entryid))
-	fmt.Fprintf(w, "</div>\n") // col1
+func (ev EntryView) Flagged() bool {
+	return isFlagged(ev.page.Site, ev.Nflags)
+}
 
-	fmt.Fprintf(w, "</section>\n")
+func (ev EntryView) Hidden() bool {
+	return isFlagHidden(ev.page.Site, ev.page.Login, ev.Nflags)
+}
+
+// Limit the indents to one level.
+func (ev EntryView) Indent() int {
+	if ev.Level > 1 {
+		return 2
+	}
+	return ev.Level * 2
+}
+
+// Replies start with a mention of the user being replied to.
+func (ev EntryView) ReplyBody() string {
+	if ev.Level >= 1 && ev.Uparent.Username != "" {
+		return fmt.Sprintf("***@%s*** %s", escape(ev.Uparent.Username), ev.Entry.Body)
+	}
+	return ev.Entry.Body
 }
 
 func indexHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
@@ -1375,13 +1600,7 @@ func indexHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		if qoffset <= 0 {
 			qoffset = 0
 		}
-		qlimit := atoi(r.FormValue("limit"))
-		if qlimit <= 0 {
-			qlimit = SETTINGS_LIMIT
-		}
-
-		w.Header().Set("Content-Type", "text/html")
-		printPageHead(w, []string{"/static/handlevote.js"}, nil, site)
+		qlimit := parseLimit(r.FormValue("limit"), cfg.Pagesize)
 
 		qi := &QIndex{
 			Latest:   qlatest,
@@ -1389,127 +1608,116 @@ func indexHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 			Cat:      qcat,
 			Tag:      qtag,
 		}
-		printPageNav(w, db, login, site, qi)
 
-		fmt.Fprintf(w, "<section class=\"main\">\n")
-
-		// Inner heading
-		fmt.Fprintf(w, "<div class=\"flex justify-start mb-base\">\n")
-		fmt.Fprintf(w, "  <ul class=\"line-menu mr-2\">\n")
-		if qcat <= 0 {
-			fmt.Fprintf(w, "<li><a class=\"no-underline text-bold\" href=\"/?cat=0\">All</a></li>\n")
-		} else {
-			fmt.Fprintf(w, "<li><a class=\"no-underline\" href=\"/?cat=0\">All</a></li>\n")
-		}
-		var cat Cat
-		s := "SELECT cat_id, name FROM cat ORDER BY cat_id"
-		rows, _ := db.Query(s)
-		for rows.Next() {
-			rows.Scan(&cat.Catid, &cat.Name)
-			url := fmt.Sprintf("/?cat=%d", cat.Catid)
-			if cat.Catid == qcat {
-				fmt.Fprintf(w, "<li><a class=\"no-underline text-bold\" href=\"%s\">%s</a></li>\n", url, escape(cat.Name))
-				continue
-			}
-			fmt.Fprintf(w, "<li><a class=\"no-underline\" href=\"%s\">%s</a></li>\n", url, escape(cat.Name))
-		}
-		fmt.Fprintf(w, "  </ul>\n")
-
-		fmt.Fprintf(w, "  <ul class=\"list-none\">\n")
-		if qusername != "" {
-			fmt.Fprintf(w, "    <li class=\"inline tag-pill mr-1\">%s</li>\n", escape(qusername))
-		}
-		if qtag != "" {
-			fmt.Fprintf(w, "    <li class=\"inline tag-pill mr-1\">%s</li>\n", escape(qtag))
+		cats, err := queryCats(db)
+		if handleDbErr(w, err, "indexhandler") {
+			return
 		}
-		fmt.Fprintf(w, "  </ul>\n")
-		fmt.Fprintf(w, "</div>\n")
-
-		orderby := "points DESC, e.createdt DESC"
-		if qlatest != "" {
-			orderby = "e.createdt DESC"
+		ee, err := queryIndexEntries(db, site, login, qi, qoffset, qlimit)
+		if handleDbErr(w, err, "indexhandler") {
+			return
 		}
 
-		var qq []interface{}
-		qq = append(qq, site.Gravityf, login.Userid)
-		where := "thing = 0"
-		join := `LEFT OUTER JOIN user u ON e.user_id = u.user_id 
+		p := newPage(r, db, login, site)
+		p.Qi = qi
+		p.Jsurls = []string{staticUrl("handlevote.js")}
+		var vv []EntryView
+		for _, ie := range ee {
+			ev := newEntryView(&p, ie)
+			ev.Qi = qi
+			ev.Tags, _ = queryEntryTags(db, ie.Entry.Entryid)
+			vv = append(vv, ev)
+		}
+
+		baseurl := fmt.Sprintf("/?username=%s&cat=%d&tag=%s&latest=%s", url.QueryEscape(qusername), qcat, url.QueryEscape(qtag), qlatest)
+		data := struct {
+			Page
+			Cats    []Cat
+			Entries []EntryView
+			Paging  PagingNav
+		}{p, cats, vv, newPagingNav(baseurl, qoffset, qlimit, len(ee))}
+		renderPage(w, "index.html", data)
+	}
+}
+
+// Submission with its listing details, as shown in the index.
+type IndexEntry struct {
+	Entry      Entry
+	Catid      int64 // category of the submission, or of the submission a comment is under
+	Submitter  User
+	Ncomments  int
+	TotalVotes int
+	Selfvote   int
+	Nflags     int
+	Points     float64
+}
+
+// Return page of submissions matching qi filters, ordered by points
+// or by latest if qi.Latest is set.
+func queryIndexEntries(db *sql.DB, site *Site, login *User, qi *QIndex, offset, limit int) ([]IndexEntry, error) {
+	orderby := "points DESC, e.createdt DESC"
+	if qi.Latest != "" {
+		orderby = "e.createdt DESC"
+	}
+
+	var qq []interface{}
+	qq = append(qq, site.Gravityf, login.Userid)
+	where := "thing = 0 AND e.deleted = 0"
+	join := `LEFT OUTER JOIN user u ON e.user_id = u.user_id 
+LEFT OUTER JOIN userkarma uk ON e.user_id = uk.user_id 
 LEFT OUTER JOIN totalvotes ON e.entry_id = totalvotes.entry_id 
+LEFT OUTER JOIN totalflags ON e.entry_id = totalflags.entry_id 
 LEFT OUTER JOIN entryvote ev ON ev.entry_id = e.entry_id AND ev.user_id = ?`
 
-		if qcat > 0 {
-			join += " INNER JOIN entrycat ec ON e.entry_id = ec.entry_id AND ec.cat_id = ?"
-			qq = append(qq, qcat)
-		}
-		if qtag != "" {
-			join += " INNER JOIN entrytag et ON e.entry_id = et.entry_id AND et.tag = ?"
-			qq = append(qq, qtag)
-		}
-		if qusername != "" {
-			where += " AND u.Username = ?"
-			qq = append(qq, qusername)
-		}
-		qq = append(qq, qlimit, qoffset)
+	if qi.Cat > 0 {
+		join += " INNER JOIN entrycat ec ON e.entry_id = ec.entry_id AND ec.cat_id = ?"
+		qq = append(qq, qi.Cat)
+	} else {
+		join += " LEFT OUTER JOIN entrycat ec ON e.entry_id = ec.entry_id"
+	}
+	join += " LEFT OUTER JOIN cat c ON ec.cat_id = c.cat_id"
+	if qi.Tag != "" {
+		join += " INNER JOIN entrytag et ON e.entry_id = et.entry_id AND et.tag = ?"
+		qq = append(qq, resolveTag(db, qi.Tag))
+	}
+	if qi.Username != "" {
+		where += " AND u.Username = ?"
+		qq = append(qq, qi.Username)
+	}
+	cond, pp := flagHiddenCond(site, login)
+	where += cond
+	qq = append(qq, pp...)
+	qq = append(qq, limit, offset)
 
-		s = fmt.Sprintf(`SELECT e.entry_id, e.title, e.url, e.createdt, 
-IFNULL(u.user_id, 0), IFNULL(u.username, ''),  
-(SELECT COUNT(*) FROM entry AS child WHERE child.parent_id = e.entry_id) AS ncomments, 
+	s := fmt.Sprintf(`SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.description, e.thumburl, e.createdt, e.editdt, IFNULL(ec.cat_id, 0), 
+IFNULL(u.user_id, 0), IFNULL(u.username, ''), IFNULL(uk.karma, 0), 
+(SELECT COUNT(*) FROM entry AS child WHERE child.parent_id = e.entry_id AND child.deleted = 0) AS ncomments, 
 IFNULL(totalvotes.votes, 0),
-CASE WHEN ev.entry_id IS NOT NULL THEN 1 ELSE 0 END, 
-calculate_points(IFNULL(totalvotes.votes, 0), e.createdt, ?) AS points
+IFNULL(ev.dir, 0), 
+IFNULL(totalflags.flags, 0), 
+calculate_points(IFNULL(totalvotes.votes, 0), e.createdt, %s) AS points
 FROM entry AS e 
  %s 
 WHERE %s 
 ORDER BY %s 
-LIMIT ? OFFSET ?`, join, where, orderby)
-		rows, err := db.Query(s, qq...)
-		if handleDbErr(w, err, "indexhandler") {
-			return
-		}
-
-		fmt.Fprintf(w, "<ul class=\"vertical-list\">\n")
-		var u User
-		var e Entry
-		var ncomments int
-		var totalvotes int
-		var selfvote int
-		var points float64
-		nrows := 0
-		for rows.Next() {
-			rows.Scan(&e.Entryid, &e.Title, &e.Url, &e.Createdt, &u.Userid, &u.Username, &ncomments, &totalvotes, &selfvote, &points)
-			fmt.Fprintf(w, "<li>\n")
-
-			tt, _ := queryEntryTags(db, e.Entryid)
-			printSubmissionEntry(w, r, db, qi, &e, tt, &u, login, ncomments, totalvotes, selfvote, points, false)
-			fmt.Fprintf(w, "</li>\n")
-			nrows++
-		}
-		fmt.Fprintf(w, "</ul>\n")
-
-		baseurl := fmt.Sprintf("/?username=%s&cat=%s&tag=%s&latest=%s", qusername, qcat, qtag, qlatest)
-		printPagingNav(w, baseurl, qoffset, qlimit, nrows)
-		fmt.Fprintf(w, "</section>\n")
-		printPageFoot(w)
+LIMIT ? OFFSET ?`, CAT_GRAVITYF_SQL, join, where, orderby)
+	rows, err := db.Query(s, qq...)
+	if err != nil {
+		return nil, err
 	}
-}
+	defer rows.Close()
 
-func printPagingNav(w http.ResponseWriter, baseurl string, offset, limit, nrows int) {
-	fmt.Fprintf(w, "<div class=\"flex-row text-sm text-fade-2 text-italic mt-xl\">\n")
-	if offset > 0 {
-		prevOffset := offset - limit
-		if prevOffset < 0 {
-			prevOffset = 0
+	var ee []IndexEntry
+	for rows.Next() {
+		var ie IndexEntry
+		err := rows.Scan(&ie.Entry.Entryid, &ie.Entry.Thing, &ie.Entry.Title, &ie.Entry.Url, &ie.Entry.Body, &ie.Entry.Description, &ie.Entry.Thumburl, &ie.Entry.Createdt, &ie.Entry.Editdt, &ie.Catid, &ie.Submitter.Userid, &ie.Submitter.Username, &ie.Submitter.Karma, &ie.Ncomments, &ie.TotalVotes, &ie.Selfvote, &ie.Nflags, &ie.Points)
+		if err != nil {
+			return nil, err
 		}
-		prevLink := fmt.Sprintf("%s&offset=%d&limit=%d", baseurl, prevOffset, limit)
-		fmt.Fprintf(w, "  <p><a href=\"%s\">Previous</a></p>\n", prevLink)
-	} else {
-		fmt.Fprintf(w, "  <p></p>\n")
-	}
-	if nrows == limit {
-		moreLink := fmt.Sprintf("%s&offset=%d&limit=%d", baseurl, offset+limit, limit)
-		fmt.Fprintf(w, "  <p><a href=\"%s\">More</a></p>\n", moreLink)
+		ie.Entry.Userid = ie.Submitter.Userid
+		ee = append(ee, ie)
 	}
-	fmt.Fprintf(w, "</div>\n")
+	return ee, rows.Err()
 }
 
 func validateIdParm(w http.ResponseWriter, id int64) bool {
@@ -1576,6 +1784,59 @@ func validateLogin(w http.ResponseWriter, login *User) bool {
 	return true
 }
 
+// Account pages need a session login, so that a leaked api token can't be
+// used to change the password, email or tokens of its user.
+func validateSessionLogin(w http.ResponseWriter, login *User) bool {
+	if !validateLogin(w, login) {
+		return false
+	}
+	if login.Tokenid != 0 {
+		http.Error(w, "Api tokens can't be used here. Please log in.", 403)
+		return false
+	}
+	return true
+}
+
+func roleName(role int) string {
+	switch role {
+	case ROLE_MODERATOR:
+		return "moderator"
+	case ROLE_ADMIN:
+		return "admin"
+	}
+	return "user"
+}
+
+// Api tokens can't be used for admin or moderator actions.
+func isAdmin(u *User) bool {
+	return u.Userid != -1 && u.Active && u.Tokenid == 0 && u.Role == ROLE_ADMIN
+}
+
+// Admins can edit any account but the super-admin's, which only it can edit.
+func canEditUser(login *User, userid int64) bool {
+	if userid == ADMIN_ID {
+		return login.Userid == ADMIN_ID
+	}
+	return isAdmin(login) || (login.Userid != -1 && login.Userid == userid)
+}
+
+func isModerator(u *User) bool {
+	return u.Userid != -1 && u.Active && u.Tokenid == 0 && (u.Role == ROLE_MODERATOR || u.Role == ROLE_ADMIN)
+}
+
+// Moderators can edit or delete any entry, category moderators the entries
+// in their category, other users only their own.
+func canEditEntry(login *User, entryUserid, catid int64) bool {
+	if login.Userid == -1 {
+		return false
+	}
+	return canModerateCat(login, catid) || login.Userid == entryUserid
+}
+
+func createUserUrl(username string) string {
+	return fmt.Sprintf("/user/?name=%s", url.QueryEscape(username))
+}
+
 func createItemUrl(id int64) string {
 	return fmt.Sprintf("/item/?id=%d", id)
 }
@@ -1589,6 +1850,10 @@ func itemHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		if !validateIdParm(w, qentryid) {
 			return
 		}
+		qsort := r.FormValue("sort")
+		if qsort != COMMENT_SORT_NEW && qsort != COMMENT_SORT_OLD {
+			qsort = COMMENT_SORT_BEST
+		}
 
 		var u User
 		var e Entry
@@ -1597,30 +1862,44 @@ func itemHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		var ncomments int
 		var totalvotes int
 		var selfvote int
+		var nflags int
 		var points float64
 
-		s := `SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.createdt, IFNULL(ec.cat_id, 0), 
+		s := `SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.description, e.thumburl, e.createdt, e.editdt, e.deleted, IFNULL(ec.cat_id, 0), 
 IFNULL(p.entry_id, 0), IFNULL(p.thing, 0), IFNULL(p.title, ''), IFNULL(p.url, ''), IFNULL(p.body, ''), IFNULL(p.createdt, ''), 
-IFNULL(u.user_id, 0), IFNULL(u.username, ''), IFNULL(u.active, 0), IFNULL(u.email, ''),  
-(SELECT COUNT(*) FROM entry AS child WHERE child.parent_id = e.entry_id) AS ncomments, 
+IFNULL(u.user_id, 0), IFNULL(u.username, ''), IFNULL(u.active, 0), IFNULL(u.email, ''), IFNULL(uk.karma, 0), 
+(SELECT COUNT(*) FROM entry AS child WHERE child.parent_id = e.entry_id AND child.deleted = 0) AS ncomments, 
 IFNULL(totalvotes.votes, 0) AS votes, 
-CASE WHEN ev.entry_id IS NOT NULL THEN 1 ELSE 0 END, 
-calculate_points(IFNULL(totalvotes.votes, 0), e.createdt, ?) AS points
+IFNULL(ev.dir, 0), 
+IFNULL(totalflags.flags, 0), 
+calculate_points(IFNULL(totalvotes.votes, 0), e.createdt, ` + CAT_GRAVITYF_SQL + `) AS points
 FROM entry e 
 LEFT OUTER JOIN user u ON e.user_id = u.user_id 
+LEFT OUTER JOIN userkarma uk ON e.user_id = uk.user_id 
 LEFT OUTER JOIN entrycat ec ON e.entry_id = ec.entry_id 
+LEFT OUTER JOIN cat c ON ec.cat_id = c.cat_id 
 LEFT OUTER JOIN totalvotes ON e.entry_id = totalvotes.entry_id 
+LEFT OUTER JOIN totalflags ON e.entry_id = totalflags.entry_id 
 LEFT OUTER JOIN entryvote ev ON ev.entry_id = e.entry_id AND ev.user_id = ?
 LEFT OUTER JOIN entry p ON e.parent_id = p.entry_id 
 WHERE e.entry_id = ?`
 		row := db.QueryRow(s, site.Gravityf, login.Userid, qentryid)
-		err := row.Scan(&e.Entryid, &e.Thing, &e.Title, &e.Url, &e.Body, &e.Createdt, &catid,
+		err := row.Scan(&e.Entryid, &e.Thing, &e.Title, &e.Url, &e.Body, &e.Description, &e.Thumburl, &e.Createdt, &e.Editdt, &e.Deleted, &catid,
 			&p.Entryid, &p.Thing, &p.Title, &p.Url, &p.Body, &p.Createdt,
-			&u.Userid, &u.Username, &u.Active, &u.Email,
-			&ncomments, &totalvotes, &selfvote, &points)
+			&u.Userid, &u.Username, &u.Active, &u.Email, &u.Karma,
+			&ncomments, &totalvotes, &selfvote, &nflags, &points)
 		if handleDbErr(w, err, "itemhandler") {
 			return
 		}
+		if e.Deleted != 0 {
+			e.Title = ""
+			e.Url = ""
+			e.Body = ""
+			e.Description = ""
+			e.Thumburl = ""
+			e.Editdt = ""
+			u = User{}
+		}
 
 		itemurl := createItemUrl(e.Entryid)
 
@@ -1630,19 +1909,28 @@ WHERE e.entry_id = ?`
 			if !validateLogin(w, login) {
 				return
 			}
-
 			for {
 				comment.Body = strings.TrimSpace(r.FormValue("commentbody"))
 				if comment.Body == "" {
 					errmsg = "Please enter a comment."
 					break
 				}
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+				if e.Deleted != 0 {
+					errmsg = "You can't reply to a deleted entry."
+					break
+				}
+				errmsg = checkRateLimit(db, site, r, login, RATE_COMMENT)
+				if errmsg != "" {
+					break
+				}
 
-				comment.Body = strings.ReplaceAll(comment.Body, "\r", "") // CRLF => CR
-				comment.Createdt = time.Now().Format(time.RFC3339)
-
-				s := "INSERT INTO entry (thing, parent_id, title, body, createdt, user_id) VALUES (?, ?, ?, ?, ?, ?)"
-				_, err := sqlexec(db, s, COMMENT, e.Entryid, "", comment.Body, comment.Createdt, login.Userid)
+				comment.Parentid = e.Entryid
+				comment.Userid = login.Userid
+				_, err := createComment(db, &comment)
 				if err != nil {
 					log.Printf("DB error creating comment (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
@@ -1654,95 +1942,161 @@ WHERE e.entry_id = ?`
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		printPageHead(w, []string{"/static/handlevote.js"}, nil, site)
-		printPageNav(w, db, login, site, nil)
+		page := newPage(r, db, login, site)
+		page.Jsurls = []string{staticUrl("handlevote.js")}
 
-		fmt.Fprintf(w, "<section class=\"main\">\n")
+		e.Userid = u.Userid
+		if e.Thing == COMMENT {
+			catid, err = queryEntryCatid(db, e.Entryid)
+			if err != nil {
+				log.Printf("DB error querying entry category (%s)\n", err)
+			}
+		}
+		ev := newEntryView(&page, IndexEntry{Entry: e, Catid: catid, Submitter: u, Ncomments: ncomments, TotalVotes: totalvotes, Selfvote: selfvote, Nflags: nflags, Points: points})
 		if e.Thing == SUBMISSION {
-			tt, _ := queryEntryTags(db, e.Entryid)
-			qi := &QIndex{Cat: catid}
-			printSubmissionEntry(w, r, db, qi, &e, tt, &u, login, ncomments, totalvotes, selfvote, points, true)
-		} else if e.Thing == COMMENT {
-			printCommentEntry(w, db, &e, &u, &p, ncomments)
-		}
-
-		fmt.Fprintf(w, "<form class=\"simpleform mb-2xl\" method=\"post\" action=\"%s\">\n", itemurl)
-		if login.Userid == -1 || !login.Active {
-			fmt.Fprintf(w, "<div class=\"control text-sm text-fade-2 text-italic\">\n")
-			fmt.Fprintf(w, "<label><a href=\"/login/?from=%s\">Log in</a> to post a comment.</label>\n", url.QueryEscape(r.RequestURI))
-			fmt.Fprintf(w, "</div>\n")
+			ev.Tags, _ = queryEntryTags(db, e.Entryid)
+			ev.Qi = &QIndex{Cat: catid}
+			ev.ShowBody = true
 		} else {
-			if errmsg != "" {
-				fmt.Fprintf(w, "<div class=\"control\">\n")
-				fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-				fmt.Fprintf(w, "</div>\n")
+			ev.Parent = p
+			ev.Root, err = queryRootEntry(db, e.Entryid)
+			if err != nil {
+				log.Printf("DB error querying root entry (%s)\n", err)
 			}
-			fmt.Fprintf(w, "  <div class=\"control\">\n")
-			fmt.Fprintf(w, "    <textarea id=\"commentbody\" name=\"commentbody\" rows=\"6\" cols=\"60\">%s</textarea>\n", comment.Body)
-			fmt.Fprintf(w, "  </div>\n")
-			fmt.Fprintf(w, "  <div class=\"control\">\n")
-			fmt.Fprintf(w, "    <button class=\"submit\">add comment</button>\n")
-			fmt.Fprintf(w, "  </div>\n")
 		}
-		fmt.Fprintf(w, "</form>\n")
 
-		fmt.Fprintf(w, "<section class=\"entry-comments\">\n")
-		printComments(w, db, e.Entryid, 0)
-		fmt.Fprintf(w, "</section>\n")
+		cc, err := queryComments(db, &page, e.Entryid, catid, 0, qsort)
+		if handleDbErr(w, err, "itemhandler") {
+			return
+		}
+		// Deleted entries are only shown to hold their replies together.
+		if e.Deleted != 0 && len(cc) == 0 {
+			http.Error(w, "Not found.", 404)
+			return
+		}
+
+		data := struct {
+			Page
+			Entry       EntryView
+			Commentbody string
+			Sort        string
+			Sorts       []string
+			Comments    []EntryView
+		}{page, ev, comment.Body, qsort, []string{COMMENT_SORT_BEST, COMMENT_SORT_NEW, COMMENT_SORT_OLD}, cc}
+		data.Errmsg = errmsg
+		renderPage(w, "item.html", data)
+	}
+}
 
-		fmt.Fprintf(w, "</section>\n")
-		printPageFoot(w)
+const COMMENT_SORT_BEST = "best"
+const COMMENT_SORT_NEW = "new"
+const COMMENT_SORT_OLD = "old"
+
+func commentsOrderBy(sort string) string {
+	switch sort {
+	case COMMENT_SORT_NEW:
+		return "e.createdt DESC, e.entry_id DESC"
+	case COMMENT_SORT_OLD:
+		return "e.entry_id"
 	}
+	return "wilson_score(IFNULL(totalvotes.ups, 0), IFNULL(totalvotes.downs, 0)) DESC, e.entry_id"
 }
 
-func printComments(w http.ResponseWriter, db *sql.DB, parentid int64, level int) {
-	s := `SELECT e.entry_id, e.body, e.createdt, u.user_id, u.username, uparent.user_id, uparent.username  
+// Return the replies to parentid, each with its own replies.
+func queryComments(db *sql.DB, p *Page, parentid, catid int64, level int, sort string) ([]EntryView, error) {
+	s := fmt.Sprintf(`SELECT e.entry_id, e.thing, e.body, e.createdt, e.editdt, e.deleted, IFNULL(u.user_id, 0), IFNULL(u.username, ''), IFNULL(uk.karma, 0), IFNULL(uparent.user_id, 0), IFNULL(uparent.username, ''), 
+IFNULL(totalvotes.votes, 0), 
+IFNULL(ev.dir, 0), 
+IFNULL(totalflags.flags, 0) 
 FROM entry AS e 
 LEFT OUTER JOIN user u ON e.user_id = u.user_id 
+LEFT OUTER JOIN userkarma uk ON e.user_id = uk.user_id 
 LEFT OUTER JOIN entry p ON e.parent_id = p.entry_id 
-LEFT OUTER JOIN user uparent ON uparent.user_id = p.user_id
+LEFT OUTER JOIN user uparent ON uparent.user_id = p.user_id AND p.deleted = 0
+LEFT OUTER JOIN totalvotes ON e.entry_id = totalvotes.entry_id 
+LEFT OUTER JOIN totalflags ON e.entry_id = totalflags.entry_id 
+LEFT OUTER JOIN entryvote ev ON ev.entry_id = e.entry_id AND ev.user_id = ?
 WHERE e.thing = 1 AND e.parent_id = ? 
-ORDER BY e.entry_id`
-	rows, err := db.Query(s, parentid)
-	if handleDbErr(w, err, "printComments") {
-		return
+ORDER BY %s`, commentsOrderBy(sort))
+	rows, err := db.Query(s, p.Login.Userid, parentid)
+	if err != nil {
+		return nil, err
 	}
-	var reply Entry
-	var u, uparent User
+	var cc []EntryView
 	for rows.Next() {
-		rows.Scan(&reply.Entryid, &reply.Body, &reply.Createdt, &u.Userid, &u.Username, &uparent.Userid, &uparent.Username)
+		var ie IndexEntry
+		var uparent User
+		err := rows.Scan(&ie.Entry.Entryid, &ie.Entry.Thing, &ie.Entry.Body, &ie.Entry.Createdt, &ie.Entry.Editdt, &ie.Entry.Deleted, &ie.Submitter.Userid, &ie.Submitter.Username, &ie.Submitter.Karma, &uparent.Userid, &uparent.Username, &ie.TotalVotes, &ie.Selfvote, &ie.Nflags)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ie.Entry.Parentid = parentid
+		if ie.Entry.Deleted != 0 {
+			ie.Entry.Body = ""
+			ie.Submitter = User{}
+		}
+		ie.Entry.Userid = ie.Submitter.Userid
+		ie.Catid = catid
+		c := newEntryView(p, ie)
+		c.Uparent = uparent
+		c.Level = level
+		cc = append(cc, c)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
 
-		printComment(w, db, &reply, &u, &uparent, level)
-		printComments(w, db, reply.Entryid, level+1)
+	// Deleted comments are left as placeholders for their replies.
+	var visible []EntryView
+	for i := range cc {
+		cc[i].Replies, err = queryComments(db, p, cc[i].Entry.Entryid, catid, level+1, sort)
+		if err != nil {
+			return nil, err
+		}
+		if cc[i].Entry.Deleted != 0 && len(cc[i].Replies) == 0 {
+			continue
+		}
+		visible = append(visible, cc[i])
 	}
+	return visible, nil
 }
 
 func submitHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		login := getLoginUser(r, db)
+		site := querySite(db)
 
 		var e Entry
 		var tags string
 
+		allcats, err := queryCats(db)
+		if handleDbErr(w, err, "submithandler") {
+			return
+		}
+		cats := postableCats(site, login, allcats)
+
 		catid := idtoi(r.FormValue("cat"))
 		if catid == -1 {
 			catid = 1
 		}
+		if !catsContain(cats, catid) && len(cats) > 0 && r.Method != "POST" {
+			catid = cats[0].Catid
+		}
 
 		var errmsg string
 		if r.Method == "POST" {
 			if !validateLogin(w, login) {
 				return
 			}
-
-		SUBMIT_FOR:
 			for {
 				e.Title = strings.TrimSpace(r.FormValue("title"))
 				e.Url = strings.TrimSpace(r.FormValue("url"))
 				e.Body = strings.TrimSpace(r.FormValue("body"))
 				tags = strings.TrimSpace(r.FormValue("tags"))
-				if e.Title == "" {
+				if e.Title == "" && e.Url == "" {
 					errmsg = "Please enter a title."
 					break
 				}
@@ -1750,148 +2104,83 @@ func submitHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 					errmsg = "Please enter a url or text writeup."
 					break
 				}
-
-				e.Body = strings.ReplaceAll(e.Body, "\r", "") // CRLF => CR
-				e.Createdt = time.Now().Format(time.RFC3339)
-
-				s := "INSERT INTO entry (thing, title, url, body, createdt, user_id) VALUES (?, ?, ?, ?, ?, ?)"
-				result, err := sqlexec(db, s, SUBMISSION, e.Title, e.Url, e.Body, e.Createdt, login.Userid)
-				if err != nil {
-					log.Printf("DB error creating submission (%s)\n", err)
-					errmsg = "A problem occured. Please try again."
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
 					break
 				}
-				newid, err := result.LastInsertId()
-				if err != nil {
-					log.Printf("DB error getting LastInsertId() (%s)\n", err)
-					http.Redirect(w, r, "/", http.StatusSeeOther)
-					return
+				if !catsContain(cats, catid) {
+					errmsg = "You can't post to that category."
+					break
 				}
-
-				// Set category
-				s = "INSERT INTO entrycat (entry_id, cat_id) VALUES (?, ?)"
-				_, err = sqlexec(db, s, newid, catid)
+				tt, blocked, err := resolveTags(db, parseTags(tags))
 				if err != nil {
-					log.Printf("DB error setting submission category (%s)\n", err)
+					log.Printf("DB error resolving tags (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
+				if len(blocked) > 0 {
+					errmsg = blockedTagsErrmsg(blocked)
+					break
+				}
 
-				// Add entry tags
-				tt := strings.Split(tags, ",")
-				for _, t := range tt {
-					t = strings.TrimSpace(t)
-					if t == "" {
-						continue
-					}
-					s := "INSERT INTO entrytag (entry_id, tag) VALUES (?, ?)"
-					_, err := sqlexec(db, s, newid, t)
+				// Repost of a recent url goes to the existing submission.
+				dupid, err := queryDuplicateUrl(db, site, e.Url)
+				if err != nil {
+					log.Printf("DB error checking for duplicate url (%s)\n", err)
+				}
+				if dupid != -1 {
+					err := repostSubmission(db, login, dupid)
 					if err != nil {
-						log.Printf("DB error adding tag (%s)\n", err)
-						errmsg = "A problem occured. Please try again."
-						break SUBMIT_FOR
+						log.Printf("DB error voting for reposted submission (%s)\n", err)
 					}
+					http.Redirect(w, r, createItemUrl(dupid), http.StatusSeeOther)
+					return
 				}
 
-				http.Redirect(w, r, createItemUrl(newid), http.StatusSeeOther)
-				return
-			}
-		}
-
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-		fmt.Fprintf(w, "<section class=\"main\">\n")
-
-		fmt.Fprintf(w, "<form class=\"simpleform mb-2xl\" method=\"post\" action=\"/submit/\">\n")
-		if login.Userid == -1 || !login.Active {
-			fmt.Fprintf(w, "<div class=\"control text-sm text-fade-2 text-italic\">\n")
-			fmt.Fprintf(w, "<label><a href=\"/login/?from=%s\">Log in</a> to post a comment.</label>\n", url.QueryEscape(r.RequestURI))
-			fmt.Fprintf(w, "</div>\n")
-
-			fmt.Fprintf(w, "</form>\n")
-			fmt.Fprintf(w, "</section>\n")
-			printPageFoot(w)
-			return
-		}
-
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"title\">title</label>\n")
-		fmt.Fprintf(w, "<input id=\"title\" name=\"title\" type=\"text\" size=\"60\" maxlength=\"256\" value=\"%s\">\n", escape(e.Title))
-		fmt.Fprintf(w, "</div>\n")
+				errmsg = checkRateLimit(db, site, r, login, RATE_SUBMIT)
+				if errmsg != "" {
+					break
+				}
 
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"url\">url</label>\n")
-		fmt.Fprintf(w, "<input id=\"url\" name=\"url\" type=\"text\" size=\"60\" value=\"%s\">\n", escape(e.Url))
-		fmt.Fprintf(w, "</div>\n")
+				// Title is taken from the page if left blank.
+				fetchEntryMeta(r.Context(), &e)
+				if e.Title == "" {
+					errmsg = "Couldn't get the title from the url. Please enter a title."
+					break
+				}
 
-		fmt.Fprintf(w, "  <div class=\"control\">\n")
-		fmt.Fprintf(w, "    <label for=\"body\">text</label>\n")
-		fmt.Fprintf(w, "    <textarea id=\"body\" name=\"body\" rows=\"6\" cols=\"60\">%s</textarea>\n", e.Body)
-		fmt.Fprintf(w, "  </div>\n")
+				e.Userid = login.Userid
+				newid, err := createSubmission(db, &e, catid, tt)
+				if err != nil {
+					log.Printf("DB error creating submission (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
 
-		fmt.Fprintf(w, "  <div class=\"control\">\n")
-		fmt.Fprintf(w, "    <label for=\"cat\">category</label>\n")
-		fmt.Fprintf(w, "    <select id=\"cat\" name=\"cat\">\n")
-		var cat Cat
-		s := "SELECT cat_id, name FROM cat ORDER BY cat_id"
-		rows, err := db.Query(s)
-		if handleDbErr(w, err, "submithandler") {
-			return
-		}
-		for rows.Next() {
-			rows.Scan(&cat.Catid, &cat.Name)
-			if cat.Catid == catid {
-				fmt.Fprintf(w, "<option value=\"%d\" selected>%s</option>\n", cat.Catid, escape(cat.Name))
-				continue
+				http.Redirect(w, r, createItemUrl(newid), http.StatusSeeOther)
+				return
 			}
-			fmt.Fprintf(w, "<option value=\"%d\">%s</option>\n", cat.Catid, escape(cat.Name))
 		}
-		fmt.Fprintf(w, "    </select>\n")
-		fmt.Fprintf(w, "  </div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"tags\">tags</label>\n")
-		fmt.Fprintf(w, "<input id=\"tags\" name=\"tags\" type=\"text\" size=\"60\" maxlength=\"256\" value=\"%s\">\n", escape(tags))
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "  <div class=\"control\">\n")
-		fmt.Fprintf(w, "    <button class=\"submit\">submit</button>\n")
-		fmt.Fprintf(w, "  </div>\n")
-
-		fmt.Fprintf(w, "</form>\n")
-		fmt.Fprintf(w, "</section>\n")
-		printPageFoot(w)
-	}
-}
-
-func delEntry(tx *sql.Tx, db *sql.DB, entryid int64) error {
-	s := "DELETE FROM entry WHERE entry_id = ?"
-	_, err := txexec(tx, s, entryid)
-	if err != nil {
-		return err
-	}
 
-	// Delete children of entry recursively.
-	s = "SELECT entry_id FROM entry WHERE parent_id = ?"
-	rows, err := db.Query(s, entryid)
-	for rows.Next() {
-		var childid int64
-		rows.Scan(&childid)
-		err = delEntry(tx, db, childid)
+		// Existing tags for autocomplete.
+		taglist, err := queryTagNames(db, TAG_COMPLETE_LIMIT)
 		if err != nil {
-			return err
+			log.Printf("submithandler: DB error querying tags (%s)\n", err)
 		}
-	}
 
-	return nil
+		p := newPage(r, db, login, site)
+		p.Jsurls = []string{staticUrl("tagcomplete.js")}
+		data := struct {
+			Page
+			Entry   Entry
+			Catid   int64
+			Cats    []Cat
+			Tags    string
+			Taglist []string
+		}{p, e, catid, cats, tags, taglist}
+		data.Errmsg = errmsg
+		renderPage(w, "submit.html", data)
+	}
 }
 
 func delHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
@@ -1905,21 +2194,26 @@ func delHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 
 		qfrom := r.FormValue("from")
 
-		var e Entry
-		s := "SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.createdt, e.user_id FROM entry e WHERE e.entry_id = ?"
-		row := db.QueryRow(s, qentryid)
-		err := row.Scan(&e.Entryid, &e.Thing, &e.Title, &e.Url, &e.Body, &e.Createdt, &e.Userid)
-		if handleDbErr(w, err, "itemhandler") {
+		e, err := queryEntry(db, qentryid)
+		if handleDbErr(w, err, "delhandler") {
 			return
 		}
-		if login.Userid != ADMIN_ID && e.Userid != login.Userid {
-			http.Error(w, "admin or entry submitter required", 401)
+		catid, err := queryEntryCatid(db, e.Entryid)
+		if handleDbErr(w, err, "delhandler") {
+			return
+		}
+		if !canEditEntry(login, e.Userid, catid) {
+			http.Error(w, "moderator or entry submitter required", 401)
 			return
 		}
 
 		var errmsg string
 		if r.Method == "POST" {
 			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
 				tx, err := db.Begin()
 				if err != nil {
 					log.Printf("DB error creating transaction (%s)\n", err)
@@ -1927,7 +2221,7 @@ func delHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 					break
 				}
 
-				err = delEntry(tx, db, qentryid)
+				err = delEntry(tx, qentryid, login.Userid)
 				if err != nil {
 					log.Printf("DB error deleting entry (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
@@ -1940,47 +2234,20 @@ func delHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 					errmsg = "A problem occured. Please try again."
 					break
 				}
+				logAudit(db, login, AUDIT_DEL_ENTRY, AUDIT_ENTRY, e.Entryid, entrySummary(e), entryAuditFields(e), nil, parseReason(r))
 
 				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
 				return
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-		fmt.Fprintf(w, "<section class=\"main\">\n")
-
-		fmt.Fprintf(w, "<form class=\"simpleform mb-2xl\" method=\"post\" action=\"/del/?id=%d&from=%s\">\n", qentryid, url.QueryEscape(qfrom))
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-
-		fmt.Fprintf(w, "<div class=\"control displayonly\">\n")
-		fmt.Fprintf(w, "<label for=\"title\">title</label>\n")
-		fmt.Fprintf(w, "<input id=\"title\" name=\"title\" type=\"text\" size=\"60\" maxlength=\"256\" value=\"%s\" readonly>\n", e.Title)
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control displayonly\">\n")
-		fmt.Fprintf(w, "<label for=\"url\">url</label>\n")
-		fmt.Fprintf(w, "<input id=\"url\" name=\"url\" type=\"text\" size=\"60\" value=\"%s\" readonly>\n", e.Url)
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "  <div class=\"control displayonly\">\n")
-		fmt.Fprintf(w, "    <label for=\"body\">text</label>\n")
-		fmt.Fprintf(w, "    <textarea id=\"body\" name=\"body\" rows=\"6\" cols=\"60\" readonly>%s</textarea>\n", e.Body)
-		fmt.Fprintf(w, "  </div>\n")
-
-		fmt.Fprintf(w, "  <div class=\"control\">\n")
-		fmt.Fprintf(w, "    <button class=\"submit\">delete</button>\n")
-		fmt.Fprintf(w, "  </div>\n")
-		fmt.Fprintf(w, "</form>\n")
-
-		fmt.Fprintf(w, "</section>\n")
-		printPageFoot(w)
+		data := struct {
+			Page
+			Entry *Entry
+			From  string
+		}{newPage(r, db, login, querySite(db)), e, qfrom}
+		data.Errmsg = errmsg
+		renderPage(w, "del.html", data)
 	}
 }
 
@@ -1994,14 +2261,21 @@ func editHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 
 		var e Entry
 		var catid int64
-		s := "SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.createdt, e.user_id, IFNULL(ec.cat_id, 0) FROM entry e LEFT OUTER JOIN entrycat ec ON e.entry_id = ec.entry_id WHERE e.entry_id = ?"
+		s := "SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.description, e.thumburl, e.createdt, e.user_id, IFNULL(ec.cat_id, 0) FROM entry e LEFT OUTER JOIN entrycat ec ON e.entry_id = ec.entry_id WHERE e.entry_id = ? AND e.deleted = 0"
 		row := db.QueryRow(s, qentryid)
-		err := row.Scan(&e.Entryid, &e.Thing, &e.Title, &e.Url, &e.Body, &e.Createdt, &e.Userid, &catid)
+		err := row.Scan(&e.Entryid, &e.Thing, &e.Title, &e.Url, &e.Body, &e.Description, &e.Thumburl, &e.Createdt, &e.Userid, &catid)
 		if handleDbErr(w, err, "edithandler") {
 			return
 		}
-		if login.Userid != ADMIN_ID && login.Userid != e.Userid {
-			http.Error(w, "admin user or entry submitter required", 401)
+		if e.Thing == COMMENT {
+			catid, err = queryEntryCatid(db, e.Entryid)
+			if handleDbErr(w, err, "edithandler") {
+				return
+			}
+		}
+		oldcatid := catid
+		if !canEditEntry(login, e.Userid, catid) {
+			http.Error(w, "moderator or entry submitter required", 401)
 			return
 		}
 
@@ -2013,10 +2287,64 @@ func editHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		}
 		tags := strings.Join(tt, ", ")
 
+		// Submission can stay in its category, or move to one the user can post to.
+		site := querySite(db)
+		var cats []Cat
+		allcats, err := queryCats(db)
+		if handleDbErr(w, err, "edithandler") {
+			return
+		}
+		for i := range allcats {
+			if allcats[i].Catid == oldcatid || canPostToCat(site, login, &allcats[i]) {
+				cats = append(cats, allcats[i])
+			}
+		}
+
+		// Edits are kept as revisions, and audited when by moderators of someone else's entry.
+		olde := e
+		oldtags := tags
+
 		var errmsg string
 		if r.Method == "POST" {
-		SUBMIT_FOR:
 			for {
+				// Comments only have a body to edit.
+				if e.Thing == COMMENT {
+					e.Body = strings.TrimSpace(r.FormValue("body"))
+					if e.Body == "" {
+						errmsg = "Please enter a comment."
+						break
+					}
+					if !checkCsrf(r, login) {
+						errmsg = CSRF_ERRMSG
+						break
+					}
+					e.Body = strings.ReplaceAll(e.Body, "\r", "") // CRLF => CR
+
+					s := "UPDATE entry SET body = ? WHERE entry_id = ?"
+					_, err = sqlexec(db, s, e.Body, qentryid)
+					if err != nil {
+						log.Printf("DB error updating comment (%s)\n", err)
+						errmsg = "A problem occured. Please try again."
+						break
+					}
+
+					err = indexEntrySearch(db, qentryid, "", e.Body, "")
+					if err != nil {
+						log.Printf("DB error indexing comment for search (%s)\n", err)
+					}
+					_, err = addEntryRevision(db, &olde, &e, login.Userid)
+					if err != nil {
+						log.Printf("DB error adding comment revision (%s)\n", err)
+					}
+					if login.Userid != e.Userid {
+						logAudit(db, login, AUDIT_EDIT_ENTRY, AUDIT_ENTRY, qentryid, entrySummary(&olde), entryAuditFields(&olde), entryAuditFields(&e), parseReason(r))
+					}
+
+					http.Redirect(w, r, createItemUrl(qentryid), http.StatusSeeOther)
+					return
+				}
+
+				oldurl := e.Url
 				e.Title = strings.TrimSpace(r.FormValue("title"))
 				e.Url = strings.TrimSpace(r.FormValue("url"))
 				e.Body = strings.TrimSpace(r.FormValue("body"))
@@ -2030,18 +2358,50 @@ func editHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 					errmsg = "Please enter a url or text writeup."
 					break
 				}
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+				if !catsContain(cats, catid) {
+					errmsg = "You can't post to that category."
+					break
+				}
+				tt, blocked, err := resolveTags(db, parseTags(tags))
+				if err != nil {
+					log.Printf("DB error resolving tags (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				if len(blocked) > 0 {
+					errmsg = blockedTagsErrmsg(blocked)
+					break
+				}
 
 				e.Body = strings.ReplaceAll(e.Body, "\r", "") // CRLF => CR
 				e.Createdt = time.Now().Format(time.RFC3339)
+				if e.Url != oldurl {
+					e.Description = ""
+					e.Thumburl = ""
+					fetchEntryMeta(r.Context(), &e)
+				}
 
-				s := "UPDATE entry SET title = ?, url = ?, body = ? WHERE entry_id = ?"
-				_, err = sqlexec(db, s, e.Title, e.Url, e.Body, qentryid)
+				s := "UPDATE entry SET title = ?, url = ?, normurl = ?, body = ?, description = ?, thumburl = ? WHERE entry_id = ?"
+				_, err = sqlexec(db, s, e.Title, e.Url, normalizeUrl(e.Url), e.Body, e.Description, e.Thumburl, qentryid)
 				if err != nil {
 					log.Printf("DB error updating submission (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
 
+				err = indexEntrySearch(db, qentryid, e.Title, e.Body, e.Url)
+				if err != nil {
+					log.Printf("DB error indexing submission for search (%s)\n", err)
+				}
+				_, err = addEntryRevision(db, &olde, &e, login.Userid)
+				if err != nil {
+					log.Printf("DB error adding submission revision (%s)\n", err)
+				}
+
 				// Set category
 				s = "UPDATE entrycat SET cat_id = ? WHERE entry_id = ?"
 				_, err = sqlexec(db, s, catid, qentryid)
@@ -2052,27 +2412,16 @@ func editHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 				}
 
 				// Update entry tags
-				s = "DELETE FROM entrytag WHERE entry_id = ?"
-				_, err = sqlexec(db, s, qentryid)
+				err = updateEntryTags(db, qentryid, tt)
 				if err != nil {
-					log.Printf("DB error deleting existing entry tags (%s)\n", err)
+					log.Printf("DB error updating entry tags (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
-
-				tt := strings.Split(tags, ",")
-				for _, t := range tt {
-					t = strings.TrimSpace(t)
-					if t == "" {
-						continue
-					}
-					s := "INSERT INTO entrytag (entry_id, tag) VALUES (?, ?)"
-					_, err := sqlexec(db, s, qentryid, t)
-					if err != nil {
-						log.Printf("DB error adding tag (%s)\n", err)
-						errmsg = "A problem occured. Please try again."
-						break SUBMIT_FOR
-					}
+				if login.Userid != e.Userid {
+					before := submissionAuditFields(&olde, oldcatid, oldtags)
+					after := submissionAuditFields(&e, catid, strings.Join(tt, ", "))
+					logAudit(db, login, AUDIT_EDIT_ENTRY, AUDIT_ENTRY, qentryid, entrySummary(&olde), before, after, parseReason(r))
 				}
 
 				http.Redirect(w, r, createItemUrl(qentryid), http.StatusSeeOther)
@@ -2080,275 +2429,184 @@ func editHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-		fmt.Fprintf(w, "<section class=\"main\">\n")
-
-		fmt.Fprintf(w, "<form class=\"simpleform mb-2xl\" method=\"post\" action=\"/edit/?id=%d\">\n", qentryid)
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"title\">title</label>\n")
-		fmt.Fprintf(w, "<input id=\"title\" name=\"title\" type=\"text\" size=\"60\" maxlength=\"256\" value=\"%s\">\n", escape(e.Title))
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"url\">url</label>\n")
-		fmt.Fprintf(w, "<input id=\"url\" name=\"url\" type=\"text\" size=\"60\" value=\"%s\">\n", escape(e.Url))
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "  <div class=\"control\">\n")
-		fmt.Fprintf(w, "    <label for=\"body\">text</label>\n")
-		fmt.Fprintf(w, "    <textarea id=\"body\" name=\"body\" rows=\"6\" cols=\"60\">%s</textarea>\n", e.Body)
-		fmt.Fprintf(w, "  </div>\n")
-
-		fmt.Fprintf(w, "  <div class=\"control\">\n")
-		fmt.Fprintf(w, "    <label for=\"cat\">category</label>\n")
-		fmt.Fprintf(w, "    <select id=\"cat\" name=\"cat\">\n")
-		var cat Cat
-		s = "SELECT cat_id, name FROM cat ORDER BY cat_id"
-		rows, err := db.Query(s)
-		if handleDbErr(w, err, "submithandler") {
-			return
-		}
-		for rows.Next() {
-			rows.Scan(&cat.Catid, &cat.Name)
-			if cat.Catid == catid {
-				fmt.Fprintf(w, "<option value=\"%d\" selected>%s</option>\n", cat.Catid, escape(cat.Name))
-				continue
-			}
-			fmt.Fprintf(w, "<option value=\"%d\">%s</option>\n", cat.Catid, escape(cat.Name))
+		// Existing tags for autocomplete.
+		taglist, err := queryTagNames(db, TAG_COMPLETE_LIMIT)
+		if err != nil {
+			log.Printf("edithandler: DB error querying tags (%s)\n", err)
 		}
-		fmt.Fprintf(w, "    </select>\n")
-		fmt.Fprintf(w, "  </div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"tags\">tags</label>\n")
-		fmt.Fprintf(w, "<input id=\"tags\" name=\"tags\" type=\"text\" size=\"60\" maxlength=\"256\" value=\"%s\">\n", escape(tags))
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "  <div class=\"control\">\n")
-		fmt.Fprintf(w, "    <button class=\"submit\">submit</button>\n")
-		fmt.Fprintf(w, "  </div>\n")
-		fmt.Fprintf(w, "</form>\n")
-
-		fmt.Fprintf(w, "</section>\n")
-		printPageFoot(w)
-	}
-}
 
-func decryptVoteTok(tok string) (int64, int64) {
-	// When decrypted, tok takes the format: <entryid>:<userid>.
-	// Ex. 123:12  where entryid = 123, userid = 12
-	parms := decryptString(tok)
-	sre := `^(\d+):(\d+)$`
-	re := regexp.MustCompile(sre)
-	matches := re.FindStringSubmatch(parms)
-	if matches == nil {
-		return -1, -1
+		p := newPage(r, db, login, site)
+		p.Jsurls = []string{staticUrl("tagcomplete.js")}
+		data := struct {
+			Page
+			Entry   Entry
+			Catid   int64
+			Cats    []Cat
+			Tags    string
+			Taglist []string
+		}{p, e, catid, cats, tags, taglist}
+		data.Errmsg = errmsg
+		renderPage(w, "edit.html", data)
 	}
-
-	entryid := idtoi(matches[1])
-	userid := idtoi(matches[2])
-	return entryid, userid
 }
 
 func voteHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		//todo authenticate request
-		qtok := r.FormValue("tok")
-		if qtok == "" {
-			log.Printf("voteHandler: tok required\n")
-			http.Error(w, "tok required", 401)
-			return
-		}
-
-		entryid, userid := decryptVoteTok(qtok)
-		if entryid == -1 || userid == -1 {
-			log.Printf("voteHandler: invalid tok format\n")
-			http.Error(w, "invalid tok format", 401)
-			return
-		}
-
-		e, err := queryEntry(db, entryid)
-		if err != nil {
-			log.Printf("voteHandler: DB error (%s)\n", err)
-			http.Error(w, "Server error", 500)
-			return
-		}
-		if e == nil {
-			log.Printf("voteHandler: entryid %d doesn't exist\n", entryid)
-			http.Error(w, "entryid doesn't exist", 401)
-			return
-		}
-
-		u := queryUser(db, userid)
-		if u.Userid == -1 {
-			log.Printf("voteHandler: userid %d doesn't exist\n", userid)
-			http.Error(w, "user doesn't exist", 401)
-			return
-		}
-
-		s := "INSERT OR REPLACE INTO entryvote (entry_id, user_id) VALUES (?, ?)"
-		_, err = sqlexec(db, s, entryid, userid)
-		if err != nil {
-			log.Printf("voteHandler: DB error (%s)\n", err)
-			http.Error(w, "Server error", 500)
-			return
-		}
-
-		var votes int
-		s = "SELECT IFNULL(totalvotes.votes, 0) AS votes FROM entry e LEFT OUTER JOIN totalvotes ON e.entry_id = totalvotes.entry_id WHERE e.entry_id = ?"
-		row := db.QueryRow(s, entryid)
-		err = row.Scan(&votes)
-		if handleDbErr(w, err, "votehandler") {
-			return
-		}
-
-		vr := VoteResult{
-			Entryid:    entryid,
-			Userid:     userid,
-			TotalVotes: votes,
-		}
-		bs, _ := json.Marshal(vr)
-		w.WriteHeader(200)
-		w.Write(bs)
+		handleVote(w, r, db, true)
 	}
 }
 
 func unvoteHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		//todo authenticate request
-		qtok := r.FormValue("tok")
-		if qtok == "" {
-			log.Printf("unvoteHandler: tok required\n")
-			http.Error(w, "tok required", 401)
-			return
-		}
+		handleVote(w, r, db, false)
+	}
+}
 
-		entryid, userid := decryptVoteTok(qtok)
-		if entryid == -1 || userid == -1 {
-			log.Printf("unvoteHandler: invalid tok format\n")
-			http.Error(w, "invalid tok format", 401)
-			return
-		}
+// POST /vote/ or /unvote/ with entryid and csrftok parameters.
+// /vote/ takes dir=-1 for a down vote.
+func handleVote(w http.ResponseWriter, r *http.Request, db *sql.DB, isvote bool) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", 405)
+		return
+	}
 
-		e, err := queryEntry(db, entryid)
-		if err != nil {
-			log.Printf("unvoteHandler: DB error (%s)\n", err)
-			http.Error(w, "Server error", 500)
-			return
-		}
-		if e == nil {
-			log.Printf("unvoteHandler: entryid %d doesn't exist\n", entryid)
-			http.Error(w, "entryid doesn't exist", 401)
-			return
-		}
+	login := getLoginUser(r, db)
+	if !validateLogin(w, login) {
+		return
+	}
+	if !validateCsrf(w, r, login) {
+		return
+	}
 
-		u := queryUser(db, userid)
-		if u.Userid == -1 {
-			log.Printf("unvoteHandler: userid %d doesn't exist\n", userid)
-			http.Error(w, "user doesn't exist", 401)
-			return
-		}
+	entryid := idtoi(r.FormValue("entryid"))
+	if !validateIdParm(w, entryid) {
+		return
+	}
+	e, err := queryEntry(db, entryid)
+	if handleDbErr(w, err, "handleVote") {
+		return
+	}
 
-		s := "DELETE FROM entryvote WHERE entry_id = ? AND user_id = ?"
-		_, err = sqlexec(db, s, entryid, userid)
-		if err != nil {
-			log.Printf("unvoteHandler: DB error (%s)\n", err)
-			http.Error(w, "Server error", 500)
-			return
+	dir := 0
+	if isvote {
+		dir = 1
+		if r.FormValue("dir") == "-1" {
+			dir = -1
 		}
+	}
+	if dir == -1 && !canDownvote(querySite(db), login, e.Userid) {
+		http.Error(w, "Not enough karma to down vote.", 403)
+		return
+	}
 
-		var votes int
-		s = "SELECT IFNULL(totalvotes.votes, 0) AS votes FROM entry e LEFT OUTER JOIN totalvotes ON e.entry_id = totalvotes.entry_id WHERE e.entry_id = ?"
-		row := db.QueryRow(s, entryid)
-		err = row.Scan(&votes)
-		if handleDbErr(w, err, "unvotehandler") {
-			return
-		}
+	if isvote {
+		err = voteEntry(db, entryid, login.Userid, dir)
+	} else {
+		err = unvoteEntry(db, entryid, login.Userid)
+	}
+	if err != nil {
+		log.Printf("handleVote: DB error (%s)\n", err)
+		http.Error(w, "Server error", 500)
+		return
+	}
 
-		vr := VoteResult{
-			Entryid:    entryid,
-			Userid:     userid,
-			TotalVotes: votes,
-		}
-		bs, _ := json.Marshal(vr)
-		w.WriteHeader(200)
-		w.Write(bs)
+	votes, err := queryTotalVotes(db, entryid)
+	if handleDbErr(w, err, "handleVote") {
+		return
+	}
+
+	vr := VoteResult{
+		Entryid:    entryid,
+		Userid:     login.Userid,
+		TotalVotes: votes,
+		Dir:        dir,
 	}
+	bs, _ := json.Marshal(vr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(bs)
 }
 
 func createcatHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errmsg string
 		var cat Cat
+		var mods string
+		cat.Gravityf = -1
 
 		qfrom := r.FormValue("from")
 
 		login := getLoginUser(r, db)
-		if login.Userid != ADMIN_ID {
-			log.Printf("create cat: admin not logged in\n")
+		if !isAdmin(login) {
+			logDebugf("create cat: admin not logged in\n")
 			http.Error(w, "admin required", 401)
 			return
 		}
 
 		if r.Method == "POST" {
 			cat.Name = strings.TrimSpace(r.FormValue("name"))
+			cat.Desc = strings.TrimSpace(r.FormValue("desc"))
+			cat.Gravityf = parseCatGravityf(r.FormValue("gravityf"))
+			cat.Postpolicy = atoi(r.FormValue("postpolicy"))
+			mods = r.FormValue("mods")
 
 			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
 				if cat.Name == "" {
 					errmsg = "Please enter a category name."
 					break
 				}
+				if !isValidPostPolicy(cat.Postpolicy) {
+					cat.Postpolicy = CAT_POST_OPEN
+				}
+				modids, err := parseCatMods(db, mods)
+				if err != nil {
+					errmsg = err.Error()
+					break
+				}
 
-				var err error
-				s := "INSERT INTO cat (name) VALUES (?)"
-				_, err = sqlexec(db, s, cat.Name)
+				tx, err := db.Begin()
+				if err == nil {
+					var result sql.Result
+					s := "INSERT INTO cat (name, desc, gravityf, postpolicy) VALUES (?, ?, ?, ?)"
+					result, err = txexec(tx, s, cat.Name, cat.Desc, cat.Gravityf, cat.Postpolicy)
+					if err == nil {
+						cat.Catid, err = result.LastInsertId()
+					}
+					if err == nil {
+						err = updateCatMods(tx, cat.Catid, modids)
+					}
+					if err == nil {
+						err = tx.Commit()
+					} else {
+						tx.Rollback()
+					}
+				}
 				if err != nil {
 					log.Printf("DB error creating cat: %s\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
+				uu, _ := queryCatMods(db, cat.Catid)
+				logAudit(db, login, AUDIT_CREATE_CAT, AUDIT_CAT, cat.Catid, cat.Name, nil, catAuditFields(&cat, joinCatMods(uu)), parseReason(r))
 
 				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
 				return
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-
-		fmt.Fprintf(w, "<div class=\"main\">\n")
-		fmt.Fprintf(w, "<section class=\"main-content\">\n")
-		fmt.Fprintf(w, "<form class=\"simpleform\" action=\"/createcat/?from=%s\" method=\"post\">\n", url.QueryEscape(qfrom))
-		fmt.Fprintf(w, "<h1 class=\"heading\">Create Category</h1>")
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"name\">category name</label>\n")
-		fmt.Fprintf(w, "<input id=\"name\" name=\"name\" type=\"text\" size=\"20\" maxlength=\"20\" value=\"%s\">\n", escape(cat.Name))
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<button class=\"submit\">create category</button>\n")
-		fmt.Fprintf(w, "</div>\n")
-		fmt.Fprintf(w, "</form>\n")
-		fmt.Fprintf(w, "</section>\n")
-
-		fmt.Fprintf(w, "</div>\n")
-		printPageFoot(w)
+		data := struct {
+			Page
+			Cat      *Cat
+			Mods     string
+			Policies []int
+			From     string
+		}{newPage(r, db, login, querySite(db)), &cat, mods, catPostPolicies, qfrom}
+		data.Errmsg = errmsg
+		renderPage(w, "createcat.html", data)
 	}
 }
 
@@ -2359,75 +2617,93 @@ func editcatHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		qfrom := r.FormValue("from")
 		qcatid := idtoi(r.FormValue("catid"))
 		if qcatid == -1 {
-			log.Printf("edit cat: no catid\n")
+			logDebugf("edit cat: no catid\n")
 			http.Error(w, "missing catid parameter", 401)
 			return
 		}
 
 		login := getLoginUser(r, db)
-		if login.Userid != ADMIN_ID {
-			log.Printf("edit cat: admin not logged in\n")
+		if !isAdmin(login) {
+			logDebugf("edit cat: admin not logged in\n")
 			http.Error(w, "admin required", 401)
 			return
 		}
 
 		cat := queryCat(db, qcatid)
 		if cat == nil {
-			log.Printf("edit cat: catid %d doesn't exist\n", qcatid)
+			logDebugf("edit cat: catid %d doesn't exist\n", qcatid)
 			http.Error(w, "cat doesn't exist", 401)
 			return
 		}
 
+		uu, err := queryCatMods(db, qcatid)
+		if handleDbErr(w, err, "editcathandler") {
+			return
+		}
+		mods := joinCatMods(uu)
+		oldcat := *cat
+		oldmods := mods
+
 		if r.Method == "POST" {
 			cat.Name = strings.TrimSpace(r.FormValue("name"))
+			cat.Desc = strings.TrimSpace(r.FormValue("desc"))
+			cat.Gravityf = parseCatGravityf(r.FormValue("gravityf"))
+			cat.Postpolicy = atoi(r.FormValue("postpolicy"))
+			mods = r.FormValue("mods")
 
 			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
 				if cat.Name == "" {
 					errmsg = "Please enter a category name."
 					break
 				}
+				if !isValidPostPolicy(cat.Postpolicy) {
+					cat.Postpolicy = CAT_POST_OPEN
+				}
+				modids, err := parseCatMods(db, mods)
+				if err != nil {
+					errmsg = err.Error()
+					break
+				}
 
-				var err error
-				s := "UPDATE cat SET name = ? WHERE cat_id = ?"
-				_, err = sqlexec(db, s, cat.Name, qcatid)
+				tx, err := db.Begin()
+				if err == nil {
+					s := "UPDATE cat SET name = ?, desc = ?, gravityf = ?, postpolicy = ? WHERE cat_id = ?"
+					_, err = txexec(tx, s, cat.Name, cat.Desc, cat.Gravityf, cat.Postpolicy, qcatid)
+					if err == nil {
+						err = updateCatMods(tx, qcatid, modids)
+					}
+					if err == nil {
+						err = tx.Commit()
+					} else {
+						tx.Rollback()
+					}
+				}
 				if err != nil {
 					log.Printf("DB error updating cat: %s\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
+				uu, _ := queryCatMods(db, qcatid)
+				logAudit(db, login, AUDIT_EDIT_CAT, AUDIT_CAT, qcatid, oldcat.Name, catAuditFields(&oldcat, oldmods), catAuditFields(cat, joinCatMods(uu)), parseReason(r))
 
 				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
 				return
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-
-		fmt.Fprintf(w, "<div class=\"main\">\n")
-		fmt.Fprintf(w, "<section class=\"main-content\">\n")
-		fmt.Fprintf(w, "<form class=\"simpleform\" action=\"/editcat/?catid=%d&from=%s\" method=\"post\">\n", qcatid, url.QueryEscape(qfrom))
-		fmt.Fprintf(w, "<h1 class=\"heading\">Edit Category</h1>")
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<label for=\"name\">category name</label>\n")
-		fmt.Fprintf(w, "<input id=\"name\" name=\"name\" type=\"text\" size=\"20\" maxlength=\"20\" value=\"%s\">\n", escape(cat.Name))
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<button class=\"submit\">update category</button>\n")
-		fmt.Fprintf(w, "</div>\n")
-		fmt.Fprintf(w, "</form>\n")
-		fmt.Fprintf(w, "</section>\n")
-
-		fmt.Fprintf(w, "</div>\n")
-		printPageFoot(w)
+		data := struct {
+			Page
+			Cat      *Cat
+			Mods     string
+			Policies []int
+			From     string
+		}{newPage(r, db, login, querySite(db)), cat, mods, catPostPolicies, qfrom}
+		data.Errmsg = errmsg
+		renderPage(w, "editcat.html", data)
 	}
 }
 
@@ -2438,27 +2714,35 @@ func delcatHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		qfrom := r.FormValue("from")
 		qcatid := idtoi(r.FormValue("catid"))
 		if qcatid == -1 {
-			log.Printf("del cat: no catid\n")
+			logDebugf("del cat: no catid\n")
 			http.Error(w, "missing catid parameter", 401)
 			return
 		}
 
 		login := getLoginUser(r, db)
-		if login.Userid != ADMIN_ID {
-			log.Printf("del cat: admin not logged in\n")
+		if !isAdmin(login) {
+			logDebugf("del cat: admin not logged in\n")
 			http.Error(w, "admin required", 401)
 			return
 		}
 
 		cat := queryCat(db, qcatid)
 		if cat == nil {
-			log.Printf("del cat: catid %d doesn't exist\n", qcatid)
+			logDebugf("del cat: catid %d doesn't exist\n", qcatid)
 			http.Error(w, "cat doesn't exist", 401)
 			return
 		}
+		uu, err := queryCatMods(db, qcatid)
+		if handleDbErr(w, err, "delcathandler") {
+			return
+		}
 
 		if r.Method == "POST" {
 			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
 				var err error
 				s := "DELETE FROM cat WHERE cat_id = ?"
 				_, err = sqlexec(db, s, qcatid)
@@ -2476,52 +2760,138 @@ func delcatHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 					break
 				}
 
+				s = "DELETE FROM catmod WHERE cat_id = ?"
+				_, err = sqlexec(db, s, qcatid)
+				if err != nil {
+					log.Printf("DB error deleting catmod: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				logAudit(db, login, AUDIT_DEL_CAT, AUDIT_CAT, qcatid, cat.Name, catAuditFields(cat, joinCatMods(uu)), nil, parseReason(r))
+
 				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
 				return
 			}
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		site := querySite(db)
-		printPageHead(w, nil, nil, site)
-		printPageNav(w, db, login, site, nil)
-
-		fmt.Fprintf(w, "<div class=\"main\">\n")
-		fmt.Fprintf(w, "<section class=\"main-content\">\n")
-		fmt.Fprintf(w, "<form class=\"simpleform\" action=\"/delcat/?catid=%d&from=%s\" method=\"post\">\n", qcatid, url.QueryEscape(qfrom))
-		fmt.Fprintf(w, "<h1 class=\"heading\">Delete Category</h1>")
-		if errmsg != "" {
-			fmt.Fprintf(w, "<div class=\"control\">\n")
-			fmt.Fprintf(w, "<p class=\"error\">%s</p>\n", errmsg)
-			fmt.Fprintf(w, "</div>\n")
-		}
-		fmt.Fprintf(w, "<div class=\"control displayonly\">\n")
-		fmt.Fprintf(w, "<label for=\"name\">category name</label>\n")
-		fmt.Fprintf(w, "<input id=\"name\" name=\"name\" type=\"text\" size=\"20\" maxlength=\"20\" readonly value=\"%s\">\n", escape(cat.Name))
-		fmt.Fprintf(w, "</div>\n")
-
-		fmt.Fprintf(w, "<div class=\"control\">\n")
-		fmt.Fprintf(w, "<button class=\"submit\">delete category</button>\n")
-		fmt.Fprintf(w, "</div>\n")
-		fmt.Fprintf(w, "</form>\n")
-		fmt.Fprintf(w, "</section>\n")
-
-		fmt.Fprintf(w, "</div>\n")
-		printPageFoot(w)
+		data := struct {
+			Page
+			Cat  *Cat
+			From string
+		}{newPage(r, db, login, querySite(db)), cat, qfrom}
+		data.Errmsg = errmsg
+		renderPage(w, "delcat.html", data)
 	}
 }
 
+// Deleted entries aren't found.
 func queryEntry(db *sql.DB, entryid int64) (*Entry, error) {
-	s := "SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.createdt FROM entry e WHERE e.entry_id = ?"
+	s := "SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.createdt, e.user_id FROM entry e WHERE e.entry_id = ? AND e.deleted = 0"
 	row := db.QueryRow(s, entryid)
 	var e Entry
-	err := row.Scan(&e.Entryid, &e.Thing, &e.Title, &e.Url, &e.Body, &e.Createdt)
+	err := row.Scan(&e.Entryid, &e.Thing, &e.Title, &e.Url, &e.Body, &e.Createdt, &e.Userid)
 	if err != nil {
 		return nil, err
 	}
 	return &e, nil
 }
 
+// Add new submission e from e.Userid along with its category and tags.
+func createSubmission(db *sql.DB, e *Entry, catid int64, tt []string) (int64, error) {
+	e.Thing = SUBMISSION
+	e.Body = strings.ReplaceAll(e.Body, "\r", "") // CRLF => CR
+	e.Createdt = time.Now().Format(time.RFC3339)
+
+	s := "INSERT INTO entry (thing, title, url, normurl, body, description, thumburl, createdt, user_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	result, err := sqlexec(db, s, SUBMISSION, e.Title, e.Url, normalizeUrl(e.Url), e.Body, e.Description, e.Thumburl, e.Createdt, e.Userid)
+	if err != nil {
+		return 0, err
+	}
+	newid, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	e.Entryid = newid
+
+	s = "UPDATE entry SET root_id = entry_id WHERE entry_id = ?"
+	_, err = sqlexec(db, s, newid)
+	if err != nil {
+		return newid, err
+	}
+
+	err = indexEntrySearch(db, newid, e.Title, e.Body, e.Url)
+	if err != nil {
+		log.Printf("DB error indexing submission for search (%s)\n", err)
+	}
+
+	// Set category
+	s = "INSERT INTO entrycat (entry_id, cat_id) VALUES (?, ?)"
+	_, err = sqlexec(db, s, newid, catid)
+	if err != nil {
+		return newid, err
+	}
+
+	// Add entry tags
+	for _, t := range tt {
+		s := "INSERT INTO entrytag (entry_id, tag) VALUES (?, ?)"
+		_, err := sqlexec(db, s, newid, t)
+		if err != nil {
+			return newid, err
+		}
+	}
+	return newid, nil
+}
+
+// Add new comment e from e.Userid replying to e.Parentid.
+func createComment(db *sql.DB, e *Entry) (int64, error) {
+	e.Thing = COMMENT
+	e.Body = strings.ReplaceAll(e.Body, "\r", "") // CRLF => CR
+	e.Createdt = time.Now().Format(time.RFC3339)
+
+	// Comments keep the submission at the top of their thread in root_id.
+	s := "INSERT INTO entry (thing, parent_id, root_id, title, body, createdt, user_id) VALUES (?, ?, IFNULL((SELECT root_id FROM entry WHERE entry_id = ?), 0), ?, ?, ?, ?)"
+	result, err := sqlexec(db, s, COMMENT, e.Parentid, e.Parentid, "", e.Body, e.Createdt, e.Userid)
+	if err != nil {
+		return 0, err
+	}
+	newid, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	e.Entryid = newid
+
+	err = indexEntrySearch(db, newid, "", e.Body, "")
+	if err != nil {
+		log.Printf("DB error indexing comment for search (%s)\n", err)
+	}
+	err = notifyReply(db, e)
+	if err != nil {
+		log.Printf("DB error adding reply notification (%s)\n", err)
+	}
+	return newid, nil
+}
+
+// dir is 1 for an up vote, -1 for a down vote.
+func voteEntry(db *sql.DB, entryid, userid int64, dir int) error {
+	s := "INSERT OR REPLACE INTO entryvote (entry_id, user_id, dir) VALUES (?, ?, ?)"
+	_, err := sqlexec(db, s, entryid, userid, dir)
+	return err
+}
+
+func unvoteEntry(db *sql.DB, entryid, userid int64) error {
+	s := "DELETE FROM entryvote WHERE entry_id = ? AND user_id = ?"
+	_, err := sqlexec(db, s, entryid, userid)
+	return err
+}
+
+func queryTotalVotes(db *sql.DB, entryid int64) (int, error) {
+	var votes int
+	s := "SELECT IFNULL(totalvotes.votes, 0) AS votes FROM entry e LEFT OUTER JOIN totalvotes ON e.entry_id = totalvotes.entry_id WHERE e.entry_id = ?"
+	row := db.QueryRow(s, entryid)
+	err := row.Scan(&votes)
+	return votes, err
+}
+
 func queryEntryTags(db *sql.DB, entryid int64) ([]string, error) {
 	s := "SELECT tag FROM entrytag WHERE entry_id = ? ORDER BY tag"
 	rows, err := db.Query(s, entryid)
@@ -2582,19 +2952,3 @@ func decrypt(data []byte, passphrase string) []byte {
 	return plaintext
 }
 
-// todo Make this configurable and hidden.
-const PASSPHRASE = "newsboard_passphrase"
-
-func encryptString(s string) string {
-	bs := encrypt([]byte(s), PASSPHRASE)
-	return hex.EncodeToString(bs)
-}
-
-func decryptString(tok string) string {
-	bstok, err := hex.DecodeString(tok)
-	if err != nil {
-		return ""
-	}
-	bs := decrypt(bstok, PASSPHRASE)
-	return string(bs)
-}
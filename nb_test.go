@@ -28,7 +28,7 @@ func TestSQL(t *testing.T) {
 
 	fmt.Printf("Test custom sqlite funcs.\n")
 
-	s := "SELECT entry_id, pow(entry_id, 2.0), randint(10), seconds_since_epoch(createdt), seconds_since_time(createdt), hours_since_time(createdt), calculate_points(entry_id, createdt) FROM entry ORDER BY entry_id"
+	s := "SELECT entry_id, pow(entry_id, 2.0), randint(10), seconds_since_epoch(createdt), seconds_since_time(createdt), hours_since_time(createdt), calculate_points(entry_id, createdt, 1.0) FROM entry ORDER BY entry_id"
 	rows, err := db.Query(s)
 	if err != nil {
 		log.Fatal(err)
@@ -51,3 +51,59 @@ func TestCrypto(t *testing.T) {
 	plaintext := decrypt(ciphertext, "password")
 	fmt.Printf("Decrypted: %s\n", plaintext)
 }
+
+func TestWilsonScore(t *testing.T) {
+	if wilson_score(0, 0) != 0 {
+		t.Fatalf("no votes should score 0")
+	}
+	// More votes at the same ratio gives more confidence.
+	if wilson_score(10, 0) <= wilson_score(1, 0) {
+		t.Fatalf("10 up votes should score higher than 1")
+	}
+	if wilson_score(10, 0) <= wilson_score(10, 5) {
+		t.Fatalf("down votes should lower the score")
+	}
+	if s := wilson_score(100, 0); s <= 0 || s >= 1 {
+		t.Fatalf("score should be in (0, 1), got %f", s)
+	}
+}
+
+func TestCanEditUser(t *testing.T) {
+	superadmin := &User{Userid: ADMIN_ID, Active: true, Role: ROLE_ADMIN}
+	admin := &User{Userid: 2, Active: true, Role: ROLE_ADMIN}
+	user := &User{Userid: 3, Active: true}
+
+	if !canEditUser(superadmin, ADMIN_ID) || !canEditUser(superadmin, 3) {
+		t.Errorf("super-admin should edit any user")
+	}
+	if canEditUser(admin, ADMIN_ID) {
+		t.Errorf("admin shouldn't edit the super-admin")
+	}
+	if !canEditUser(admin, 3) || !canEditUser(admin, 2) {
+		t.Errorf("admin should edit other users and itself")
+	}
+	if !canEditUser(user, 3) || canEditUser(user, 2) {
+		t.Errorf("user should only edit itself")
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		s        string
+		deflimit int
+		want     int
+	}{
+		{"", 30, 30},
+		{"abc", 30, 30},
+		{"-5", 30, 30},
+		{"10", 30, 10},
+		{"100000000", 30, MAX_PAGE_LIMIT},
+		{"100000000", 200, 200},
+		{"150", 200, 150},
+	}
+	for _, tt := range tests {
+		if got := parseLimit(tt.s, tt.deflimit); got != tt.want {
+			t.Errorf("parseLimit(%q, %d) = %d, want %d", tt.s, tt.deflimit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Users are notified when someone replies to their submission or comment.
+// Notifications are listed in /inbox/ until the user marks them read.
+
+const INBOX_LIMIT = 30
+
+type Notification struct {
+	Notificationid int64
+	Reply          Entry
+	Replier        User
+	Parent         Entry
+	Isread         bool
+	Createdt       string
+}
+
+// Notify the author of the replied-to entry, unless they're replying to themselves.
+func notifyReply(db *sql.DB, reply *Entry) error {
+	s := `INSERT INTO notification (user_id, entry_id, createdt)
+SELECT p.user_id, ?, ? FROM entry p WHERE p.entry_id = ? AND p.user_id <> ?`
+	_, err := sqlexec(db, s, reply.Entryid, reply.Createdt, reply.Parentid, reply.Userid)
+	return err
+}
+
+func queryUnreadCount(db *sql.DB, userid int64) (int, error) {
+	var n int
+	s := "SELECT COUNT(*) FROM notification n INNER JOIN entry e ON n.entry_id = e.entry_id WHERE n.user_id = ? AND n.isread = 0 AND e.deleted = 0"
+	err := db.QueryRow(s, userid).Scan(&n)
+	return n, err
+}
+
+func queryNotifications(db *sql.DB, userid int64, offset, limit int) ([]Notification, error) {
+	s := `SELECT n.notification_id, n.isread, n.createdt,
+e.entry_id, e.body, e.createdt, IFNULL(u.user_id, 0), IFNULL(u.username, ''),
+IFNULL(p.entry_id, 0), IFNULL(p.thing, 0), IFNULL(p.title, ''), IFNULL(p.body, '')
+FROM notification n
+INNER JOIN entry e ON n.entry_id = e.entry_id
+LEFT OUTER JOIN user u ON e.user_id = u.user_id
+LEFT OUTER JOIN entry p ON e.parent_id = p.entry_id
+WHERE n.user_id = ? AND e.deleted = 0
+ORDER BY n.notification_id DESC
+LIMIT ? OFFSET ?`
+	rows, err := db.Query(s, userid, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nn []Notification
+	for rows.Next() {
+		var n Notification
+		err := rows.Scan(&n.Notificationid, &n.Isread, &n.Createdt,
+			&n.Reply.Entryid, &n.Reply.Body, &n.Reply.Createdt, &n.Replier.Userid, &n.Replier.Username,
+			&n.Parent.Entryid, &n.Parent.Thing, &n.Parent.Title, &n.Parent.Body)
+		if err != nil {
+			return nil, err
+		}
+		nn = append(nn, n)
+	}
+	return nn, rows.Err()
+}
+
+// Pass notificationid -1 to mark all of the user's notifications read.
+func markNotificationsRead(db *sql.DB, userid, notificationid int64) error {
+	s := "UPDATE notification SET isread = 1 WHERE user_id = ?"
+	pp := []interface{}{userid}
+	if notificationid != -1 {
+		s += " AND notification_id = ?"
+		pp = append(pp, notificationid)
+	}
+	_, err := sqlexec(db, s, pp...)
+	return err
+}
+
+func delEntryNotifications(tx *sql.Tx, entryid int64) error {
+	s := "DELETE FROM notification WHERE entry_id = ?"
+	_, err := txexec(tx, s, entryid)
+	return err
+}
+
+func textSnippet(s string, n int) string {
+	rr := []rune(strings.Join(strings.Fields(s), " "))
+	if len(rr) > n {
+		return string(rr[:n]) + "..."
+	}
+	return string(rr)
+}
+
+// /inbox/ lists the login user's notifications, latest first.
+// POST with notificationid to mark one read, or without to mark all read.
+func inboxHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		login := getLoginUser(r, db)
+		if !validateSessionLogin(w, login) {
+			return
+		}
+
+		qoffset := atoi(r.FormValue("offset"))
+		if qoffset <= 0 {
+			qoffset = 0
+		}
+		qlimit := parseLimit(r.FormValue("limit"), INBOX_LIMIT)
+
+		if r.Method == "POST" {
+			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+				qnotificationid := idtoi(r.FormValue("notificationid"))
+				err := markNotificationsRead(db, login.Userid, qnotificationid)
+				if err != nil {
+					log.Printf("DB error marking notifications read: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+
+				// Read link goes to the reply after marking it.
+				qfrom := r.FormValue("from")
+				if qfrom == "" {
+					qfrom = r.RequestURI
+				}
+				http.Redirect(w, r, unescapeUrl(qfrom), http.StatusSeeOther)
+				return
+			}
+		}
+
+		nn, err := queryNotifications(db, login.Userid, qoffset, qlimit)
+		if handleDbErr(w, err, "inboxhandler") {
+			return
+		}
+
+		data := struct {
+			Page
+			Notifications []Notification
+			Paging        PagingNav
+		}{newPage(r, db, login, querySite(db)), nn, newPagingNav("/inbox/?", qoffset, qlimit, len(nn))}
+		data.Errmsg = errmsg
+		renderPage(w, "inbox.html", data)
+	}
+}
+
+// Reply digests are emailed at most once a day to users who opted in
+// and have confirmed their email address.
+const DIGEST_INTERVAL = 24 * time.Hour
+const DIGEST_CHECK_INTERVAL = time.Hour
+const DIGEST_LIMIT = 50
+
+// Base url for links in emails, set by -baseurl.
+var siteBaseUrl = "http://localhost:8000"
+
+func runDigests(db *sql.DB, stop <-chan struct{}) {
+	for {
+		err := sendDigests(db)
+		if err != nil {
+			log.Printf("error sending digests (%s)\n", err)
+		}
+		err = delExpiredUserTokens(db)
+		if err != nil {
+			log.Printf("DB error deleting expired user tokens (%s)\n", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(DIGEST_CHECK_INTERVAL):
+		}
+	}
+}
+
+func sendDigests(db *sql.DB) error {
+	s := `SELECT user_id FROM user
+WHERE digest = 1 AND emailverified = 1 AND email <> '' AND active = 1 AND (lastdigestdt = '' OR seconds_since_time(lastdigestdt) >= ?)`
+	rows, err := db.Query(s, int64(DIGEST_INTERVAL/time.Second))
+	if err != nil {
+		return err
+	}
+	var userids []int64
+	for rows.Next() {
+		var userid int64
+		rows.Scan(&userid)
+		userids = append(userids, userid)
+	}
+	rows.Close()
+
+	site := querySite(db)
+	for _, userid := range userids {
+		u := queryUser(db, userid)
+		if u.Userid == -1 {
+			continue
+		}
+		err := sendUserDigest(db, site, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Email the user's unread replies since their last digest.
+func sendUserDigest(db *sql.DB, site *Site, u *User) error {
+	lastdigestdt, _ := time.Parse(time.RFC3339, u.Lastdigestdt)
+	nn, err := queryNotifications(db, u.Userid, 0, DIGEST_LIMIT)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	nreplies := 0
+	for _, n := range nn {
+		createdt, _ := time.Parse(time.RFC3339, n.Createdt)
+		if n.Isread || !createdt.After(lastdigestdt) {
+			continue
+		}
+		fmt.Fprintf(&b, "%s replied:\n%s\n%s%s\n\n", n.Replier.Username, textSnippet(n.Reply.Body, 200), siteBaseUrl, createItemUrl(n.Reply.Entryid))
+		nreplies++
+	}
+
+	s := "UPDATE user SET lastdigestdt = ? WHERE user_id = ?"
+	_, err = sqlexec(db, s, nowUTC(), u.Userid)
+	if err != nil {
+		return err
+	}
+	if nreplies == 0 {
+		return nil
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+You have %d new %s on %s.
+
+%sSee all replies in your inbox: %s/inbox/
+
+To stop these emails, turn off the reply digest in your account settings.
+`, u.Username, nreplies, getReplyUnit(nreplies), site.Title, b.String(), siteBaseUrl)
+	sendMail(u.Email, fmt.Sprintf("%s: %d new %s", site.Title, nreplies, getReplyUnit(nreplies)), body)
+	return nil
+}
+
+func getReplyUnit(n int) string {
+	if n == 1 {
+		return "reply"
+	}
+	return "replies"
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Submissions, comments and new accounts are rate limited with a token bucket
+// per user and per ip address. A bucket holds up to the hourly limit from the
+// site settings and refills at that rate, so a user can post a short burst then
+// has to slow down. New accounts are on probation for site.Probationhours with
+// their own, stricter limits. The ip bucket always uses the regular limit, which
+// caps how much one address can post across several new accounts.
+//
+// Password reset emails are limited to RESETPWD_LIMIT an hour per ip address
+// and per account.
+//
+// Buckets are kept in memory. Turn on site.Persistlimits to also keep them in
+// the ratelimit table so that restarting nb doesn't reset them.
+
+const (
+	RATE_SUBMIT   = "submit"
+	RATE_COMMENT  = "comment"
+	RATE_SIGNUP   = "signup"
+	RATE_RESETPWD = "resetpwd"
+)
+
+const RESETPWD_LIMIT = 5
+
+// A bucket left alone for this long has refilled, so it can be dropped.
+const RATE_BUCKET_IDLE = time.Hour
+const RATE_PRUNE_INTERVAL = 10 * time.Minute
+
+type RateBucket struct {
+	Tokens   float64
+	Updatedt time.Time
+}
+
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*RateBucket
+}
+
+var limiter = newRateLimiter()
+
+func newRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: map[string]*RateBucket{}}
+}
+
+type RateKey struct {
+	Key   string
+	Limit int
+}
+
+// Take one token from key's bucket. Returns whether there was one, and if not,
+// how long until there will be. Pass a db to persist the bucket in it, db errors
+// are returned along with the result.
+func (rl *RateLimiter) take(db *sql.DB, key string, limit int, now time.Time) (bool, time.Duration, error) {
+	return rl.takeAll(db, []RateKey{{key, limit}}, now)
+}
+
+// Take one token from each of the buckets in kk, or from none of them if any
+// is empty, so that a request turned away by one bucket doesn't cost a token
+// from the others. Returns the longest wait of the empty buckets.
+func (rl *RateLimiter) takeAll(db *sql.DB, kk []RateKey, now time.Time) (bool, time.Duration, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var err error
+	var wait time.Duration
+	ok := true
+	bb := make([]*RateBucket, len(kk))
+	for i, k := range kk {
+		b, berr := rl.refill(db, k, now)
+		if berr != nil && err == nil {
+			err = berr
+		}
+		bb[i] = b
+		if b.Tokens < 1 {
+			ok = false
+			rate := float64(k.Limit) / RATE_BUCKET_IDLE.Seconds() // tokens per second
+			if w := time.Duration((1 - b.Tokens) / rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+	}
+	if ok {
+		for _, b := range bb {
+			b.Tokens--
+		}
+	}
+
+	if db != nil && err == nil {
+		for i, k := range kk {
+			err = updateRateBucket(db, k.Key, bb[i])
+			if err != nil {
+				break
+			}
+		}
+	}
+	return ok, wait, err
+}
+
+// Bucket of k refilled up to now. Must be called with rl.mu held.
+func (rl *RateLimiter) refill(db *sql.DB, k RateKey, now time.Time) (*RateBucket, error) {
+	var err error
+	b, ok := rl.buckets[k.Key]
+	if !ok {
+		b = &RateBucket{Tokens: float64(k.Limit), Updatedt: now}
+		if db != nil {
+			err = queryRateBucket(db, k.Key, b)
+			if err == sql.ErrNoRows {
+				err = nil
+			} else if err != nil {
+				// Start over with a full bucket.
+				b = &RateBucket{Tokens: float64(k.Limit), Updatedt: now}
+			}
+		}
+		rl.buckets[k.Key] = b
+	}
+
+	rate := float64(k.Limit) / RATE_BUCKET_IDLE.Seconds() // tokens per second
+	elapsed := now.Sub(b.Updatedt).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	b.Tokens = math.Min(float64(k.Limit), b.Tokens+elapsed*rate)
+	b.Updatedt = now
+	return b, err
+}
+
+// Drop idle buckets, which are full again.
+func (rl *RateLimiter) prune(db *sql.DB, now time.Time) error {
+	cutoff := now.Add(-RATE_BUCKET_IDLE)
+
+	rl.mu.Lock()
+	for key, b := range rl.buckets {
+		if b.Updatedt.Before(cutoff) {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.mu.Unlock()
+
+	if db == nil {
+		return nil
+	}
+	s := "DELETE FROM ratelimit WHERE updatedt < ?"
+	_, err := sqlexec(db, s, cutoff.UTC().Format(time.RFC3339))
+	return err
+}
+
+func queryRateBucket(db *sql.DB, key string, b *RateBucket) error {
+	var updatedt string
+	s := "SELECT tokens, updatedt FROM ratelimit WHERE key = ?"
+	err := db.QueryRow(s, key).Scan(&b.Tokens, &updatedt)
+	if err != nil {
+		return err
+	}
+	b.Updatedt, err = time.Parse(time.RFC3339, updatedt)
+	return err
+}
+
+func updateRateBucket(db *sql.DB, key string, b *RateBucket) error {
+	s := "INSERT OR REPLACE INTO ratelimit (key, tokens, updatedt) VALUES (?, ?, ?)"
+	_, err := sqlexec(db, s, key, b.Tokens, b.Updatedt.UTC().Format(time.RFC3339))
+	return err
+}
+
+func runRateLimitPrune(db *sql.DB, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(RATE_PRUNE_INTERVAL):
+		}
+		err := limiter.prune(db, time.Now())
+		if err != nil {
+			log.Printf("DB error pruning rate limits (%s)\n", err)
+		}
+	}
+}
+
+func setDefaultRateLimits(site *Site) {
+	site.Submitlimit = 10
+	site.Commentlimit = 60
+	site.Signuplimit = 3
+	site.Probationhours = 24
+	site.Probationsubmitlimit = 2
+	site.Probationcommentlimit = 10
+}
+
+func isOnProbation(site *Site, u *User, now time.Time) bool {
+	if site.Probationhours <= 0 {
+		return false
+	}
+	createdt, err := time.Parse(time.RFC3339, u.Createdt)
+	if err != nil {
+		return false
+	}
+	return now.Sub(createdt) < time.Duration(site.Probationhours)*time.Hour
+}
+
+// Client ip address. X-Forwarded-For is only trusted from a reverse proxy
+// on the same host, and then only the address the proxy added. Connections
+// on a unix socket (listen unix:<path>) always come from the same host.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	local := ip == nil || ip.IsLoopback() // no ip address on a unix socket
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && local {
+		addrs := strings.Split(fwd, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	return host
+}
+
+// Returns an error message if login or the client's ip address is over the
+// limit for action, "" if the action can go ahead. Moderators aren't limited.
+func checkRateLimit(db *sql.DB, site *Site, r *http.Request, login *User, action string) string {
+	if isModerator(login) {
+		return ""
+	}
+	now := time.Now()
+
+	pdb := rateLimitDb(db, site)
+
+	var kk []RateKey
+	ip := clientIp(r)
+	switch action {
+	case RATE_SIGNUP:
+		kk = append(kk, RateKey{fmt.Sprintf("signup:ip:%s", ip), site.Signuplimit})
+	case RATE_RESETPWD:
+		kk = append(kk, RateKey{fmt.Sprintf("resetpwd:ip:%s", ip), RESETPWD_LIMIT})
+	case RATE_SUBMIT, RATE_COMMENT:
+		limit, plimit := site.Submitlimit, site.Probationsubmitlimit
+		if action == RATE_COMMENT {
+			limit, plimit = site.Commentlimit, site.Probationcommentlimit
+		}
+		userlimit := limit
+		if isOnProbation(site, login, now) {
+			userlimit = plimit
+		}
+		kk = append(kk, RateKey{fmt.Sprintf("%s:user:%d", action, login.Userid), userlimit})
+		kk = append(kk, RateKey{fmt.Sprintf("%s:ip:%s", action, ip), limit})
+	}
+
+	// Limits of 0 or less are turned off.
+	var limited []RateKey
+	for _, k := range kk {
+		if k.Limit > 0 {
+			limited = append(limited, k)
+		}
+	}
+	if len(limited) == 0 {
+		return ""
+	}
+	ok, wait, err := limiter.takeAll(pdb, limited, now)
+	if err != nil {
+		// Don't turn away posts because the limits couldn't be saved.
+		log.Printf("DB error updating rate limits for %s (%s)\n", action, err)
+	}
+	if ok {
+		return ""
+	}
+	if action == RATE_SIGNUP {
+		return fmt.Sprintf("Too many accounts were created from your network. Please try again in %s.", formatWait(wait))
+	}
+	if action == RATE_RESETPWD {
+		return fmt.Sprintf("Too many password reset requests from your network. Please try again in %s.", formatWait(wait))
+	}
+	return fmt.Sprintf("You're posting too fast. Please try again in %s.", formatWait(wait))
+}
+
+// Whether another password reset email can be sent to u. Over the limit, the
+// email is quietly not sent so the form doesn't tell who has an account.
+func allowResetPwdEmail(db *sql.DB, site *Site, u *User) bool {
+	key := fmt.Sprintf("resetpwd:user:%d", u.Userid)
+	ok, _, err := limiter.take(rateLimitDb(db, site), key, RESETPWD_LIMIT, time.Now())
+	if err != nil {
+		log.Printf("DB error updating rate limit %s (%s)\n", key, err)
+	}
+	return ok
+}
+
+// db to keep rate limits in, nil to keep them in memory only.
+func rateLimitDb(db *sql.DB, site *Site) *sql.DB {
+	if site.Persistlimits {
+		return db
+	}
+	return nil
+}
+
+func formatWait(wait time.Duration) string {
+	nmins := int(math.Ceil(wait.Minutes()))
+	if nmins <= 1 {
+		return "a minute"
+	}
+	return fmt.Sprintf("%d minutes", nmins)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	rl := newRateLimiter()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Bucket starts full with the hourly limit.
+	for i := 0; i < 3; i++ {
+		ok, _, _ := rl.take(nil, "k", 3, now)
+		if !ok {
+			t.Fatalf("take %d should be allowed", i+1)
+		}
+	}
+	ok, wait, _ := rl.take(nil, "k", 3, now)
+	if ok {
+		t.Fatalf("take over the limit should be refused")
+	}
+	if wait != 20*time.Minute {
+		t.Fatalf("expected 20m wait for 3 per hour, got %s", wait)
+	}
+
+	// One token refills every 20 minutes.
+	ok, _, _ = rl.take(nil, "k", 3, now.Add(20*time.Minute))
+	if !ok {
+		t.Fatalf("take after refill should be allowed")
+	}
+	ok, _, _ = rl.take(nil, "other", 3, now)
+	if !ok {
+		t.Fatalf("buckets should be separate per key")
+	}
+
+	rl.prune(nil, now.Add(2*time.Hour))
+	if len(rl.buckets) != 0 {
+		t.Fatalf("idle buckets should be pruned, %d left", len(rl.buckets))
+	}
+}
+
+func TestIsOnProbation(t *testing.T) {
+	site := &Site{Probationhours: 24}
+	now := time.Now()
+	u := &User{Createdt: now.Add(-time.Hour).Format(time.RFC3339)}
+	if !isOnProbation(site, u, now) {
+		t.Fatalf("new account should be on probation")
+	}
+	u.Createdt = now.Add(-48 * time.Hour).Format(time.RFC3339)
+	if isOnProbation(site, u, now) {
+		t.Fatalf("old account shouldn't be on probation")
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	r := &http.Request{RemoteAddr: "203.0.113.5:1234", Header: http.Header{}}
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if ip := clientIp(r); ip != "203.0.113.5" {
+		t.Fatalf("X-Forwarded-For shouldn't be trusted from remote clients, got %s", ip)
+	}
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 192.0.2.7")
+	if ip := clientIp(r); ip != "192.0.2.7" {
+		t.Fatalf("expected the address added by the local proxy, got %s", ip)
+	}
+	for _, addr := range []string{"@", ""} {
+		r.RemoteAddr = addr
+		if ip := clientIp(r); ip != "192.0.2.7" {
+			t.Fatalf("expected the proxy's address on a unix socket (RemoteAddr '%s'), got %s", addr, ip)
+		}
+	}
+}
+
+func TestRateLimiterTakeAll(t *testing.T) {
+	rl := newRateLimiter()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	user := RateKey{"user", 5}
+	ip := RateKey{"ip", 1}
+
+	ok, _, _ := rl.takeAll(nil, []RateKey{user, ip}, now)
+	if !ok {
+		t.Fatalf("first take should be allowed")
+	}
+	ok, wait, _ := rl.takeAll(nil, []RateKey{user, ip}, now)
+	if ok {
+		t.Fatalf("take over the ip limit should be refused")
+	}
+	if wait != time.Hour {
+		t.Fatalf("expected 1h wait for the ip bucket, got %s", wait)
+	}
+	if n := rl.buckets["user"].Tokens; n != 4 {
+		t.Fatalf("refused take shouldn't cost a user token, %v left", n)
+	}
+}
+
+func TestResetPwdLimit(t *testing.T) {
+	limiter = newRateLimiter()
+	site := &Site{}
+	anon := &User{Userid: -1}
+
+	u := &User{Userid: 42}
+	for i := 0; i < RESETPWD_LIMIT; i++ {
+		if !allowResetPwdEmail(nil, site, u) {
+			t.Fatalf("reset email %d should be allowed", i+1)
+		}
+	}
+	if allowResetPwdEmail(nil, site, u) {
+		t.Errorf("reset emails over the limit should be refused")
+	}
+	if !allowResetPwdEmail(nil, site, &User{Userid: 43}) {
+		t.Errorf("reset limit should be per account")
+	}
+
+	r := &http.Request{RemoteAddr: "203.0.113.9:1234", Header: http.Header{}}
+	for i := 0; i < RESETPWD_LIMIT; i++ {
+		if errmsg := checkRateLimit(nil, site, r, anon, RATE_RESETPWD); errmsg != "" {
+			t.Fatalf("reset request %d should be allowed, got '%s'", i+1, errmsg)
+		}
+	}
+	if errmsg := checkRateLimit(nil, site, r, anon, RATE_RESETPWD); errmsg == "" {
+		t.Errorf("reset requests over the ip limit should be refused")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Edits are kept in entry_revision. The first edit of an entry stores its
+// original version, then each edit stores the new version with who made it,
+// so the last revision is the entry as it is now. Edited entries show when
+// they were last edited, with a link to the history page at /history/?id=
+// that diffs each revision against the one before it.
+
+type Revision struct {
+	Revisionid int64
+	Entryid    int64
+	Title      string
+	Url        string
+	Body       string
+	Createdt   string
+	Editor     User
+}
+
+// Revision with its changes from the previous revision.
+type RevisionDiff struct {
+	Revision
+	Original  bool // first revision, diffed against nothing
+	Titlediff []DiffOp
+	Urldiff   []DiffOp
+	Bodydiff  []DiffOp
+}
+
+const (
+	DIFF_SAME = 0
+	DIFF_ADD  = 1
+	DIFF_DEL  = 2
+)
+
+type DiffOp struct {
+	Op   int
+	Text string
+}
+
+// Longer texts are shown as replaced whole instead of diffed word by word.
+const DIFF_MAXCELLS = 4000000
+
+// Save the edit of olde to newe by editorid. Returns false if nothing changed.
+func addEntryRevision(db *sql.DB, olde, newe *Entry, editorid int64) (bool, error) {
+	if olde.Title == newe.Title && olde.Url == newe.Url && olde.Body == newe.Body {
+		return false, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var nrevs int
+	s := "SELECT COUNT(*) FROM entry_revision WHERE entry_id = ?"
+	err = tx.QueryRow(s, olde.Entryid).Scan(&nrevs)
+	if err != nil {
+		return false, err
+	}
+	s = "INSERT INTO entry_revision (entry_id, title, url, body, createdt, editor_id) VALUES (?, ?, ?, ?, ?, ?)"
+	if nrevs == 0 {
+		_, err = txexec(tx, s, olde.Entryid, olde.Title, olde.Url, olde.Body, olde.Createdt, olde.Userid)
+		if err != nil {
+			return false, err
+		}
+	}
+	editdt := time.Now().Format(time.RFC3339)
+	_, err = txexec(tx, s, olde.Entryid, newe.Title, newe.Url, newe.Body, editdt, editorid)
+	if err != nil {
+		return false, err
+	}
+	s = "UPDATE entry SET editdt = ? WHERE entry_id = ?"
+	_, err = txexec(tx, s, editdt, olde.Entryid)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Revisions of entryid, oldest first.
+func queryRevisions(db *sql.DB, entryid int64) ([]Revision, error) {
+	s := `SELECT r.revision_id, r.entry_id, r.title, r.url, r.body, r.createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '')
+FROM entry_revision r
+LEFT OUTER JOIN user u ON r.editor_id = u.user_id
+WHERE r.entry_id = ?
+ORDER BY r.revision_id`
+	rows, err := db.Query(s, entryid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rr []Revision
+	for rows.Next() {
+		var rev Revision
+		err := rows.Scan(&rev.Revisionid, &rev.Entryid, &rev.Title, &rev.Url, &rev.Body, &rev.Createdt, &rev.Editor.Userid, &rev.Editor.Username)
+		if err != nil {
+			return nil, err
+		}
+		rr = append(rr, rev)
+	}
+	return rr, rows.Err()
+}
+
+// Each revision diffed against the one before it, latest first.
+func diffRevisions(rr []Revision) []RevisionDiff {
+	var dd []RevisionDiff
+	for i := len(rr) - 1; i >= 0; i-- {
+		var prev Revision
+		if i > 0 {
+			prev = rr[i-1]
+		}
+		dd = append(dd, RevisionDiff{
+			Revision:  rr[i],
+			Original:  i == 0,
+			Titlediff: diffWords(prev.Title, rr[i].Title),
+			Urldiff:   diffWords(prev.Url, rr[i].Url),
+			Bodydiff:  diffWords(prev.Body, rr[i].Body),
+		})
+	}
+	return dd
+}
+
+var reDiffToken = regexp.MustCompile(`\s+|\S+`)
+
+// Word level diff of a to b, from the longest common subsequence of their
+// words and whitespace.
+func diffWords(a, b string) []DiffOp {
+	aa := reDiffToken.FindAllString(a, -1)
+	bb := reDiffToken.FindAllString(b, -1)
+
+	if len(aa)*len(bb) > DIFF_MAXCELLS {
+		var dd []DiffOp
+		dd = appendDiffOp(dd, DIFF_DEL, a)
+		dd = appendDiffOp(dd, DIFF_ADD, b)
+		return dd
+	}
+
+	// lcs[i][j] is the length of the lcs of aa[i:] and bb[j:].
+	lcs := make([][]int, len(aa)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bb)+1)
+	}
+	for i := len(aa) - 1; i >= 0; i-- {
+		for j := len(bb) - 1; j >= 0; j-- {
+			if aa[i] == bb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var dd []DiffOp
+	i, j := 0, 0
+	for i < len(aa) && j < len(bb) {
+		if aa[i] == bb[j] {
+			dd = appendDiffOp(dd, DIFF_SAME, aa[i])
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			dd = appendDiffOp(dd, DIFF_DEL, aa[i])
+			i++
+		} else {
+			dd = appendDiffOp(dd, DIFF_ADD, bb[j])
+			j++
+		}
+	}
+	for ; i < len(aa); i++ {
+		dd = appendDiffOp(dd, DIFF_DEL, aa[i])
+	}
+	for ; j < len(bb); j++ {
+		dd = appendDiffOp(dd, DIFF_ADD, bb[j])
+	}
+	return dd
+}
+
+// Append text to dd, joined with the last op if it's the same kind.
+func appendDiffOp(dd []DiffOp, op int, text string) []DiffOp {
+	if text == "" {
+		return dd
+	}
+	if len(dd) > 0 && dd[len(dd)-1].Op == op {
+		dd[len(dd)-1].Text += text
+		return dd
+	}
+	return append(dd, DiffOp{op, text})
+}
+
+func (d DiffOp) Added() bool {
+	return d.Op == DIFF_ADD
+}
+
+func (d DiffOp) Deleted() bool {
+	return d.Op == DIFF_DEL
+}
+
+func diffChanged(dd []DiffOp) bool {
+	for _, d := range dd {
+		if d.Op != DIFF_SAME {
+			return true
+		}
+	}
+	return false
+}
+
+// /history/?id=<entryid>
+func historyHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := getLoginUser(r, db)
+
+		qentryid := idtoi(r.FormValue("id"))
+		if !validateIdParm(w, qentryid) {
+			return
+		}
+		e, err := queryEntry(db, qentryid)
+		if handleDbErr(w, err, "historyhandler") {
+			return
+		}
+		rr, err := queryRevisions(db, qentryid)
+		if handleDbErr(w, err, "historyhandler") {
+			return
+		}
+
+		data := struct {
+			Page
+			Entry     *Entry
+			Revisions []RevisionDiff
+		}{newPage(r, db, login, querySite(db)), e, diffRevisions(rr)}
+		renderPage(w, "history.html", data)
+	}
+}
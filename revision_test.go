@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffWords(t *testing.T) {
+	dd := diffWords("the quick brown fox", "the slow brown fox jumps")
+	expected := []DiffOp{
+		{DIFF_SAME, "the "},
+		{DIFF_DEL, "quick"},
+		{DIFF_ADD, "slow"},
+		{DIFF_SAME, " brown fox"},
+		{DIFF_ADD, " jumps"},
+	}
+	if len(dd) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, dd)
+	}
+	for i := range dd {
+		if dd[i] != expected[i] {
+			t.Errorf("op %d: expected %v, got %v", i, expected[i], dd[i])
+		}
+	}
+	if diffChanged(diffWords("same text", "same text")) {
+		t.Errorf("expected no changes for the same text")
+	}
+}
+
+func TestEntryRevisions(t *testing.T) {
+	db := openTestDb(t)
+	_, err := migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("INSERT INTO user (user_id, username, active) VALUES (2, 'u2', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Entry{Body: "first", Parentid: 1, Userid: 2}
+	e.Entryid, err = createComment(db, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newe := e
+	if changed, _ := addEntryRevision(db, &e, &newe, 2); changed {
+		t.Errorf("expected no revision when nothing changed")
+	}
+	newe.Body = "second"
+	if _, err := addEntryRevision(db, &e, &newe, ADMIN_ID); err != nil {
+		t.Fatal(err)
+	}
+
+	rr, err := queryRevisions(db, e.Entryid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != 2 || rr[0].Body != "first" || rr[0].Editor.Userid != 2 || rr[1].Body != "second" || rr[1].Editor.Userid != ADMIN_ID {
+		t.Fatalf("expected original and edited revisions, got %+v", rr)
+	}
+	var editdt string
+	db.QueryRow("SELECT editdt FROM entry WHERE entry_id = ?", e.Entryid).Scan(&editdt)
+	if editdt != rr[1].Createdt {
+		t.Errorf("expected entry editdt %s, got '%s'", rr[1].Createdt, editdt)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Highlight markers returned by fts5 highlight() and snippet().
+// Replaced with <mark> tags after the result text is html escaped.
+const HL_START = "\x02"
+const HL_END = "\x03"
+
+func indexEntrySearch(db *sql.DB, entryid int64, title, body, url string) error {
+	s := "DELETE FROM entry_fts WHERE rowid = ?"
+	_, err := sqlexec(db, s, entryid)
+	if err != nil {
+		return err
+	}
+	s = "INSERT INTO entry_fts (rowid, title, body, url) VALUES (?, ?, ?, ?)"
+	_, err = sqlexec(db, s, entryid, title, body, url)
+	return err
+}
+
+func unindexEntrySearch(tx *sql.Tx, entryid int64) error {
+	s := "DELETE FROM entry_fts WHERE rowid = ?"
+	_, err := txexec(tx, s, entryid)
+	return err
+}
+
+// Convert user search text into an fts5 query.
+// Each word is quoted so that fts5 operators and punctuation in the
+// search text are matched literally instead of causing syntax errors.
+// Ex. `go "sqlite" c++` => `"go" "sqlite" "c++"`
+func ftsQuery(q string) string {
+	var terms []string
+	for _, w := range strings.Fields(q) {
+		w = strings.ReplaceAll(w, "\"", "")
+		if w == "" {
+			continue
+		}
+		terms = append(terms, fmt.Sprintf("\"%s\"", w))
+	}
+	return strings.Join(terms, " ")
+}
+
+// Search result with the matching words marked by HL_START and HL_END.
+type SearchResult struct {
+	Entry     Entry
+	User      User
+	Root      Entry // submission of a matching comment
+	Hltitle   string
+	Hlsnippet string
+}
+
+func highlightSearchText(s string) string {
+	s = escape(s)
+	s = strings.ReplaceAll(s, HL_START, "<mark>")
+	s = strings.ReplaceAll(s, HL_END, "</mark>")
+	return s
+}
+
+func searchHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := getLoginUser(r, db)
+		site := querySite(db)
+
+		qq := strings.TrimSpace(r.FormValue("q"))
+		qusername := r.FormValue("username")
+		qcat := idtoi(r.FormValue("cat"))
+		if qcat == -1 {
+			qcat = 0
+		}
+		qtag := r.FormValue("tag")
+		qoffset := atoi(r.FormValue("offset"))
+		if qoffset <= 0 {
+			qoffset = 0
+		}
+		qlimit := parseLimit(r.FormValue("limit"), cfg.Pagesize)
+
+		qi := &QIndex{
+			Username: qusername,
+			Cat:      qcat,
+			Tag:      qtag,
+		}
+
+		cats, err := queryCats(db)
+		if handleDbErr(w, err, "searchhandler") {
+			return
+		}
+
+		data := struct {
+			Page
+			Q        string
+			Cats     []Cat
+			Searched bool
+			Results  []SearchResult
+			Paging   PagingNav
+		}{Page: newPage(r, db, login, site), Q: qq, Cats: cats}
+		data.Qi = qi
+
+		match := ftsQuery(qq)
+		if match == "" {
+			renderPage(w, "search.html", data)
+			return
+		}
+
+		// Comments are filtered by the category and tags of their root submission.
+		var pp []interface{}
+		pp = append(pp, HL_START, HL_END, HL_START, HL_END)
+		join := ""
+		if qcat > 0 {
+			join += " INNER JOIN entrycat ec ON e.root_id = ec.entry_id AND ec.cat_id = ?"
+			pp = append(pp, qcat)
+		}
+		if qtag != "" {
+			join += " INNER JOIN entrytag et ON e.root_id = et.entry_id AND et.tag = ?"
+			pp = append(pp, resolveTag(db, qtag))
+		}
+		// Comments in a deleted thread go with it.
+		where := "entry_fts MATCH ? AND e.deleted = 0 AND e.root_id <> 0 AND re.deleted = 0"
+		pp = append(pp, match)
+		if qusername != "" {
+			where += " AND u.username = ?"
+			pp = append(pp, qusername)
+		}
+		cond, condpp := flagHiddenCond(site, login)
+		where += cond
+		pp = append(pp, condpp...)
+		pp = append(pp, qlimit, qoffset)
+
+		s := fmt.Sprintf(`SELECT e.entry_id, e.thing, e.title, e.url, e.createdt,
+IFNULL(u.user_id, 0), IFNULL(u.username, ''),
+IFNULL(re.entry_id, 0), IFNULL(re.title, ''),
+highlight(entry_fts, 0, ?, ?), snippet(entry_fts, -1, ?, ?, '...', 24)
+FROM entry_fts
+INNER JOIN entry e ON e.entry_id = entry_fts.rowid
+LEFT OUTER JOIN entry re ON re.entry_id = e.root_id
+LEFT OUTER JOIN user u ON e.user_id = u.user_id
+LEFT OUTER JOIN totalflags ON e.entry_id = totalflags.entry_id
+ %s
+WHERE %s
+ORDER BY rank
+LIMIT ? OFFSET ?`, join, where)
+		rows, err := db.Query(s, pp...)
+		if handleDbErr(w, err, "searchhandler") {
+			return
+		}
+
+		for rows.Next() {
+			var sr SearchResult
+			err := rows.Scan(&sr.Entry.Entryid, &sr.Entry.Thing, &sr.Entry.Title, &sr.Entry.Url, &sr.Entry.Createdt, &sr.User.Userid, &sr.User.Username, &sr.Root.Entryid, &sr.Root.Title, &sr.Hltitle, &sr.Hlsnippet)
+			if handleDbErr(w, err, "searchhandler") {
+				rows.Close()
+				return
+			}
+			data.Results = append(data.Results, sr)
+		}
+		rows.Close()
+
+		baseurl := fmt.Sprintf("/search/?q=%s&username=%s&cat=%d&tag=%s", url.QueryEscape(qq), url.QueryEscape(qusername), qcat, url.QueryEscape(qtag))
+		data.Searched = true
+		data.Paging = newPagingNav(baseurl, qoffset, qlimit, len(data.Results))
+		renderPage(w, "search.html", data)
+	}
+}
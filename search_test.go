@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestEntryRootId(t *testing.T) {
+	db := openTestDb(t)
+	_, err := migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := Entry{Title: "sub", Url: "https://example.com/a", Userid: ADMIN_ID}
+	subid, err := createSubmission(db, &sub, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := Entry{Body: "comment", Parentid: subid, Userid: ADMIN_ID}
+	c1id, err := createComment(db, &c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := Entry{Body: "reply", Parentid: c1id, Userid: ADMIN_ID}
+	c2id, err := createComment(db, &c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int64{subid, c1id, c2id} {
+		var rootid int64
+		err := db.QueryRow("SELECT root_id FROM entry WHERE entry_id = ?", id).Scan(&rootid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rootid != subid {
+			t.Errorf("entry %d: expected root %d, got %d", id, subid, rootid)
+		}
+	}
+}
+
+func TestFlagHidden(t *testing.T) {
+	db := openTestDb(t)
+	_, err := migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := querySite(db)
+	site.Flagthreshold = 1
+	site.Flagaction = FLAG_HIDE
+
+	sub := Entry{Title: "sub", Url: "https://example.com/a", Userid: ADMIN_ID}
+	subid, err := createSubmission(db, &sub, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := Entry{Body: "flagged comment", Parentid: subid, Userid: ADMIN_ID}
+	c1id, err := createComment(db, &c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO entryflag (entry_id, user_id, reason, createdt) VALUES (?, ?, '', '')", c1id, ADMIN_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Userid: 2, Active: true, Role: ROLE_USER}
+	mod := &User{Userid: ADMIN_ID, Active: true, Role: ROLE_ADMIN}
+
+	_, err = queryApiItem(db, site, user, c1id)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected hidden item not found, got %v", err)
+	}
+	_, err = queryApiItem(db, site, mod, c1id)
+	if err != nil {
+		t.Errorf("expected moderator to see hidden item, got %s", err)
+	}
+
+	cc, err := queryApiComments(db, site, user, subid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cc) != 0 {
+		t.Errorf("expected hidden comment without replies left out, got %d comments", len(cc))
+	}
+
+	f, err := queryCommentsFeed(db, site, "", subid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Items) != 0 {
+		t.Errorf("expected hidden comment left out of feed, got %d items", len(f.Items))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The listen address is one of:
+//
+//	host:port       tcp
+//	unix:<path>     unix socket, replacing a stale socket file at path
+//	systemd         first socket passed by systemd socket activation
+//
+// On SIGINT or SIGTERM the server stops accepting connections and waits up
+// to SHUTDOWN_TIMEOUT for requests in progress to finish. Background jobs
+// are then stopped and waited for, so that they're done before the db is closed.
+
+const (
+	SERVER_READ_HEADER_TIMEOUT = 10 * time.Second
+	SERVER_READ_TIMEOUT        = 30 * time.Second
+	SERVER_WRITE_TIMEOUT       = 60 * time.Second // submit can wait on FETCH_TIMEOUT
+	SERVER_IDLE_TIMEOUT        = 120 * time.Second
+	SERVER_MAX_HEADER_BYTES    = 64 * 1024
+	SHUTDOWN_TIMEOUT           = 30 * time.Second
+)
+
+const LISTEN_SYSTEMD = "systemd"
+
+// First fd passed by systemd, after stdin, stdout and stderr.
+const SYSTEMD_LISTEN_FDS_START = 3
+
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: SERVER_READ_HEADER_TIMEOUT,
+		ReadTimeout:       SERVER_READ_TIMEOUT,
+		WriteTimeout:      SERVER_WRITE_TIMEOUT,
+		IdleTimeout:       SERVER_IDLE_TIMEOUT,
+		MaxHeaderBytes:    SERVER_MAX_HEADER_BYTES,
+	}
+}
+
+func isUnixListen(addr string) bool {
+	return strings.HasPrefix(addr, "unix:")
+}
+
+func listen(addr string) (net.Listener, error) {
+	if addr == LISTEN_SYSTEMD {
+		return systemdListener()
+	}
+	if isUnixListen(addr) {
+		sockfile := strings.TrimPrefix(addr, "unix:")
+		if sockfile == "" {
+			return nil, fmt.Errorf("unix socket path required")
+		}
+		// Left behind by a server that didn't shut down cleanly. A socket
+		// that still takes connections belongs to a running server.
+		fi, err := os.Lstat(sockfile)
+		if err == nil && fi.Mode()&os.ModeSocket != 0 {
+			conn, err := net.Dial("unix", sockfile)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("'%s' is in use by another server", sockfile)
+			}
+			if !errors.Is(err, syscall.ECONNREFUSED) {
+				return nil, err
+			}
+			os.Remove(sockfile)
+		}
+		return net.Listen("unix", sockfile)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Socket passed by systemd socket activation, see sd_listen_fds(3).
+func systemdListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	nfds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || nfds < 1 {
+		return nil, fmt.Errorf("no socket passed by systemd (LISTEN_PID, LISTEN_FDS not set for this process)")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(SYSTEMD_LISTEN_FDS_START), "systemd-socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Serve on l until SIGINT or SIGTERM, then drain requests in progress.
+func serve(srv *http.Server, l net.Listener) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	return serveUntil(srv, l, stop)
+}
+
+func serveUntil(srv *http.Server, l net.Listener, stop <-chan os.Signal) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		logInfof("Received %s, shutting down...\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("shutdown: %s", err)
+	}
+	return nil
+}
+
+// Background jobs, such as sending digests and purging the trash. Each job
+// runs until stop is closed.
+type Jobs struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func (j *Jobs) run(job func(stop <-chan struct{})) {
+	if j.stop == nil {
+		j.stop = make(chan struct{})
+	}
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		job(j.stop)
+	}()
+}
+
+// Stop jobs and wait for the ones in the middle of a run to finish.
+func (j *Jobs) stopWait() {
+	j.stopOnce.Do(func() {
+		if j.stop != nil {
+			close(j.stop)
+		}
+	})
+	j.wg.Wait()
+}
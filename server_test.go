@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	// Short path, unix socket paths are limited to about 100 chars.
+	dir, err := os.MkdirTemp("", "nb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockfile := filepath.Join(dir, "nb.sock")
+
+	// Stale socket left by a server that was killed.
+	stale, err := net.Listen("unix", sockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix:" + sockfile)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced, got %s", err)
+	}
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", sockfile)
+		},
+	}}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("expected ok, got '%s'", body)
+	}
+
+	// A socket in use by a running server isn't taken over.
+	_, err = listen("unix:" + sockfile)
+	if err == nil {
+		t.Errorf("expected error listening on a socket in use")
+	}
+
+	// Regular files aren't removed.
+	regfile := filepath.Join(dir, "file")
+	os.WriteFile(regfile, []byte("x"), 0600)
+	_, err = listen("unix:" + regfile)
+	if err == nil {
+		t.Errorf("expected error listening over a regular file")
+	}
+
+	_, err = listen(LISTEN_SYSTEMD)
+	if err == nil {
+		t.Errorf("expected error for systemd without LISTEN_FDS")
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serveUntil(srv, l, stop)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			resc <- result{"", err}
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resc <- result{string(body), err}
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+
+	res := <-resc
+	if res.err != nil || res.body != "done" {
+		t.Errorf("expected in-flight request to finish, got '%s' (%v)", res.body, res.err)
+	}
+	err = <-served
+	if err != nil {
+		t.Errorf("expected clean shutdown, got %s", err)
+	}
+	_, err = net.Dial("tcp", l.Addr().String())
+	if err == nil {
+		t.Errorf("expected listener closed after shutdown")
+	}
+}
+
+func TestJobsStopWait(t *testing.T) {
+	var jobs Jobs
+	done := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		jobs.run(func(stop <-chan struct{}) {
+			<-stop
+			time.Sleep(50 * time.Millisecond)
+			done <- true
+		})
+	}
+	jobs.stopWait()
+	if len(done) != 2 {
+		t.Errorf("expected stopWait to wait for all jobs, %d finished", len(done))
+	}
+	jobs.stopWait()
+}
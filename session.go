@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const SESSION_COOKIE = "session"
+const SESSION_DAYS = 30
+
+// Don't write lastseendt to the db more often than this.
+const SESSION_TOUCH_INTERVAL = time.Hour
+
+type Session struct {
+	Sessionid  string
+	Userid     int64
+	Createdt   string
+	Expiredt   string
+	Lastseendt string
+}
+
+func nowUTC() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+func randomToken(nbytes int) string {
+	bs := make([]byte, nbytes)
+	if _, err := cryptorand.Read(bs); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bs)
+}
+
+func hashToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+func signString(s string) string {
+	mac := hmac.New(sha256.New, siteSecret)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Session cookie value takes the format: <token>.<signature>
+// Only the hash of token is stored in the session table.
+func createSessionCookieValue(tok string) string {
+	return fmt.Sprintf("%s.%s", tok, signString(tok))
+}
+
+func parseSessionCookieValue(v string) string {
+	i := strings.LastIndex(v, ".")
+	if i == -1 {
+		return ""
+	}
+	tok, sig := v[:i], v[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(signString(tok))) {
+		return ""
+	}
+	return tok
+}
+
+func createSession(db *sql.DB, userid int64) (string, error) {
+	// Clean up expired sessions while we're here.
+	now := nowUTC()
+	s := "DELETE FROM session WHERE expiredt < ?"
+	_, err := sqlexec(db, s, now)
+	if err != nil {
+		return "", err
+	}
+
+	tok := randomToken(32)
+	expiredt := time.Now().UTC().Add(daysDuration(SESSION_DAYS)).Format(time.RFC3339)
+	s = "INSERT INTO session (session_id, user_id, createdt, expiredt, lastseendt) VALUES (?, ?, ?, ?, ?)"
+	_, err = sqlexec(db, s, hashToken(tok), userid, now, expiredt, now)
+	if err != nil {
+		return "", err
+	}
+	return tok, nil
+}
+
+func querySession(db *sql.DB, cookieval string) *Session {
+	tok := parseSessionCookieValue(cookieval)
+	if tok == "" {
+		return nil
+	}
+
+	var sess Session
+	s := "SELECT session_id, user_id, createdt, expiredt, lastseendt FROM session WHERE session_id = ?"
+	row := db.QueryRow(s, hashToken(tok))
+	err := row.Scan(&sess.Sessionid, &sess.Userid, &sess.Createdt, &sess.Expiredt, &sess.Lastseendt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Printf("querySession() db error (%s)\n", err)
+		return nil
+	}
+
+	expiredt, _ := time.Parse(time.RFC3339, sess.Expiredt)
+	if time.Now().After(expiredt) {
+		return nil
+	}
+	return &sess
+}
+
+// Update session last seen time and extend its expiry.
+func touchSession(db *sql.DB, sess *Session) {
+	lastseendt, _ := time.Parse(time.RFC3339, sess.Lastseendt)
+	if time.Since(lastseendt) < SESSION_TOUCH_INTERVAL {
+		return
+	}
+	expiredt := time.Now().UTC().Add(daysDuration(SESSION_DAYS)).Format(time.RFC3339)
+	s := "UPDATE session SET lastseendt = ?, expiredt = ? WHERE session_id = ?"
+	_, err := sqlexec(db, s, nowUTC(), expiredt, sess.Sessionid)
+	if err != nil {
+		log.Printf("touchSession() db error (%s)\n", err)
+	}
+}
+
+func delSession(db *sql.DB, cookieval string) error {
+	tok := parseSessionCookieValue(cookieval)
+	if tok == "" {
+		return nil
+	}
+	s := "DELETE FROM session WHERE session_id = ?"
+	_, err := sqlexec(db, s, hashToken(tok))
+	return err
+}
+
+func delUserSessions(db *sql.DB, userid int64) error {
+	s := "DELETE FROM session WHERE user_id = ?"
+	_, err := sqlexec(db, s, userid)
+	return err
+}
+
+func countUserSessions(db *sql.DB, userid int64) int {
+	var n int
+	s := "SELECT COUNT(*) FROM session WHERE user_id = ? AND expiredt >= ?"
+	row := db.QueryRow(s, userid, nowUTC())
+	err := row.Scan(&n)
+	if err != nil {
+		log.Printf("countUserSessions() db error (%s)\n", err)
+		return 0
+	}
+	return n
+}
+
+func setSessionCookie(w http.ResponseWriter, tok string) {
+	c := http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    createSessionCookieValue(tok),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(daysDuration(SESSION_DAYS)),
+	}
+	http.SetCookie(w, &c)
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	c := http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   -1,
+	}
+	http.SetCookie(w, &c)
+
+	// Remove cookie from older versions that stored the plain userid.
+	c = http.Cookie{
+		Name:     "userid",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   -1,
+	}
+	http.SetCookie(w, &c)
+}
+
+func logoutallHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		login := getLoginUser(r, db)
+		if !validateSessionLogin(w, login) {
+			return
+		}
+
+		if r.Method == "POST" {
+			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+				err := delUserSessions(db, login.Userid)
+				if err != nil {
+					log.Printf("DB error deleting user sessions: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				clearSessionCookie(w)
+
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+		}
+
+		data := struct {
+			Page
+			Nsessions int
+		}{newPage(r, db, login, querySite(db)), countUserSessions(db, login.Userid)}
+		data.Errmsg = errmsg
+		renderPage(w, "logoutall.html", data)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Static files in static/ are built into nb. Start nb with -static <dir> to
+// customize them: each file in dir replaces the built-in file of the same
+// name, or adds a new one.
+//
+// Pages link to static files by content hash, ex. /static/style.1a2b3c4d.css,
+// so they can be cached for good and a changed file gets a new url. The plain
+// name, /static/style.css, is also served but has to be revalidated.
+
+//go:embed static
+var staticFS embed.FS
+
+const STATIC_MAXAGE = 365 * 24 * time.Hour
+
+type StaticAsset struct {
+	Name    string
+	Hashurl string
+	Hash    string
+	Content []byte
+	Modtime time.Time
+}
+
+type StaticAssets struct {
+	byname map[string]*StaticAsset
+	byhash map[string]*StaticAsset // by the file part of Hashurl
+}
+
+var assets = mustLoadStaticAssets("")
+
+func mustLoadStaticAssets(overridedir string) *StaticAssets {
+	sa, err := loadStaticAssets(overridedir)
+	if err != nil {
+		panic(err)
+	}
+	return sa
+}
+
+func loadStaticAssets(overridedir string) (*StaticAssets, error) {
+	sa := &StaticAssets{
+		byname: map[string]*StaticAsset{},
+		byhash: map[string]*StaticAsset{},
+	}
+
+	builtin, err := fs.Sub(staticFS, "static")
+	if err != nil {
+		return nil, err
+	}
+	err = sa.addDir(builtin, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	if overridedir != "" {
+		fi, err := os.Stat(overridedir)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("'%s' isn't a directory", overridedir)
+		}
+		err = sa.addDir(os.DirFS(overridedir), fi.ModTime())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, a := range sa.byname {
+		sa.byhash[path.Base(a.Hashurl)] = a
+	}
+	return sa, nil
+}
+
+// Add the files in fsys, replacing any of the same name.
+func (sa *StaticAssets) addDir(fsys fs.FS, modtime time.Time) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(path.Base(name), ".") {
+			return nil
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		hash := hex.EncodeToString(sum[:])[:12]
+		sa.byname[name] = &StaticAsset{
+			Name:    name,
+			Hashurl: "/static/" + hashedName(name, hash),
+			Hash:    hash,
+			Content: content,
+			Modtime: modtime,
+		}
+		return nil
+	})
+}
+
+// style.css => style.<hash>.css
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(name, ext), hash, ext)
+}
+
+// Url of the static file name, or the plain url if there's no such file.
+func staticUrl(name string) string {
+	a := assets.byname[name]
+	if a == nil {
+		return "/static/" + name
+	}
+	return a.Hashurl
+}
+
+// /static/<name> or /static/<hashed name>
+func (sa *StaticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/static/")
+	if a := sa.byhash[name]; a != nil {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int(STATIC_MAXAGE/time.Second)))
+		sa.serveAsset(w, r, a)
+		return
+	}
+	if a := sa.byname[name]; a != nil {
+		w.Header().Set("Cache-Control", "no-cache")
+		sa.serveAsset(w, r, a)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (sa *StaticAssets) serveAsset(w http.ResponseWriter, r *http.Request, a *StaticAsset) {
+	w.Header().Set("ETag", `"`+a.Hash+`"`)
+	http.ServeContent(w, r, filepath.Base(a.Name), a.Modtime, bytes.NewReader(a.Content))
+}
+
+func (sa *StaticAssets) serveFile(name string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := sa.byname[name]
+		if a == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(24*time.Hour/time.Second)))
+		sa.serveAsset(w, r, a)
+	}
+}
@@ -1,15 +1,13 @@
 function bindVoteListeners() {
     document.addEventListener("click", function(e) {
-        console.log(e.target);
-        let votebtn = null;
-        if (e.target.classList.contains("upvote")) {
-            votebtn = e.target;
-        } else {
-            votebtn = e.target.closest(".upvote");
-        }
+        let votebtn = e.target.closest(".upvote, .downvote");
         if (votebtn == null) {
             return;
         }
+        let dir = 1;
+        if (votebtn.classList.contains("downvote")) {
+            dir = -1;
+        }
         let wspath = "/vote/";
         if (votebtn.classList.contains("selfvote")) {
             wspath = "/unvote/";
@@ -20,9 +18,12 @@ function bindVoteListeners() {
             return;
         }
         let votectr = entry.querySelector(".votectr");
+        let upbtn = votebtn.parentElement.querySelector(".upvote");
+        let downbtn = votebtn.parentElement.querySelector(".downvote");
 
-        let tok = entry.getAttribute("data-votetok");
-        if (tok == null || tok == "") {
+        let entryid = entry.getAttribute("data-entryid");
+        let csrftok = entry.getAttribute("data-csrftok");
+        if (entryid == null || csrftok == null || csrftok == "") {
             return;
         }
 
@@ -33,18 +34,25 @@ function bindVoteListeners() {
             }
             let vr = JSON.parse(xhr.responseText);
 
-            if (wspath == "/vote/") {
-                votebtn.classList.add("selfvote");
-            } else if (wspath == "/unvote/") {
-                votebtn.classList.remove("selfvote");
+            if (upbtn != null) {
+                upbtn.classList.toggle("selfvote", vr.dir == 1);
+            }
+            if (downbtn != null) {
+                downbtn.classList.toggle("selfvote", vr.dir == -1);
             }
             if (votectr != null) {
                 votectr.innerText = vr.totalvotes;
             }
         };
-        console.log(`${wspath}?tok=${tok}`);
-        xhr.open("GET", `${wspath}?tok=${tok}`);
-        xhr.send();
+        let parms = new URLSearchParams();
+        parms.set("entryid", entryid);
+        parms.set("csrftok", csrftok);
+        if (wspath == "/vote/") {
+            parms.set("dir", dir);
+        }
+        xhr.open("POST", wspath);
+        xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+        xhr.send(parms.toString());
     });
 }
 
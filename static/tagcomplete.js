@@ -0,0 +1,42 @@
+// Autocomplete the last tag being typed in a comma separated tags input.
+// The input's datalist starts with the existing tags, its options are
+// rewritten to the input's other tags followed by each matching tag.
+function bindTagComplete() {
+    let input = document.querySelector("input[list=taglist]");
+    let datalist = document.getElementById("taglist");
+    if (input == null || datalist == null) {
+        return;
+    }
+    let tags = [];
+    for (let opt of datalist.options) {
+        tags.push(opt.value);
+    }
+
+    input.addEventListener("input", function() {
+        let val = input.value;
+        let i = val.lastIndexOf(",");
+        let prefix = "";
+        if (i != -1) {
+            prefix = val.substring(0, i+1).trimEnd() + " ";
+        }
+        let term = val.substring(i+1).trim().toLowerCase();
+        let entered = prefix.split(",").map(function(t) { return t.trim().toLowerCase(); });
+
+        datalist.innerHTML = "";
+        let n = 0;
+        for (let tag of tags) {
+            if (n >= 20) {
+                break;
+            }
+            if (!tag.startsWith(term) || entered.includes(tag)) {
+                continue;
+            }
+            let opt = document.createElement("option");
+            opt.value = prefix + tag;
+            datalist.appendChild(opt);
+            n++;
+        }
+    });
+}
+
+bindTagComplete();
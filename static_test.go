@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticAssets(t *testing.T) {
+	sa, err := loadStaticAssets("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := sa.byname["style.css"]
+	if a == nil || !strings.HasPrefix(a.Hashurl, "/static/style.") || !strings.HasSuffix(a.Hashurl, ".css") {
+		t.Fatalf("expected hashed style.css url, got %+v", a)
+	}
+
+	get := func(sa *StaticAssets, url string, hdr map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		for k, v := range hdr {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		sa.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get(sa, a.Hashurl, nil)
+	if w.Code != 200 || !strings.Contains(w.Header().Get("Cache-Control"), "immutable") || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") {
+		t.Errorf("expected cached css for hashed url, got %d %v", w.Code, w.Header())
+	}
+	w = get(sa, "/static/style.css", nil)
+	if w.Code != 200 || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("expected revalidated css for plain url, got %d %v", w.Code, w.Header())
+	}
+	w = get(sa, "/static/style.css", map[string]string{"If-None-Match": w.Header().Get("ETag")})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for matching etag, got %d", w.Code)
+	}
+	w = get(sa, "/static/nosuch.css", nil)
+	if w.Code != 404 {
+		t.Errorf("expected 404 for missing file, got %d", w.Code)
+	}
+
+	// Override dir replaces the built-in file.
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "style.css"), []byte("body {color: red;}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	osa, err := loadStaticAssets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oa := osa.byname["style.css"]
+	if oa.Hashurl == a.Hashurl || string(oa.Content) != "body {color: red;}" {
+		t.Errorf("expected override style.css with a new url, got %s", oa.Hashurl)
+	}
+	if osa.byname["handlevote.js"] == nil {
+		t.Errorf("expected built-in files not in override dir to be kept")
+	}
+	w = get(osa, a.Hashurl, nil)
+	if w.Code != 404 {
+		t.Errorf("expected old hashed url to be gone, got %d", w.Code)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tags are stored normalized, see normalizeTag(). Admins can merge one tag
+// into another, optionally keeping the old name as an alias so that later
+// submissions using it get the new tag, and block tags from being used at all.
+
+type TagCount struct {
+	Tag      string
+	Nentries int
+	Nrecent  int    // submissions in the last TAG_RECENT_DAYS days
+	Lastdt   string // latest submission with the tag
+}
+
+type TagAlias struct {
+	Alias string
+	Tag   string
+}
+
+const TAG_RECENT_DAYS = 7
+
+// Tags offered for autocomplete on the submit and edit forms.
+const TAG_COMPLETE_LIMIT = 500
+
+// Lowercase with surrounding whitespace trimmed and inner whitespace collapsed
+// to single spaces, so "Go", " go" and "GO " are the same tag.
+func normalizeTag(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// Parse comma separated tags, normalized and without duplicates.
+func parseTags(tags string) []string {
+	var tt []string
+	for _, t := range strings.Split(tags, ",") {
+		t = normalizeTag(t)
+		if t == "" || listContains(tt, t) {
+			continue
+		}
+		tt = append(tt, t)
+	}
+	return tt
+}
+
+// Replace aliases in tt with their tags. Returns the tags and any that are blocked.
+func resolveTags(db *sql.DB, tt []string) ([]string, []string, error) {
+	var resolved, blocked []string
+	for _, t := range tt {
+		t, err := queryTagAlias(db, t)
+		if err != nil {
+			return nil, nil, err
+		}
+		isblocked, err := isTagBlocked(db, t)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isblocked {
+			blocked = append(blocked, t)
+			continue
+		}
+		if !listContains(resolved, t) {
+			resolved = append(resolved, t)
+		}
+	}
+	return resolved, blocked, nil
+}
+
+// Tag to filter listings by. Errors looking up the alias just use the tag as is.
+func resolveTag(db *sql.DB, tag string) string {
+	tag = normalizeTag(tag)
+	if tag == "" {
+		return ""
+	}
+	t, err := queryTagAlias(db, tag)
+	if err != nil {
+		log.Printf("DB error looking up tag alias (%s)\n", err)
+		return tag
+	}
+	return t
+}
+
+func blockedTagsErrmsg(blocked []string) string {
+	if len(blocked) == 1 {
+		return fmt.Sprintf("The tag '%s' isn't allowed.", blocked[0])
+	}
+	return fmt.Sprintf("The tags '%s' aren't allowed.", strings.Join(blocked, "', '"))
+}
+
+// Tag that alias stands for, or alias itself if it isn't one.
+func queryTagAlias(db *sql.DB, alias string) (string, error) {
+	var tag string
+	s := "SELECT tag FROM tagalias WHERE alias = ?"
+	err := db.QueryRow(s, alias).Scan(&tag)
+	if err == sql.ErrNoRows {
+		return alias, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return tag, nil
+}
+
+func isTagBlocked(db *sql.DB, tag string) (bool, error) {
+	var n int
+	s := "SELECT COUNT(*) FROM tagblock WHERE tag = ?"
+	err := db.QueryRow(s, tag).Scan(&n)
+	return n > 0, err
+}
+
+// sort is "name", "recent" or "popular" for the most used first.
+func queryTags(db *sql.DB, sort string) ([]TagCount, error) {
+	orderby := "nentries DESC, et.tag"
+	switch sort {
+	case "name":
+		orderby = "et.tag"
+	case "recent":
+		orderby = "nrecent DESC, lastdt DESC, et.tag"
+	}
+	s := fmt.Sprintf(`SELECT et.tag, COUNT(*) AS nentries, SUM(seconds_since_time(e.createdt) < ?) AS nrecent, MAX(e.createdt) AS lastdt
+FROM entrytag et
+INNER JOIN entry e ON et.entry_id = e.entry_id
+WHERE e.deleted = 0
+GROUP BY et.tag
+ORDER BY %s`, orderby)
+	rows, err := db.Query(s, TAG_RECENT_DAYS*24*60*60)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tt []TagCount
+	for rows.Next() {
+		var tc TagCount
+		err := rows.Scan(&tc.Tag, &tc.Nentries, &tc.Nrecent, &tc.Lastdt)
+		if err != nil {
+			return nil, err
+		}
+		tt = append(tt, tc)
+	}
+	return tt, rows.Err()
+}
+
+// Most used tags for autocomplete.
+func queryTagNames(db *sql.DB, limit int) ([]string, error) {
+	s := "SELECT et.tag FROM entrytag et INNER JOIN entry e ON et.entry_id = e.entry_id WHERE e.deleted = 0 GROUP BY et.tag ORDER BY COUNT(*) DESC, et.tag LIMIT ?"
+	rows, err := db.Query(s, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tt []string
+	for rows.Next() {
+		var t string
+		err := rows.Scan(&t)
+		if err != nil {
+			return nil, err
+		}
+		tt = append(tt, t)
+	}
+	return tt, rows.Err()
+}
+
+func queryTagAliases(db *sql.DB) ([]TagAlias, error) {
+	s := "SELECT alias, tag FROM tagalias ORDER BY tag, alias"
+	rows, err := db.Query(s)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aa []TagAlias
+	for rows.Next() {
+		var a TagAlias
+		err := rows.Scan(&a.Alias, &a.Tag)
+		if err != nil {
+			return nil, err
+		}
+		aa = append(aa, a)
+	}
+	return aa, rows.Err()
+}
+
+func queryBlockedTags(db *sql.DB) ([]string, error) {
+	s := "SELECT tag FROM tagblock ORDER BY tag"
+	rows, err := db.Query(s)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tt []string
+	for rows.Next() {
+		var t string
+		err := rows.Scan(&t)
+		if err != nil {
+			return nil, err
+		}
+		tt = append(tt, t)
+	}
+	return tt, rows.Err()
+}
+
+// Set entryid's tags to tt.
+func updateEntryTags(db *sql.DB, entryid int64, tt []string) error {
+	s := "DELETE FROM entrytag WHERE entry_id = ?"
+	_, err := sqlexec(db, s, entryid)
+	if err != nil {
+		return err
+	}
+	for _, t := range tt {
+		s := "INSERT OR IGNORE INTO entrytag (entry_id, tag) VALUES (?, ?)"
+		_, err := sqlexec(db, s, entryid, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move entries tagged from to tag to, which renames from if to isn't used yet.
+// Aliases of from become aliases of to, and from itself becomes one if alias is set.
+func mergeTag(tx *sql.Tx, from, to string, alias bool) error {
+	s := "INSERT OR IGNORE INTO entrytag (entry_id, tag) SELECT entry_id, ? FROM entrytag WHERE tag = ?"
+	_, err := txexec(tx, s, to, from)
+	if err != nil {
+		return err
+	}
+	s = "DELETE FROM entrytag WHERE tag = ?"
+	_, err = txexec(tx, s, from)
+	if err != nil {
+		return err
+	}
+	s = "UPDATE tagalias SET tag = ? WHERE tag = ?"
+	_, err = txexec(tx, s, to, from)
+	if err != nil {
+		return err
+	}
+	s = "DELETE FROM tagalias WHERE alias = ?"
+	_, err = txexec(tx, s, to)
+	if err != nil {
+		return err
+	}
+	if alias {
+		s = "INSERT OR REPLACE INTO tagalias (alias, tag) VALUES (?, ?)"
+		_, err = txexec(tx, s, from, to)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Block tag from being used, and remove it from the entries that have it.
+func blockTag(tx *sql.Tx, tag string) error {
+	s := "INSERT OR IGNORE INTO tagblock (tag, createdt) VALUES (?, ?)"
+	_, err := txexec(tx, s, tag, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	s = "DELETE FROM entrytag WHERE tag = ?"
+	_, err = txexec(tx, s, tag)
+	if err != nil {
+		return err
+	}
+	s = "DELETE FROM tagalias WHERE alias = ? OR tag = ?"
+	_, err = txexec(tx, s, tag, tag)
+	return err
+}
+
+func tagsHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := getLoginUser(r, db)
+		site := querySite(db)
+
+		sorts := []string{"popular", "recent", "name"}
+		qsort := r.FormValue("sort")
+		if !listContains(sorts, qsort) {
+			qsort = "popular"
+		}
+		tt, err := queryTags(db, qsort)
+		if handleDbErr(w, err, "tagshandler") {
+			return
+		}
+
+		data := struct {
+			Page
+			Sorts      []string
+			Sort       string
+			Tags       []TagCount
+			RecentDays int
+		}{newPage(r, db, login, site), sorts, qsort, tt, TAG_RECENT_DAYS}
+		renderPage(w, "tags.html", data)
+	}
+}
+
+func admintagsHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		login := getLoginUser(r, db)
+		if !isAdmin(login) {
+			logDebugf("admin tags: admin not logged in\n")
+			http.Error(w, "admin required", 401)
+			return
+		}
+
+		qtag := normalizeTag(r.FormValue("tag"))
+		qto := normalizeTag(r.FormValue("to"))
+		qalias := r.FormValue("alias") != ""
+
+		if r.Method == "POST" {
+			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+				if qtag == "" {
+					errmsg = "Please enter a tag."
+					break
+				}
+
+				var err error
+				qaction := r.FormValue("action")
+				switch qaction {
+				case "merge":
+					if qto == "" {
+						errmsg = "Please enter the tag to rename or merge into."
+						break
+					}
+					qto, err = queryTagAlias(db, qto)
+					if err != nil {
+						break
+					}
+					if qto == qtag {
+						errmsg = "Please enter a different tag."
+						break
+					}
+					var isblocked bool
+					isblocked, err = isTagBlocked(db, qto)
+					if err != nil {
+						break
+					}
+					if isblocked {
+						errmsg = blockedTagsErrmsg([]string{qto})
+						break
+					}
+					var tx *sql.Tx
+					tx, err = db.Begin()
+					if err != nil {
+						break
+					}
+					err = mergeTag(tx, qtag, qto, qalias)
+					if err == nil {
+						err = tx.Commit()
+					} else {
+						tx.Rollback()
+					}
+				case "block":
+					var tx *sql.Tx
+					tx, err = db.Begin()
+					if err != nil {
+						break
+					}
+					err = blockTag(tx, qtag)
+					if err == nil {
+						err = tx.Commit()
+					} else {
+						tx.Rollback()
+					}
+				case "unblock":
+					s := "DELETE FROM tagblock WHERE tag = ?"
+					_, err = sqlexec(db, s, qtag)
+				case "unalias":
+					s := "DELETE FROM tagalias WHERE alias = ?"
+					_, err = sqlexec(db, s, qtag)
+				default:
+					errmsg = "Unknown action."
+				}
+				if err != nil {
+					log.Printf("DB error updating tags (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+				}
+				if errmsg != "" {
+					break
+				}
+
+				reason := parseReason(r)
+				switch qaction {
+				case "merge":
+					logAudit(db, login, AUDIT_MERGE_TAG, AUDIT_TAG, 0, qtag, AuditFields{"tag": qtag}, AuditFields{"tag": qto, "alias": qalias}, reason)
+				case "block":
+					logAudit(db, login, AUDIT_BLOCK_TAG, AUDIT_TAG, 0, qtag, AuditFields{"blocked": false}, AuditFields{"blocked": true}, reason)
+				case "unblock":
+					logAudit(db, login, AUDIT_UNBLOCK_TAG, AUDIT_TAG, 0, qtag, AuditFields{"blocked": true}, AuditFields{"blocked": false}, reason)
+				case "unalias":
+					logAudit(db, login, AUDIT_UNALIAS_TAG, AUDIT_TAG, 0, qtag, AuditFields{"alias": qtag}, nil, reason)
+				}
+
+				http.Redirect(w, r, "/admintags/", http.StatusSeeOther)
+				return
+			}
+		}
+
+		aa, err := queryTagAliases(db)
+		if handleDbErr(w, err, "admintagshandler") {
+			return
+		}
+		blocked, err := queryBlockedTags(db)
+		if handleDbErr(w, err, "admintagshandler") {
+			return
+		}
+
+		data := struct {
+			Page
+			Tag     string
+			To      string
+			Alias   bool
+			Aliases []TagAlias
+			Blocked []string
+		}{newPage(r, db, login, querySite(db)), qtag, qto, qalias, aa, blocked}
+		data.Errmsg = errmsg
+		renderPage(w, "admintags.html", data)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		tags string
+		tt   []string
+	}{
+		{"", nil},
+		{"Go, go ,GO", []string{"go"}},
+		{" Machine   Learning, ,rust", []string{"machine learning", "rust"}},
+	}
+	for _, test := range tests {
+		tt := parseTags(test.tags)
+		if !reflect.DeepEqual(tt, test.tt) {
+			t.Errorf("parseTags(%q) = %q, expected %q", test.tags, tt, test.tt)
+		}
+	}
+}
+
+func TestMergeAndBlockTags(t *testing.T) {
+	db := openTestDb(t)
+	_, err := migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`INSERT INTO entry (entry_id, thing, title, createdt, user_id) VALUES (2, 0, 'two', '2024-01-01T00:00:00Z', 1)`,
+		`INSERT INTO entrytag (entry_id, tag) VALUES (1, 'golang'), (1, 'go'), (2, 'golang'), (2, 'spam')`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, _ := db.Begin()
+	err = mergeTag(tx, "golang", "go", true)
+	if err == nil {
+		err = blockTag(tx, "spam")
+	}
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	tags, err := queryTags(db, "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Tag != "go" || tags[0].Nentries != 2 {
+		t.Errorf("expected golang merged into go on both entries, got %+v", tags)
+	}
+
+	tt, blocked, err := resolveTags(db, parseTags("Golang, spam, go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tt, []string{"go"}) {
+		t.Errorf("expected alias to resolve to go, got %q", tt)
+	}
+	if !reflect.DeepEqual(blocked, []string{"spam"}) {
+		t.Errorf("expected spam to be blocked, got %q", blocked)
+	}
+	if resolveTag(db, " GoLang") != "go" {
+		t.Errorf("expected tag filter to use the alias")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Pages are rendered from the html/template files in templates/, which are
+// built into nb. Start nb with -templates <dir> to use a theme: each .html file
+// in dir replaces the built-in file of the same name, and any {{define}} in it
+// replaces the built-in block of the same name.
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var views = template.Must(loadTemplates(""))
+
+var templateFuncs = template.FuncMap{
+	// Markdown is sanitized when it's rendered, so it's passed through as is.
+	"markdown": func(s string) template.HTML {
+		return template.HTML(parseMarkdown(s))
+	},
+	// Search results with the matching words in <mark> tags.
+	"highlight": func(s string) template.HTML {
+		return template.HTML(highlightSearchText(s))
+	},
+	"date":           parseIsoDate,
+	"join":           strings.Join,
+	"title":          normalizeTitle,
+	"snippet":        textSnippet,
+	"summary":        entrySummary,
+	"itemurl":        createItemUrl,
+	"userurl":        createUserUrl,
+	"rolename":       roleName,
+	"thingname":      thingName,
+	"flagactionname": flagActionName,
+	"postpolicyname": postPolicyName,
+	"diffchanged":    diffChanged,
+	"feature":        featureEnabled,
+	"static":         staticUrl,
+	"issubmission":   func(thing int) bool { return thing == SUBMISSION },
+	"iscomment":      func(thing int) bool { return thing == COMMENT },
+	"isadmin":        isAdmin,
+	"canedituser":    canEditUser,
+	"ismoderator":    isModerator,
+	"voteunit":       getVoteUnit,
+	"pointunit":      getPointCountUnit,
+	"tokenexpired":   isTokenExpired,
+}
+
+func loadTemplates(themedir string) (*template.Template, error) {
+	t, err := template.New("").Funcs(templateFuncs).ParseFS(templateFS, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if themedir == "" {
+		return t, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(themedir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .html files in '%s'", themedir)
+	}
+	return t.ParseFiles(files...)
+}
+
+// Fields used by the page layout, embedded in the data of every page.
+type Page struct {
+	Site    *Site
+	Login   *User
+	Qi      *QIndex // listing filters for the nav links, nil outside of listings
+	Jsurls  []string
+	Csrftok string
+	Nunread int
+	Requri  string
+	Errmsg  string
+}
+
+func newPage(r *http.Request, db *sql.DB, login *User, site *Site) Page {
+	p := Page{
+		Site:   site,
+		Login:  login,
+		Requri: r.RequestURI,
+	}
+	if login.Sessionid != "" {
+		p.Csrftok = createCsrfToken(login.Sessionid)
+	}
+	if login.Userid != -1 {
+		nunread, err := queryUnreadCount(db, login.Userid)
+		if err != nil {
+			log.Printf("DB error querying unread notifications: %s\n", err)
+		}
+		p.Nunread = nunread
+	}
+	return p
+}
+
+// Previous and More links of a paged listing.
+type PagingNav struct {
+	Prev string
+	More string
+}
+
+func newPagingNav(baseurl string, offset, limit, nrows int) PagingNav {
+	var nav PagingNav
+	if offset > 0 {
+		prevOffset := offset - limit
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		nav.Prev = fmt.Sprintf("%s&offset=%d&limit=%d", baseurl, prevOffset, limit)
+	}
+	if nrows == limit {
+		nav.More = fmt.Sprintf("%s&offset=%d&limit=%d", baseurl, offset+limit, limit)
+	}
+	return nav
+}
+
+// Render to a buffer first so that a template error doesn't leave a half written page.
+func renderPage(w http.ResponseWriter, name string, data interface{}) {
+	var b bytes.Buffer
+	err := views.ExecuteTemplate(&b, name, data)
+	if err != nil {
+		log.Printf("error rendering %s (%s)\n", name, err)
+		http.Error(w, "Server error.", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTemplates(t *testing.T) {
+	tt, err := loadTemplates("")
+	if err != nil {
+		t.Fatalf("built-in templates failed to parse (%s)", err)
+	}
+	for _, name := range []string{"index.html", "item.html", "login.html", "user.html", "inbox.html"} {
+		if tt.Lookup(name) == nil {
+			t.Fatalf("missing built-in template %s", name)
+		}
+	}
+
+	dir := t.TempDir()
+	theme := `{{define "foot"}}<footer>my theme</footer>{{end}}`
+	err = os.WriteFile(filepath.Join(dir, "mytheme.html"), []byte(theme), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt, err = loadTemplates(dir)
+	if err != nil {
+		t.Fatalf("theme failed to parse (%s)", err)
+	}
+	var b bytes.Buffer
+	err = tt.ExecuteTemplate(&b, "foot", Page{})
+	if err != nil {
+		t.Fatalf("foot failed to render (%s)", err)
+	}
+	if !strings.Contains(b.String(), "my theme") {
+		t.Fatalf("theme block should replace the built-in one, got:\n%s", b.String())
+	}
+
+	if _, err := loadTemplates(t.TempDir()); err == nil {
+		t.Fatalf("theme dir without templates should fail")
+	}
+}
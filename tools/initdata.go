@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -133,10 +135,72 @@ func readItem(id int64) HNItem {
 	return item
 }
 
+// Add item as a submission by admin in the Main category, filling in
+// everything nb's createSubmission() does so that it shows up in search
+// and duplicate url detection.
 func enterItem(db *sql.DB, item HNItem) {
-	s := "INSERT INTO entry (thing, user_id, title, url, body, createdt) VALUES (0, 1, ?, ?, ?, ?)"
 	itemdt := time.Unix(item.Time, 0)
 	screatedt := itemdt.Format("2006-01-02T15:04:05+07:00")
-	_, err := sqlexec(db, s, item.Title, item.Url, item.Text, screatedt)
+
+	tx, err := db.Begin()
+	handleErr(err)
+	defer tx.Rollback()
+
+	s := "INSERT INTO entry (thing, user_id, title, url, normurl, body, createdt) VALUES (0, 1, ?, ?, ?, ?, ?)"
+	result, err := tx.Exec(s, item.Title, item.Url, normalizeUrl(item.Url), item.Text, screatedt)
 	handleErr(err)
+	entryid, err := result.LastInsertId()
+	handleErr(err)
+
+	s = "UPDATE entry SET root_id = entry_id WHERE entry_id = ?"
+	_, err = tx.Exec(s, entryid)
+	handleErr(err)
+	s = "INSERT INTO entrycat (entry_id, cat_id) VALUES (?, 1)"
+	_, err = tx.Exec(s, entryid)
+	handleErr(err)
+	s = "INSERT INTO entry_fts (rowid, title, body, url) VALUES (?, ?, ?, ?)"
+	_, err = tx.Exec(s, entryid, item.Title, item.Text, item.Url)
+	handleErr(err)
+
+	handleErr(tx.Commit())
+}
+
+// Same as normalizeUrl() in nb's dupurl.go, which this separate program
+// can't import.
+func normalizeUrl(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return s
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	q := u.Query()
+	for k := range q {
+		k2 := strings.ToLower(k)
+		if strings.HasPrefix(k2, "utm_") || k2 == "fbclid" || k2 == "gclid" {
+			q.Del(k)
+		}
+	}
+	u.RawQuery = q.Encode() // sorted by key
+	u.ForceQuery = false
+	return u.String()
 }
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Deleting an entry marks it deleted and moves it to the trash, its replies
+// are left alone. Deleted entries are left out of listings and search, and
+// shown as [deleted] in threads where they still have replies.
+//
+// Admins can restore entries from the trash at /admin/trash/, or purge them.
+// Entries are purged after site.Trashdays. Purging removes the entry and its
+// votes, flags and tags for good. An entry that still has replies keeps an
+// empty placeholder row so the thread stays together, and the row is removed
+// along with the last of its replies.
+
+const (
+	ENTRY_DELETED = 1 // in the trash
+	ENTRY_PURGED  = 2 // content removed, kept for its replies
+)
+
+const TRASH_PURGE_INTERVAL = time.Hour
+
+type TrashEntry struct {
+	Entry     Entry
+	Submitter User
+	Deletedby User
+	Deletedt  string
+}
+
+func delEntry(tx *sql.Tx, entryid, userid int64) error {
+	s := "UPDATE entry SET deleted = ?, deletedt = ?, deletedby = ? WHERE entry_id = ? AND deleted = 0"
+	_, err := txexec(tx, s, ENTRY_DELETED, time.Now().Format(time.RFC3339), userid, entryid)
+	if err != nil {
+		return err
+	}
+	return unindexEntrySearch(tx, entryid)
+}
+
+func restoreEntry(tx *sql.Tx, entryid int64) error {
+	var title, body, url string
+	s := "SELECT title, body, url FROM entry WHERE entry_id = ? AND deleted = ?"
+	err := tx.QueryRow(s, entryid, ENTRY_DELETED).Scan(&title, &body, &url)
+	if err != nil {
+		return err
+	}
+	s = "UPDATE entry SET deleted = 0, deletedt = '', deletedby = 0 WHERE entry_id = ?"
+	_, err = txexec(tx, s, entryid)
+	if err != nil {
+		return err
+	}
+	s = "INSERT INTO entry_fts (rowid, title, body, url) VALUES (?, ?, ?, ?)"
+	_, err = txexec(tx, s, entryid, title, body, url)
+	return err
+}
+
+// Remove deleted entryid for good, or just its content if it still has replies.
+// A purged parent left without replies is removed too.
+func purgeEntry(tx *sql.Tx, entryid int64) error {
+	var parentid int64
+	var nchildren int
+	s := "SELECT IFNULL(parent_id, 0), (SELECT COUNT(*) FROM entry child WHERE child.parent_id = e.entry_id) FROM entry e WHERE e.entry_id = ? AND e.deleted <> 0"
+	err := tx.QueryRow(s, entryid).Scan(&parentid, &nchildren)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range []string{
+		"DELETE FROM entryvote WHERE entry_id = ?",
+		"DELETE FROM entryflag WHERE entry_id = ?",
+		"DELETE FROM entrytag WHERE entry_id = ?",
+		"DELETE FROM entry_revision WHERE entry_id = ?",
+	} {
+		_, err := txexec(tx, s, entryid)
+		if err != nil {
+			return err
+		}
+	}
+	err = delEntryNotifications(tx, entryid)
+	if err != nil {
+		return err
+	}
+	err = unindexEntrySearch(tx, entryid)
+	if err != nil {
+		return err
+	}
+
+	if nchildren > 0 {
+		s = "UPDATE entry SET deleted = ?, title = '', url = '', normurl = '', body = '', description = '', thumburl = '', editdt = '' WHERE entry_id = ?"
+		_, err = txexec(tx, s, ENTRY_PURGED, entryid)
+		return err
+	}
+
+	s = "DELETE FROM entrycat WHERE entry_id = ?"
+	_, err = txexec(tx, s, entryid)
+	if err != nil {
+		return err
+	}
+	s = "DELETE FROM entry WHERE entry_id = ?"
+	_, err = txexec(tx, s, entryid)
+	if err != nil {
+		return err
+	}
+
+	if parentid == 0 {
+		return nil
+	}
+	var nsiblings int
+	s = "SELECT COUNT(*) FROM entry WHERE parent_id = ?"
+	err = tx.QueryRow(s, parentid).Scan(&nsiblings)
+	if err != nil {
+		return err
+	}
+	if nsiblings > 0 {
+		return nil
+	}
+	var deleted int
+	s = "SELECT deleted FROM entry WHERE entry_id = ?"
+	err = tx.QueryRow(s, parentid).Scan(&deleted)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil || deleted != ENTRY_PURGED {
+		return err
+	}
+	return purgeEntry(tx, parentid)
+}
+
+// Purge entries that have been in the trash longer than site.Trashdays.
+// Returns the number purged.
+func purgeExpiredTrash(db *sql.DB, site *Site) (int, error) {
+	if site.Trashdays <= 0 {
+		return 0, nil
+	}
+
+	// Replies before their parents, so that a parent is removed with its last reply.
+	s := "SELECT entry_id FROM entry WHERE deleted = ? AND seconds_since_time(deletedt) > ? ORDER BY entry_id DESC"
+	rows, err := db.Query(s, ENTRY_DELETED, site.Trashdays*24*60*60)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	npurged := 0
+	for _, id := range ids {
+		tx, err := db.Begin()
+		if err != nil {
+			return npurged, err
+		}
+		err = purgeEntry(tx, id)
+		if err == sql.ErrNoRows {
+			// Already removed along with a reply.
+			tx.Rollback()
+			continue
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			return npurged, err
+		}
+		npurged++
+	}
+	return npurged, nil
+}
+
+func runTrashPurge(db *sql.DB, stop <-chan struct{}) {
+	for {
+		n, err := purgeExpiredTrash(db, querySite(db))
+		if err != nil {
+			log.Printf("DB error purging trash (%s)\n", err)
+		} else if n > 0 {
+			logInfof("Purged %d deleted entries from the trash\n", n)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(TRASH_PURGE_INTERVAL):
+		}
+	}
+}
+
+// Entries in the trash, latest deleted first.
+func queryTrash(db *sql.DB, offset, limit int) ([]TrashEntry, error) {
+	s := `SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.createdt, IFNULL(e.parent_id, 0), e.deletedt,
+IFNULL(u.user_id, 0), IFNULL(u.username, ''), IFNULL(ud.user_id, 0), IFNULL(ud.username, '')
+FROM entry e
+LEFT OUTER JOIN user u ON e.user_id = u.user_id
+LEFT OUTER JOIN user ud ON e.deletedby = ud.user_id
+WHERE e.deleted = ?
+ORDER BY e.deletedt DESC, e.entry_id DESC
+LIMIT ? OFFSET ?`
+	rows, err := db.Query(s, ENTRY_DELETED, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tt []TrashEntry
+	for rows.Next() {
+		var te TrashEntry
+		err := rows.Scan(&te.Entry.Entryid, &te.Entry.Thing, &te.Entry.Title, &te.Entry.Url, &te.Entry.Body, &te.Entry.Createdt, &te.Entry.Parentid, &te.Deletedt,
+			&te.Submitter.Userid, &te.Submitter.Username, &te.Deletedby.Userid, &te.Deletedby.Username)
+		if err != nil {
+			return nil, err
+		}
+		te.Entry.Deleted = ENTRY_DELETED
+		te.Entry.Userid = te.Submitter.Userid
+		tt = append(tt, te)
+	}
+	return tt, rows.Err()
+}
+
+func queryTrashEntry(db *sql.DB, entryid int64) (*Entry, error) {
+	var e Entry
+	s := "SELECT entry_id, thing, title, url, body, createdt, user_id, deleted FROM entry WHERE entry_id = ? AND deleted = ?"
+	err := db.QueryRow(s, entryid, ENTRY_DELETED).Scan(&e.Entryid, &e.Thing, &e.Title, &e.Url, &e.Body, &e.Createdt, &e.Userid, &e.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// /admin/trash/
+// POST with action=restore or action=purge and the entry id.
+func trashHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		login := getLoginUser(r, db)
+		if !isAdmin(login) {
+			logDebugf("trash: admin not logged in\n")
+			http.Error(w, "admin required", 401)
+			return
+		}
+		site := querySite(db)
+
+		qoffset := atoi(r.FormValue("offset"))
+		if qoffset <= 0 {
+			qoffset = 0
+		}
+		qlimit := parseLimit(r.FormValue("limit"), cfg.Pagesize)
+
+		if r.Method == "POST" {
+			for {
+				if !checkCsrf(r, login) {
+					errmsg = CSRF_ERRMSG
+					break
+				}
+				qentryid := idtoi(r.FormValue("id"))
+				e, err := queryTrashEntry(db, qentryid)
+				if err == sql.ErrNoRows {
+					errmsg = "That entry isn't in the trash."
+					break
+				}
+				if err != nil {
+					log.Printf("DB error querying trash entry (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+
+				qaction := r.FormValue("action")
+				if qaction != "restore" && qaction != "purge" {
+					errmsg = "Unknown action."
+					break
+				}
+				tx, err := db.Begin()
+				if err == nil {
+					if qaction == "restore" {
+						err = restoreEntry(tx, e.Entryid)
+					} else {
+						err = purgeEntry(tx, e.Entryid)
+					}
+					if err == nil {
+						err = tx.Commit()
+					} else {
+						tx.Rollback()
+					}
+				}
+				if err != nil {
+					log.Printf("DB error updating trash entry (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+
+				if qaction == "restore" {
+					logAudit(db, login, AUDIT_RESTORE_ENTRY, AUDIT_ENTRY, e.Entryid, entrySummary(e), nil, entryAuditFields(e), parseReason(r))
+				} else {
+					logAudit(db, login, AUDIT_PURGE_ENTRY, AUDIT_ENTRY, e.Entryid, entrySummary(e), entryAuditFields(e), nil, parseReason(r))
+				}
+
+				http.Redirect(w, r, fmt.Sprintf("/admin/trash/?offset=%d&limit=%d", qoffset, qlimit), http.StatusSeeOther)
+				return
+			}
+		}
+
+		tt, err := queryTrash(db, qoffset, qlimit)
+		if handleDbErr(w, err, "trashhandler") {
+			return
+		}
+
+		data := struct {
+			Page
+			Entries   []TrashEntry
+			Trashdays int
+			Offset    int
+			Limit     int
+			Paging    PagingNav
+		}{newPage(r, db, login, site), tt, site.Trashdays, qoffset, qlimit, newPagingNav("/admin/trash/?", qoffset, qlimit, len(tt))}
+		data.Errmsg = errmsg
+		renderPage(w, "trash.html", data)
+	}
+}
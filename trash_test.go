@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestTrashPurgeKeepsReplies(t *testing.T) {
+	db := openTestDb(t)
+	_, err := migrateDb(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := Entry{Title: "sub", Url: "https://example.com/a", Userid: ADMIN_ID}
+	subid, err := createSubmission(db, &sub, 1, []string{"go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := Entry{Body: "parent comment", Parentid: subid, Userid: ADMIN_ID}
+	c1id, err := createComment(db, &c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := Entry{Body: "reply", Parentid: c1id, Userid: ADMIN_ID}
+	c2id, err := createComment(db, &c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inTx := func(fn func(tx *sql.Tx) error) {
+		t.Helper()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fn(tx)
+		if err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		tx.Commit()
+	}
+
+	// Deleted and restored.
+	inTx(func(tx *sql.Tx) error { return delEntry(tx, c1id, ADMIN_ID) })
+	if _, err := queryEntry(db, c1id); err != sql.ErrNoRows {
+		t.Errorf("expected deleted comment not to be found, got %v", err)
+	}
+	tt, err := queryTrash(db, 0, 10)
+	if err != nil || len(tt) != 1 || tt[0].Entry.Entryid != c1id || tt[0].Deletedby.Userid != ADMIN_ID {
+		t.Fatalf("expected deleted comment in the trash, got %+v (%v)", tt, err)
+	}
+	inTx(func(tx *sql.Tx) error { return restoreEntry(tx, c1id) })
+	if _, err := queryEntry(db, c1id); err != nil {
+		t.Errorf("expected restored comment to be found, got %v", err)
+	}
+
+	// Expired from the trash with a reply, its content is removed but the row is kept.
+	inTx(func(tx *sql.Tx) error { return delEntry(tx, c1id, ADMIN_ID) })
+	db.Exec("UPDATE entry SET deletedt = ? WHERE entry_id = ?", time.Now().AddDate(0, 0, -40).Format(time.RFC3339), c1id)
+	n, err := purgeExpiredTrash(db, &Site{Trashdays: 30})
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 purged, got %d (%v)", n, err)
+	}
+	var deleted int
+	var body string
+	err = db.QueryRow("SELECT deleted, body FROM entry WHERE entry_id = ?", c1id).Scan(&deleted, &body)
+	if err != nil || deleted != ENTRY_PURGED || body != "" {
+		t.Errorf("expected purged placeholder, got deleted=%d body='%s' (%v)", deleted, body, err)
+	}
+
+	// Purging the last reply removes the placeholder too.
+	inTx(func(tx *sql.Tx) error { return delEntry(tx, c2id, ADMIN_ID) })
+	inTx(func(tx *sql.Tx) error { return purgeEntry(tx, c2id) })
+	var nrows int
+	db.QueryRow("SELECT COUNT(*) FROM entry WHERE entry_id IN (?, ?)", c1id, c2id).Scan(&nrows)
+	if nrows != 0 {
+		t.Errorf("expected both comments removed, got %d rows", nrows)
+	}
+
+	// Purging a submission removes its tags.
+	inTx(func(tx *sql.Tx) error { return delEntry(tx, subid, ADMIN_ID) })
+	inTx(func(tx *sql.Tx) error { return purgeEntry(tx, subid) })
+	db.QueryRow("SELECT COUNT(*) FROM entrytag WHERE entry_id = ?", subid).Scan(&nrows)
+	if nrows != 0 {
+		t.Errorf("expected submission tags removed, got %d", nrows)
+	}
+}
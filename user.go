@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Public user profile at /user/?name=<username>&tab=<tab>
+
+const PROFILE_SUBMISSIONS = "submissions"
+const PROFILE_COMMENTS = "comments"
+const PROFILE_UPVOTED = "upvoted"
+
+// Votes are private, so only the user can see what they upvoted.
+func canViewUpvoted(login *User, u *User) bool {
+	return login.Userid != -1 && login.Userid == u.Userid
+}
+
+// Return page of u's submissions, comments or upvoted entries, latest first.
+func queryProfileEntries(db *sql.DB, site *Site, login *User, u *User, tab string, offset, limit int) ([]IndexEntry, error) {
+	var qq []interface{}
+	qq = append(qq, site.Gravityf, login.Userid)
+
+	var where string
+	switch tab {
+	case PROFILE_COMMENTS:
+		where = "e.thing = 1 AND e.user_id = ?"
+	case PROFILE_UPVOTED:
+		where = "e.entry_id IN (SELECT entry_id FROM entryvote WHERE user_id = ? AND dir > 0)"
+	default:
+		where = "e.thing = 0 AND e.user_id = ?"
+	}
+	qq = append(qq, u.Userid)
+	where += " AND e.deleted = 0"
+	cond, pp := flagHiddenCond(site, login)
+	where += cond
+	qq = append(qq, pp...)
+	qq = append(qq, limit, offset)
+
+	s := fmt.Sprintf(`SELECT e.entry_id, e.thing, e.title, e.url, e.body, e.description, e.thumburl, e.createdt, e.editdt, IFNULL(e.parent_id, 0), IFNULL(ec.cat_id, 0),
+IFNULL(u.user_id, 0), IFNULL(u.username, ''), IFNULL(uk.karma, 0),
+(SELECT COUNT(*) FROM entry AS child WHERE child.parent_id = e.entry_id AND child.deleted = 0) AS ncomments,
+IFNULL(totalvotes.votes, 0),
+IFNULL(ev.dir, 0),
+IFNULL(totalflags.flags, 0),
+calculate_points(IFNULL(totalvotes.votes, 0), e.createdt, %s) AS points
+FROM entry AS e
+LEFT OUTER JOIN entrycat ec ON e.entry_id = ec.entry_id
+LEFT OUTER JOIN cat c ON ec.cat_id = c.cat_id
+LEFT OUTER JOIN user u ON e.user_id = u.user_id
+LEFT OUTER JOIN userkarma uk ON e.user_id = uk.user_id
+LEFT OUTER JOIN totalvotes ON e.entry_id = totalvotes.entry_id
+LEFT OUTER JOIN totalflags ON e.entry_id = totalflags.entry_id
+LEFT OUTER JOIN entryvote ev ON ev.entry_id = e.entry_id AND ev.user_id = ?
+WHERE %s
+ORDER BY e.createdt DESC
+LIMIT ? OFFSET ?`, CAT_GRAVITYF_SQL, where)
+	rows, err := db.Query(s, qq...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ee []IndexEntry
+	for rows.Next() {
+		var ie IndexEntry
+		err := rows.Scan(&ie.Entry.Entryid, &ie.Entry.Thing, &ie.Entry.Title, &ie.Entry.Url, &ie.Entry.Body, &ie.Entry.Description, &ie.Entry.Thumburl, &ie.Entry.Createdt, &ie.Entry.Editdt, &ie.Entry.Parentid, &ie.Catid, &ie.Submitter.Userid, &ie.Submitter.Username, &ie.Submitter.Karma, &ie.Ncomments, &ie.TotalVotes, &ie.Selfvote, &ie.Nflags, &ie.Points)
+		if err != nil {
+			return nil, err
+		}
+		ie.Entry.Userid = ie.Submitter.Userid
+		ee = append(ee, ie)
+	}
+	return ee, rows.Err()
+}
+
+func profileTabs(login *User, u *User) []string {
+	tabs := []string{PROFILE_SUBMISSIONS, PROFILE_COMMENTS}
+	if canViewUpvoted(login, u) {
+		tabs = append(tabs, PROFILE_UPVOTED)
+	}
+	return tabs
+}
+
+func userHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := getLoginUser(r, db)
+		site := querySite(db)
+
+		u := queryUsername(db, r.FormValue("name"))
+		if u.Userid == -1 {
+			http.Error(w, "Not found.", 404)
+			return
+		}
+
+		qtab := r.FormValue("tab")
+		if qtab != PROFILE_COMMENTS && qtab != PROFILE_UPVOTED {
+			qtab = PROFILE_SUBMISSIONS
+		}
+		if qtab == PROFILE_UPVOTED && !canViewUpvoted(login, u) {
+			http.Error(w, "Not found.", 404)
+			return
+		}
+		qoffset := atoi(r.FormValue("offset"))
+		if qoffset <= 0 {
+			qoffset = 0
+		}
+		qlimit := parseLimit(r.FormValue("limit"), cfg.Pagesize)
+
+		ee, err := queryProfileEntries(db, site, login, u, qtab, qoffset, qlimit)
+		if handleDbErr(w, err, "userhandler") {
+			return
+		}
+
+		p := newPage(r, db, login, site)
+		p.Jsurls = []string{staticUrl("handlevote.js")}
+		var vv []EntryView
+		for _, ie := range ee {
+			ev := newEntryView(&p, ie)
+			if ie.Entry.Thing == SUBMISSION {
+				ev.Tags, _ = queryEntryTags(db, ie.Entry.Entryid)
+			} else {
+				ev.Parent = Entry{Entryid: ie.Entry.Parentid}
+				ev.Root, err = queryRootEntry(db, ie.Entry.Entryid)
+				if err != nil {
+					log.Printf("DB error querying root entry (%s)\n", err)
+				}
+			}
+			vv = append(vv, ev)
+		}
+
+		baseurl := fmt.Sprintf("%s&tab=%s", createUserUrl(u.Username), qtab)
+		data := struct {
+			Page
+			User    *User
+			Tab     string
+			Tabs    []string
+			Entries []EntryView
+			Paging  PagingNav
+		}{p, u, qtab, profileTabs(login, u), vv, newPagingNav(baseurl, qoffset, qlimit, len(ee))}
+		renderPage(w, "user.html", data)
+	}
+}